@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"slices"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// annotateUsages are the arguments of the commands that only change the
+// metadata of a snapshot
+var annotateUsages = map[string]string{
+	"pin":   "<name> <snapshot>",
+	"unpin": "<name> <snapshot>",
+	"tag":   "<name> <snapshot> <tag>...",
+	"untag": "<name> <snapshot> <tag>...",
+	"note":  "<name> <snapshot> [text...]",
+}
+
+// annotateCommand implements pin, unpin, tag, untag and note.
+func annotateCommand(command string, args []string) int {
+	flagSet := flag.NewFlagSet(command, flag.ExitOnError)
+	interval := flagSet.String("interval", "", "Interval of the snapshot number, the first interval when empty")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: snapsync %s %s\n", command, annotateUsages[command])
+		fmt.Fprintln(flagSet.Output(), "A snapshot is given by its number or by the name of its dir.")
+		if command == "note" {
+			fmt.Fprintln(flagSet.Output(), "Without text the note is removed.")
+		}
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	switch command {
+	case "pin", "unpin":
+		if len(positional) != 2 {
+			flagSet.Usage()
+			return exitUsage
+		}
+	case "tag", "untag":
+		if len(positional) < 3 {
+			flagSet.Usage()
+			return exitUsage
+		}
+	case "note":
+		if len(positional) < 2 {
+			flagSet.Usage()
+			return exitUsage
+		}
+	}
+	tags := positional[2:]
+	if command == "tag" {
+		for _, tag := range tags {
+			err = validateTag(tag)
+			if err != nil {
+				slog.Error(err.Error())
+				return exitUsage
+			}
+		}
+	}
+
+	snapshotName := positional[0]
+	snapshotConfig, err := configs.GetSnapshotConfigByName(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("An error occurred: " + err.Error())
+		return exitError
+	}
+	if snapshotConfig == nil {
+		slog.Error("Snapshot template " + snapshotName + " does not exist.")
+		return exitError
+	}
+	snapshotsInfo, err := snapshots.GetSnapshotsInfo(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("Can't get snapshots of snapshot " + snapshotName + ": " + err.Error())
+		return exitError
+	}
+	snapshotInfo, err := findSnapshot(snapshotConfig, snapshotsInfo, *interval, positional[1])
+	if err != nil {
+		slog.Error(err.Error())
+		return exitError
+	}
+	var done string
+	err = snapshots.UpdateSnapshotMetadata(snapshotConfig, snapshotInfo, func(metadata *structs.SnapshotMetadata) {
+		switch command {
+		case "pin":
+			metadata.Pinned = true
+			done = "Pinned"
+		case "unpin":
+			metadata.Pinned = false
+			done = "Unpinned"
+		case "tag":
+			for _, tag := range tags {
+				if !slices.Contains(metadata.Tags, tag) {
+					metadata.Tags = append(metadata.Tags, tag)
+				}
+			}
+			done = "Tagged"
+		case "untag":
+			metadata.Tags = slices.DeleteFunc(metadata.Tags, func(tag string) bool {
+				return slices.Contains(tags, tag)
+			})
+			done = "Untagged"
+		case "note":
+			metadata.Note = strings.Join(tags, " ")
+			done = "Noted"
+			if len(metadata.Note) == 0 {
+				done = "Removed the note of"
+			}
+		}
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("Can't update %s: %s", snapshotInfo.Abspath, err.Error()))
+		return exitError
+	}
+	fmt.Printf("%s %s\n", done, path.Base(snapshotInfo.Abspath))
+	return exitOK
+}
+
+func validateTag(tag string) error {
+	// tags are joined with commas and semicolons in the list output
+	if len(strings.TrimSpace(tag)) == 0 || strings.ContainsAny(tag, ",;") {
+		return fmt.Errorf("invalid tag %q, tags can't be empty or contain commas and semicolons", tag)
+	}
+	return nil
+}
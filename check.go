@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"strings"
+
+	"github.com/go-co-op/gocron/v2"
+	"golang.org/x/exp/slog"
+)
+
+func checkCommand(args []string) int {
+	flagSet := flag.NewFlagSet("check", flag.ExitOnError)
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync check")
+		fmt.Fprintln(flagSet.Output(), "Validates config.yml and the snapshot configs, their cron strings, paths and executables.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 0 {
+		flagSet.Usage()
+		return exitUsage
+	}
+
+	config, err := configs.LoadConfig(*configsDir, *expandVars)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		return exitError
+	}
+	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(*configsDir, *expandVars)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		return exitError
+	}
+	if len(snapshotsConfigs) == 0 {
+		fmt.Printf("warning: no snapshot config in %s\n", *configsDir)
+	}
+	scheduler, err := gocron.NewScheduler()
+	if err != nil {
+		fmt.Printf("error: can't create scheduler: %s\n", err.Error())
+		return exitError
+	}
+	defer scheduler.Shutdown()
+
+	exitCode := exitOK
+	names := map[string]bool{}
+	for _, snapshotConfig := range snapshotsConfigs {
+		problems := checkSnapshotConfig(config, snapshotConfig, scheduler)
+		if names[snapshotConfig.SnapshotName] {
+			problems = append(problems, "error: another snapshot config has the same snapshot_name")
+		}
+		names[snapshotConfig.SnapshotName] = true
+		failed := false
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", snapshotConfig.SnapshotName, problem)
+			if strings.HasPrefix(problem, "error") {
+				failed = true
+			}
+		}
+		if failed {
+			exitCode = exitError
+		} else {
+			fmt.Printf("%s: ok\n", snapshotConfig.SnapshotName)
+		}
+	}
+	return exitCode
+}
+
+// checkSnapshotConfig returns what is wrong with snapshotConfig beyond what
+// loading it validates, each problem starting with error or warning.
+func checkSnapshotConfig(config *structs.Config, snapshotConfig *structs.SnapshotConfig, scheduler gocron.Scheduler) (problems []string) {
+	for _, interval := range snapshotConfig.Intervals {
+		if len(interval.Cron) == 0 {
+			continue
+		}
+		_, err := scheduler.NewJob(gocron.CronJob(interval.Cron, false), gocron.NewTask(func() {}))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("error: interval %s has an invalid cron %q: %s", interval.Name, interval.Cron, err.Error()))
+		}
+	}
+	if len(snapshotConfig.SnapshotsDir) == 0 || !filepath.IsAbs(snapshotConfig.SnapshotsDir) {
+		problems = append(problems, "error: snapshots_dir must be an absolute path")
+	} else if stat, err := os.Stat(snapshotConfig.SnapshotsDir); err != nil {
+		if os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("warning: snapshots_dir %s doesn't exist, it will be created", snapshotConfig.SnapshotsDir))
+		} else {
+			problems = append(problems, fmt.Sprintf("error: can't stat snapshots_dir: %s", err.Error()))
+		}
+	} else if !stat.IsDir() {
+		problems = append(problems, fmt.Sprintf("error: snapshots_dir %s is not a directory", snapshotConfig.SnapshotsDir))
+	}
+	if len(snapshotConfig.Dirs) == 0 {
+		problems = append(problems, "warning: no dirs to snapshot")
+	}
+	for _, dir := range snapshotConfig.Dirs {
+		stat, err := os.Stat(dir.SrcDirAbspath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				problems = append(problems, fmt.Sprintf("warning: src dir %s doesn't exist, its previous copy will be kept", dir.SrcDirAbspath))
+			} else {
+				problems = append(problems, fmt.Sprintf("error: can't stat src dir: %s", err.Error()))
+			}
+		} else if !stat.IsDir() {
+			problems = append(problems, fmt.Sprintf("error: src dir %s is not a directory", dir.SrcDirAbspath))
+		}
+	}
+	for _, executable := range snapshots.GetExecutables(config, snapshotConfig) {
+		_, err := exec.LookPath(executable)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("error: can't find %s: %s", executable, err.Error()))
+		}
+	}
+	return problems
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path"
 	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -25,6 +26,12 @@ func LoadConfig(configsDir string, expandVars bool) (config *structs.Config, err
 	if err != nil {
 		return nil, fmt.Errorf("can't parse %s: %s", configPath, err.Error())
 	}
+	if len(config.Engine) == 0 {
+		config.Engine = structs.EngineNative
+	}
+	if config.Engine != structs.EngineNative && config.Engine != structs.EngineRsync {
+		return nil, fmt.Errorf("%s: engine must be %s or %s", configPath, structs.EngineNative, structs.EngineRsync)
+	}
 	return config, nil
 }
 
@@ -59,6 +66,34 @@ func LoadSnapshotsConfigs(configsDir string, expandVars bool) (snapshotsConfigs
 				return nil, fmt.Errorf("%s: src_dir_abspath must be an absolute path", snapshotConfig.SnapshotName)
 			}
 		}
+		if len(snapshotConfig.Naming) == 0 {
+			snapshotConfig.Naming = structs.NamingNumber
+		}
+		if len(snapshotConfig.PreRestoreRetention) == 0 {
+			snapshotConfig.PreRestoreRetention = "7d"
+		}
+		if len(snapshotConfig.Intervals) == 0 {
+			snapshotConfig.Intervals = []structs.SnapshotInterval{{
+				Name:            snapshotConfig.Interval,
+				Retention:       snapshotConfig.Retention,
+				Cron:            snapshotConfig.Cron,
+				RetentionPolicy: snapshotConfig.RetentionPolicy,
+			}}
+		}
+		for i := range snapshotConfig.Intervals {
+			if len(snapshotConfig.Intervals[i].Promote) == 0 {
+				snapshotConfig.Intervals[i].Promote = structs.PromoteMove
+			}
+		}
+		// the base tier is the one that syncs the sources
+		snapshotConfig.Interval = snapshotConfig.Intervals[0].Name
+		snapshotConfig.Retention = snapshotConfig.Intervals[0].Retention
+		snapshotConfig.Cron = snapshotConfig.Intervals[0].Cron
+		snapshotConfig.RetentionPolicy = snapshotConfig.Intervals[0].RetentionPolicy
+		err = ValidateSnapshotConfig(&snapshotConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", absPath, err.Error())
+		}
 		snapshotsConfigs = append(snapshotsConfigs, &snapshotConfig)
 	}
 	return snapshotsConfigs, nil
@@ -71,6 +106,53 @@ func ValidateSnapshotConfig(snapshotConfig *structs.SnapshotConfig) error {
 	if strings.Contains(snapshotConfig.Interval, ".") || strings.Contains(snapshotConfig.Interval, " ") {
 		return fmt.Errorf("snapshot %s's interval must not include dots or a whitespaces", snapshotConfig.SnapshotName)
 	}
+	intervalNames := map[string]bool{}
+	for i, interval := range snapshotConfig.Intervals {
+		if len(interval.Name) == 0 || strings.Contains(interval.Name, ".") || strings.Contains(interval.Name, " ") {
+			return fmt.Errorf("snapshot %s's intervals must have a name without dots or whitespaces", snapshotConfig.SnapshotName)
+		}
+		if interval.Name == structs.PreRestoreInterval {
+			return fmt.Errorf("snapshot %s's interval can't be named %s", snapshotConfig.SnapshotName, structs.PreRestoreInterval)
+		}
+		if intervalNames[interval.Name] {
+			return fmt.Errorf("snapshot %s has interval %s more than once", snapshotConfig.SnapshotName, interval.Name)
+		}
+		intervalNames[interval.Name] = true
+		// a tier that is promoted must keep at least one snapshot to promote
+		if i < len(snapshotConfig.Intervals)-1 && interval.Retention < 1 {
+			return fmt.Errorf("snapshot %s's interval %s must have a retention of at least 1", snapshotConfig.SnapshotName, interval.Name)
+		}
+		if interval.RetentionPolicy != nil && len(interval.RetentionPolicy.KeepWithin) > 0 {
+			_, err := utils.ParseDuration(interval.RetentionPolicy.KeepWithin)
+			if err != nil {
+				return fmt.Errorf("snapshot %s's interval %s keep_within: %s", snapshotConfig.SnapshotName, interval.Name, err.Error())
+			}
+		}
+		if interval.Promote != structs.PromoteMove && interval.Promote != structs.PromoteLink {
+			return fmt.Errorf("snapshot %s's interval %s promote must be %s or %s", snapshotConfig.SnapshotName, interval.Name, structs.PromoteMove, structs.PromoteLink)
+		}
+	}
+	if len(snapshotConfig.MinFreeSpace) > 0 && !strings.HasSuffix(snapshotConfig.MinFreeSpace, "%") {
+		_, err := utils.ParseSize(snapshotConfig.MinFreeSpace)
+		if err != nil {
+			return fmt.Errorf("snapshot %s's min_free_space: %s", snapshotConfig.SnapshotName, err.Error())
+		}
+	}
+	if len(snapshotConfig.MaxTotalSize) > 0 {
+		_, err := utils.ParseSize(snapshotConfig.MaxTotalSize)
+		if err != nil {
+			return fmt.Errorf("snapshot %s's max_total_size: %s", snapshotConfig.SnapshotName, err.Error())
+		}
+	}
+	if len(snapshotConfig.PreRestoreRetention) > 0 {
+		_, err := utils.ParseDuration(snapshotConfig.PreRestoreRetention)
+		if err != nil {
+			return fmt.Errorf("snapshot %s's pre_restore_retention: %s", snapshotConfig.SnapshotName, err.Error())
+		}
+	}
+	if snapshotConfig.Naming != structs.NamingNumber && snapshotConfig.Naming != structs.NamingTimestamp {
+		return fmt.Errorf("snapshot %s's naming must be %s or %s", snapshotConfig.SnapshotName, structs.NamingNumber, structs.NamingTimestamp)
+	}
 	return nil
 }
 
@@ -95,3 +177,19 @@ func GetSnapshotConfigByName(configsDir string, expandVars bool, snapshotName st
 	}
 	return nil, nil
 }
+
+// GetIntervalConfig returns a copy of snapshotConfig where Interval, Retention
+// and Cron are the ones of the tier named interval.
+func GetIntervalConfig(snapshotConfig *structs.SnapshotConfig, interval string) (*structs.SnapshotConfig, error) {
+	for _, snapshotInterval := range snapshotConfig.Intervals {
+		if snapshotInterval.Name == interval {
+			intervalConfig := *snapshotConfig
+			intervalConfig.Interval = snapshotInterval.Name
+			intervalConfig.Retention = snapshotInterval.Retention
+			intervalConfig.Cron = snapshotInterval.Cron
+			intervalConfig.RetentionPolicy = snapshotInterval.RetentionPolicy
+			return &intervalConfig, nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s has no interval %s", snapshotConfig.SnapshotName, interval)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/exp/slog"
+)
+
+// controlSocketName is the unix socket of the daemon in the configs dir.
+// Commands hand their work to the daemon through it instead of racing it.
+const controlSocketName = "snapsync.sock"
+
+const controlCommandSnap = "snap"
+
+// controlRequest is the single line of JSON sent on a connection to the
+// daemon, which answers with a single line of JSON too.
+type controlRequest struct {
+	Command string       `json:"command"`
+	Snap    *snapRequest `json:"snap,omitempty"`
+}
+
+func getControlSocketPath(configsDir string) string {
+	return filepath.Join(configsDir, controlSocketName)
+}
+
+// listenControl serves the control socket of configsDir, answering every
+// request with what handle returns. It fails if another daemon serves it.
+func listenControl(configsDir string, handle func(request controlRequest) any) (net.Listener, error) {
+	socketPath := getControlSocketPath(configsDir)
+	connection, err := net.Dial("unix", socketPath)
+	if err == nil {
+		connection.Close()
+		return nil, fmt.Errorf("another snapsync daemon is listening on %s", socketPath)
+	}
+	// the socket of a daemon that didn't exit cleanly
+	err = os.Remove(socketPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't remove stale socket %s: %s", socketPath, err.Error())
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on %s: %s", socketPath, err.Error())
+	}
+	// only the user running the daemon can ask for snapshots
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("can't restrict permissions of %s: %s", socketPath, err.Error())
+	}
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveControlConnection(connection, handle)
+		}
+	}()
+	return listener, nil
+}
+
+func serveControlConnection(connection net.Conn, handle func(request controlRequest) any) {
+	defer connection.Close()
+	request := controlRequest{}
+	err := json.NewDecoder(connection).Decode(&request)
+	if err != nil {
+		slog.Warn("Invalid control request: " + err.Error())
+		return
+	}
+	err = json.NewEncoder(connection).Encode(handle(request))
+	if err != nil {
+		slog.Warn("Can't answer control request: " + err.Error())
+	}
+}
+
+// callDaemon sends request to the daemon of configsDir and decodes its answer
+// into response. handled is false when no daemon is running.
+func callDaemon(configsDir string, request controlRequest, response any) (handled bool, err error) {
+	socketPath := getControlSocketPath(configsDir)
+	connection, err := net.Dial("unix", socketPath)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("No daemon on %s: %s", socketPath, err.Error()))
+		return false, nil
+	}
+	defer connection.Close()
+	err = json.NewEncoder(connection).Encode(request)
+	if err != nil {
+		return true, fmt.Errorf("can't send the request to the daemon: %s", err.Error())
+	}
+	err = json.NewDecoder(connection).Decode(response)
+	if err != nil {
+		return true, fmt.Errorf("can't read the answer of the daemon: %s", err.Error())
+	}
+	return true, nil
+}
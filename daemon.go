@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+	"golang.org/x/exp/slog"
+)
+
+func runCommand(args []string) int {
+	flagSet := flag.NewFlagSet("run", flag.ExitOnError)
+	interval := flagSet.String("interval", "", "Interval to take or promote, the first interval when empty")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync run [<name>...] [--interval INTERVAL]")
+		fmt.Fprintln(flagSet.Output(), "Takes a snapshot of every snapshot config, or of the given ones, once and exits.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+
+	config, snapshotsConfigs, exitCode := loadConfigsForRun(*configsDir, *expandVars)
+	if exitCode != exitOK {
+		return exitCode
+	}
+	if len(positional) > 0 {
+		selected := []*structs.SnapshotConfig{}
+		for _, snapshotName := range positional {
+			snapshotConfig := getSnapshotConfig(snapshotsConfigs, snapshotName)
+			if snapshotConfig == nil {
+				slog.Error("Snapshot template " + snapshotName + " does not exist.")
+				return exitError
+			}
+			selected = append(selected, snapshotConfig)
+		}
+		snapshotsConfigs = selected
+	}
+	if len(*interval) > 0 {
+		for _, snapshotConfig := range snapshotsConfigs {
+			_, err = configs.GetIntervalConfig(snapshotConfig, *interval)
+			if err != nil {
+				slog.Error(err.Error())
+				return exitUsage
+			}
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return runSnapshots(ctx, config, snapshotsConfigs, *interval)
+}
+
+func daemonCommand(args []string) int {
+	flagSet := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	gracePeriod := flagSet.Duration("grace-period", defaultGracePeriod, "How long the running snapshots have to finish when stopped before they are canceled")
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync daemon [--grace-period DURATION]")
+		fmt.Fprintln(flagSet.Output(), "Takes the snapshots on the cron schedules of their intervals and the ones asked with snapsync snap.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 0 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	config, snapshotsConfigs, exitCode := loadConfigsForRun(*configsDir, *expandVars)
+	if exitCode != exitOK {
+		return exitCode
+	}
+	return runDaemon(config, *configsDir, *expandVars, snapshotsConfigs, *gracePeriod)
+}
+
+// loadConfigsForRun loads the configs to take snapshots of, creating the
+// configs dir on the first run, and recovers their snapshots.
+func loadConfigsForRun(configsDir string, expandVars bool) (*structs.Config, []*structs.SnapshotConfig, int) {
+	err := os.MkdirAll(configsDir, 0700)
+	if err != nil {
+		slog.Error("Can't create configs dir " + configsDir + ": " + err.Error())
+		return nil, nil, exitError
+	}
+	config, err := configs.LoadConfig(configsDir, expandVars)
+	if err != nil {
+		slog.Error("Can't get " + configsDir + ": " + err.Error())
+		return nil, nil, exitError
+	}
+	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(configsDir, expandVars)
+	if err != nil {
+		slog.Error("Can't get snapshots configs in " + configsDir + ": " + err.Error())
+		return nil, nil, exitError
+	}
+	// finish or undo rotations interrupted by a crash before touching the snapshots
+	for _, snapshotConfig := range snapshotsConfigs {
+		err = snapshots.RecoverSnapshots(snapshotConfig)
+		if err != nil {
+			slog.Error("Can't recover snapshots of " + snapshotConfig.SnapshotName + ": " + err.Error())
+		}
+	}
+	return config, snapshotsConfigs, exitOK
+}
+
+func getSnapshotConfig(snapshotsConfigs []*structs.SnapshotConfig, snapshotName string) *structs.SnapshotConfig {
+	for _, snapshotConfig := range snapshotsConfigs {
+		if snapshotConfig.SnapshotName == snapshotName {
+			return snapshotConfig
+		}
+	}
+	return nil
+}
+
+func hasCron(snapshotConfig *structs.SnapshotConfig) bool {
+	for _, interval := range snapshotConfig.Intervals {
+		if len(interval.Cron) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runSnapshots runs interval, or the first interval when empty, of every
+// snapshot config one after the other. The exit code is exitBusy when the only
+// failures were snapshots locked by another process.
+func runSnapshots(ctx context.Context, config *structs.Config, snapshotsConfigs []*structs.SnapshotConfig, interval string) int {
+	exitCode := exitOK
+	for _, snapshotConfig := range snapshotsConfigs {
+		snapshotInterval := interval
+		if len(snapshotInterval) == 0 {
+			snapshotInterval = snapshotConfig.Interval
+		}
+		if ctx.Err() != nil {
+			slog.Warn(fmt.Sprintf("[%s] not started, canceled", snapshotConfig.SnapshotName))
+			exitCode = exitError
+			continue
+		}
+		err := snapshots.ExecuteInterval(ctx, config, snapshotConfig, snapshotInterval)
+		if err == nil {
+			continue
+		}
+		slog.Error(fmt.Sprintf("[%s] can't execute snapshot %s: %s", snapshotConfig.SnapshotName, snapshotInterval, err.Error()))
+		if errors.Is(err, snapshots.ErrSnapshotsLocked) {
+			if exitCode == exitOK {
+				exitCode = exitBusy
+			}
+		} else {
+			exitCode = exitError
+		}
+	}
+	return exitCode
+}
+
+// defaultGracePeriod is how long the running snapshots have to finish when
+// the daemon is stopped before they are canceled
+const defaultGracePeriod = 5 * time.Minute
+
+// daemonJob is an interval scheduled by the daemon
+type daemonJob struct {
+	snapshotName string
+	interval     string
+	cron         string
+	job          gocron.Job
+}
+
+// daemon takes the scheduled snapshots and the ones asked on the control
+// socket. Every field after mutex is guarded by it.
+type daemon struct {
+	configsDir string
+	expandVars bool
+	startedAt  time.Time
+	scheduler  gocron.Scheduler
+	// ctx is canceled when the running snapshots must stop
+	ctx   context.Context
+	tasks sync.WaitGroup
+
+	mutex            sync.Mutex
+	config           *structs.Config
+	snapshotsConfigs []*structs.SnapshotConfig
+	jobs             []daemonJob
+	// the tiers of a snapshot config share their snapshots, so their jobs must not overlap
+	snapshotConfigsLocks map[string]*sync.Mutex
+	// running and lastRuns are keyed by <name>.<interval> for snapsync status
+	running  map[string]bool
+	lastRuns map[string]time.Time
+	stopping bool
+}
+
+// runDaemon schedules the intervals with a cron of snapshotsConfigs and serves
+// the control socket of configsDir. SIGHUP reloads the configs, SIGTERM and
+// SIGINT stop the daemon, giving the running snapshots gracePeriod to finish.
+func runDaemon(config *structs.Config, configsDir string, expandVars bool, snapshotsConfigs []*structs.SnapshotConfig, gracePeriod time.Duration) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler, err := gocron.NewScheduler()
+	if err != nil {
+		slog.Error("can't create scheduler: " + err.Error())
+		return exitError
+	}
+	d := &daemon{
+		configsDir:           configsDir,
+		expandVars:           expandVars,
+		startedAt:            time.Now(),
+		scheduler:            scheduler,
+		ctx:                  ctx,
+		snapshotConfigsLocks: map[string]*sync.Mutex{},
+		running:              map[string]bool{},
+		lastRuns:             map[string]time.Time{},
+	}
+	err = d.schedule(config, snapshotsConfigs)
+	if err != nil {
+		slog.Error(err.Error())
+		scheduler.Shutdown()
+		return exitError
+	}
+	// snap commands are run by the daemon, after the job of the same config
+	listener, err := listenControl(configsDir, d.handleControl)
+	if err != nil {
+		slog.Error(err.Error())
+		scheduler.Shutdown()
+		return exitError
+	}
+	scheduler.Start()
+
+	for received := range signals {
+		if received == syscall.SIGHUP {
+			d.reload()
+			continue
+		}
+		slog.Info(fmt.Sprintf("Received %s, stopping", received))
+		break
+	}
+	// closing the listener removes the socket
+	listener.Close()
+	// the jobs starting from now return at once, the scheduler is shut down
+	// once the running ones are done since it only waits for them so long
+	d.mutex.Lock()
+	d.stopping = true
+	d.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.tasks.Wait()
+		close(done)
+	}()
+	timeout := time.After(gracePeriod)
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case <-timeout:
+			slog.Warn(fmt.Sprintf("The running snapshots didn't finish within %s, canceling them", gracePeriod))
+			cancel()
+		case received := <-signals:
+			if received != syscall.SIGHUP {
+				slog.Warn(fmt.Sprintf("Received %s again, canceling the running snapshots", received))
+				cancel()
+			}
+		}
+	}
+	err = scheduler.Shutdown()
+	if err != nil {
+		slog.Warn("Can't shut down the scheduler: " + err.Error())
+	}
+	slog.Info("Stopped")
+	return exitOK
+}
+
+// schedule replaces the jobs of the daemon with the intervals with a cron of
+// snapshotsConfigs. When a job can't be created the previous jobs are kept.
+func (d *daemon) schedule(config *structs.Config, snapshotsConfigs []*structs.SnapshotConfig) error {
+	jobs := []daemonJob{}
+	removeJobs := func(jobs []daemonJob) {
+		for _, job := range jobs {
+			err := d.scheduler.RemoveJob(job.job.ID())
+			if err != nil {
+				slog.Warn(fmt.Sprintf("Can't remove job of %s %s: %s", job.snapshotName, job.interval, err.Error()))
+			}
+		}
+	}
+	for _, snapshotConfig := range snapshotsConfigs {
+		for _, interval := range snapshotConfig.Intervals {
+			if len(interval.Cron) == 0 {
+				continue
+			}
+			job, err := d.scheduler.NewJob(
+				gocron.CronJob(interval.Cron, false),
+				gocron.NewTask(
+					d.runJob,
+					snapshotConfig,
+					interval.Name,
+				),
+			)
+			if err != nil {
+				removeJobs(jobs)
+				return fmt.Errorf("can't add cron job for snapshot %s %s. Cron string is %s", snapshotConfig.SnapshotName, interval.Name, interval.Cron)
+			}
+			jobs = append(jobs, daemonJob{snapshotName: snapshotConfig.SnapshotName, interval: interval.Name, cron: interval.Cron, job: job})
+		}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	removeJobs(d.jobs)
+	d.config = config
+	d.snapshotsConfigs = snapshotsConfigs
+	d.jobs = jobs
+	for _, job := range jobs {
+		slog.Info(fmt.Sprintf("[%s] %s scheduled with cron %s", job.snapshotName, job.interval, job.cron))
+	}
+	if len(jobs) == 0 {
+		slog.Warn("No snapshot config has a cron, only the snapshots asked with snapsync snap will be taken")
+	}
+	return nil
+}
+
+// reload loads the configs again and reschedules the jobs. The snapshots
+// already running finish with the configs they started with.
+func (d *daemon) reload() {
+	slog.Info("Reloading the configs in " + d.configsDir)
+	config, err := configs.LoadConfig(d.configsDir, d.expandVars)
+	if err != nil {
+		slog.Error("Can't reload " + d.configsDir + ", keeping the current configs: " + err.Error())
+		return
+	}
+	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(d.configsDir, d.expandVars)
+	if err != nil {
+		slog.Error("Can't reload snapshots configs in " + d.configsDir + ", keeping the current configs: " + err.Error())
+		return
+	}
+	err = d.schedule(config, snapshotsConfigs)
+	if err != nil {
+		slog.Error(err.Error() + ", keeping the current configs")
+	}
+}
+
+// startTask waits for the other tasks of the snapshot config and marks the
+// task as running. It returns false when the daemon is stopping.
+func (d *daemon) startTask(snapshotName string, interval string) (config *structs.Config, ok bool) {
+	d.mutex.Lock()
+	snapshotConfigLock, ok := d.snapshotConfigsLocks[snapshotName]
+	if !ok {
+		snapshotConfigLock = &sync.Mutex{}
+		d.snapshotConfigsLocks[snapshotName] = snapshotConfigLock
+	}
+	d.mutex.Unlock()
+	snapshotConfigLock.Lock()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopping {
+		snapshotConfigLock.Unlock()
+		return nil, false
+	}
+	d.tasks.Add(1)
+	key := snapshotName + "." + interval
+	d.running[key] = true
+	d.lastRuns[key] = time.Now()
+	return d.config, true
+}
+
+func (d *daemon) finishTask(snapshotName string, interval string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.running[snapshotName+"."+interval] = false
+	d.snapshotConfigsLocks[snapshotName].Unlock()
+	d.tasks.Done()
+}
+
+func (d *daemon) runJob(snapshotConfig *structs.SnapshotConfig, interval string) {
+	config, ok := d.startTask(snapshotConfig.SnapshotName, interval)
+	if !ok {
+		slog.Info(fmt.Sprintf("[%s] not starting %s, the daemon is stopping", snapshotConfig.SnapshotName, interval))
+		return
+	}
+	defer d.finishTask(snapshotConfig.SnapshotName, interval)
+	snapshotErr := snapshots.ExecuteInterval(d.ctx, config, snapshotConfig, interval)
+	if snapshotErr != nil {
+		slog.Error(fmt.Sprintf("[%s] can't execute snapshot %s: %s", snapshotConfig.SnapshotName, interval, snapshotErr.Error()))
+	}
+}
+
+func (d *daemon) handleControl(request controlRequest) any {
+	switch {
+	case request.Command == controlCommandSnap && request.Snap != nil:
+		d.mutex.Lock()
+		snapshotConfig := getSnapshotConfig(d.snapshotsConfigs, request.Snap.Name)
+		d.mutex.Unlock()
+		if snapshotConfig == nil {
+			return snapResponse{Error: "Snapshot template " + request.Snap.Name + " is not loaded by the daemon.", ExitCode: exitError}
+		}
+		config, ok := d.startTask(snapshotConfig.SnapshotName, snapshotConfig.Interval)
+		if !ok {
+			return snapResponse{Error: "The daemon is stopping.", ExitCode: exitBusy}
+		}
+		defer d.finishTask(snapshotConfig.SnapshotName, snapshotConfig.Interval)
+		return takeSnapshot(d.ctx, config, snapshotConfig, *request.Snap)
+	case request.Command == controlCommandStatus:
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		status := daemonStatus{Pid: os.Getpid(), StartedAt: d.startedAt, Jobs: []daemonJobStatus{}}
+		for _, job := range d.jobs {
+			key := job.snapshotName + "." + job.interval
+			jobStatus := daemonJobStatus{Name: job.snapshotName, Interval: job.interval, Cron: job.cron, Running: d.running[key]}
+			nextRun, err := job.job.NextRun()
+			if err == nil && !nextRun.IsZero() {
+				jobStatus.NextRun = &nextRun
+			}
+			if lastRun, ok := d.lastRuns[key]; ok {
+				jobStatus.LastRun = &lastRun
+			}
+			status.Jobs = append(status.Jobs, jobStatus)
+		}
+		return status
+	}
+	return snapResponse{Error: "unknown command " + request.Command, ExitCode: exitUsage}
+}
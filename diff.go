@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+var diffChangeSymbols = map[string]string{
+	snapshots.DiffAdded:    "+",
+	snapshots.DiffRemoved:  "-",
+	snapshots.DiffModified: "M",
+	snapshots.DiffMetadata: "m",
+}
+
+type diffOutput struct {
+	From    string                 `json:"from"`
+	To      string                 `json:"to"`
+	Changes []snapshots.DiffChange `json:"changes"`
+}
+
+func diffCommand(args []string) int {
+	flagSet := flag.NewFlagSet("diff", flag.ExitOnError)
+	live := flagSet.Bool("live", false, "Compare the snapshot with the live sources")
+	interval := flagSet.String("interval", "", "Interval of the snapshot numbers, the first interval when empty")
+	format := flagSet.String("format", outputFormatText, "Output format: text or json")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync diff <name> <from> <to>")
+		fmt.Fprintln(flagSet.Output(), "       snapsync diff <name> <from> --live")
+		fmt.Fprintln(flagSet.Output(), "A snapshot is given by its number or by the name of its dir.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if (*live && len(positional) != 2) || (!*live && len(positional) != 3) {
+		flagSet.Usage()
+		return exitUsage
+	}
+	if *format != outputFormatText && *format != outputFormatJSON {
+		slog.Error(fmt.Sprintf("Unknown format %s, must be %s or %s", *format, outputFormatText, outputFormatJSON))
+		return exitUsage
+	}
+	snapshotName := positional[0]
+	snapshotConfig, err := configs.GetSnapshotConfigByName(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("An error occurred: " + err.Error())
+		return exitError
+	}
+	if snapshotConfig == nil {
+		slog.Error("Snapshot template " + snapshotName + " does not exist.")
+		return exitError
+	}
+	snapshotsInfo, err := snapshots.GetSnapshotsInfo(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("Can't get snapshots of snapshot " + snapshotName + ": " + err.Error())
+		return exitError
+	}
+	from, err := findSnapshot(snapshotConfig, snapshotsInfo, *interval, positional[1])
+	if err != nil {
+		slog.Error(err.Error())
+		return exitError
+	}
+	output := diffOutput{From: from.Abspath, To: "live"}
+	var to *structs.SnapshotInfo
+	if !*live {
+		to, err = findSnapshot(snapshotConfig, snapshotsInfo, *interval, positional[2])
+		if err != nil {
+			slog.Error(err.Error())
+			return exitError
+		}
+		output.To = to.Abspath
+	}
+	output.Changes, err = snapshots.DiffSnapshots(snapshotConfig, from, to)
+	if err != nil {
+		slog.Error("Can't compare the snapshots: " + err.Error())
+		return exitError
+	}
+	if output.Changes == nil {
+		output.Changes = []snapshots.DiffChange{}
+	}
+	err = writeDiff(os.Stdout, *format, output)
+	if err != nil {
+		slog.Error("Can't write the differences: " + err.Error())
+		return exitError
+	}
+	return exitOK
+}
+
+func writeDiff(writer io.Writer, format string, output diffOutput) error {
+	if format == outputFormatJSON {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	}
+	counts := map[string]int{}
+	for _, change := range output.Changes {
+		counts[change.Change]++
+		changePath := change.Path
+		if change.IsDir {
+			changePath += "/"
+		}
+		line := fmt.Sprintf("%s %s", diffChangeSymbols[change.Change], changePath)
+		switch change.Change {
+		case snapshots.DiffModified:
+			line += fmt.Sprintf(" (%s -> %s)", utils.HumanReadableSize(change.OldSize), utils.HumanReadableSize(change.NewSize))
+		case snapshots.DiffMetadata:
+			line += fmt.Sprintf(" (%s)", strings.Join(change.Metadata, ", "))
+		}
+		fmt.Fprintln(writer, line)
+	}
+	_, err := fmt.Fprintf(writer, "%d added, %d removed, %d modified, %d metadata only\n", counts[snapshots.DiffAdded], counts[snapshots.DiffRemoved], counts[snapshots.DiffModified], counts[snapshots.DiffMetadata])
+	return err
+}
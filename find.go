@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/utils"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+type findEntry struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	IsDir     bool      `json:"is_dir"`
+	Snapshots []string  `json:"snapshots"`
+}
+
+func findCommand(args []string) int {
+	flagSet := flag.NewFlagSet("find", flag.ExitOnError)
+	name := flagSet.String("name", "", "Only search the snapshots of this snapshot config")
+	isRegex := flagSet.Bool("regex", false, "The pattern is a regular expression matched against the whole path instead of a glob")
+	after := flagSet.String("after", "", "Only files modified after this local time")
+	before := flagSet.String("before", "", "Only files modified before this local time")
+	minSize := flagSet.String("min-size", "", "Only files at least this big, like 10M")
+	maxSize := flagSet.String("max-size", "", "Only files at most this big, like 1G")
+	format := flagSet.String("format", outputFormatText, "Output format: text or json")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync find <pattern> [--regex] [--after TIME] [--before TIME] [--min-size SIZE] [--max-size SIZE]")
+		fmt.Fprintln(flagSet.Output(), "A glob pattern without slashes is matched against the file name, otherwise against the whole path.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	if *format != outputFormatText && *format != outputFormatJSON {
+		slog.Error(fmt.Sprintf("Unknown format %s, must be %s or %s", *format, outputFormatText, outputFormatJSON))
+		return exitUsage
+	}
+	query := snapshots.FindQuery{MaxSize: -1}
+	if *isRegex {
+		query.Regex, err = regexp.Compile(positional[0])
+		if err != nil {
+			slog.Error("Invalid regex: " + err.Error())
+			return exitUsage
+		}
+	} else {
+		query.Glob = positional[0]
+	}
+	if len(*after) > 0 {
+		query.ModifiedAfter, err = parseRestoreAt(*after)
+		if err != nil {
+			slog.Error(err.Error())
+			return exitUsage
+		}
+	}
+	if len(*before) > 0 {
+		query.ModifiedBefore, err = parseRestoreAt(*before)
+		if err != nil {
+			slog.Error(err.Error())
+			return exitUsage
+		}
+	}
+	if len(*minSize) > 0 {
+		query.MinSize, err = utils.ParseSize(*minSize)
+		if err != nil {
+			slog.Error("Invalid --min-size: " + err.Error())
+			return exitUsage
+		}
+	}
+	if len(*maxSize) > 0 {
+		query.MaxSize, err = utils.ParseSize(*maxSize)
+		if err != nil {
+			slog.Error("Invalid --max-size: " + err.Error())
+			return exitUsage
+		}
+	}
+
+	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(*configsDir, *expandVars)
+	if err != nil {
+		slog.Error("Can't get snapshots configs in " + *configsDir + ": " + err.Error())
+		return exitError
+	}
+	entries := []findEntry{}
+	for _, snapshotConfig := range snapshotsConfigs {
+		if len(*name) > 0 && snapshotConfig.SnapshotName != *name {
+			continue
+		}
+		snapshotsInfo, err := snapshots.GetSnapshotsInfo(*configsDir, *expandVars, snapshotConfig.SnapshotName)
+		if err != nil {
+			slog.Error("Can't get snapshots of snapshot " + snapshotConfig.SnapshotName + ": " + err.Error())
+			return exitError
+		}
+		matches, err := snapshots.FindFiles(snapshotConfig, snapshotsInfo, query)
+		if err != nil {
+			slog.Error("Can't search the snapshots of " + snapshotConfig.SnapshotName + ": " + err.Error())
+			return exitError
+		}
+		for _, match := range matches {
+			entry := findEntry{
+				Name:    snapshotConfig.SnapshotName,
+				Path:    match.SrcPath,
+				Size:    match.Size,
+				ModTime: match.ModTime,
+				IsDir:   match.IsDir,
+			}
+			for _, snapshotInfo := range match.Snapshots {
+				entry.Snapshots = append(entry.Snapshots, fmt.Sprintf("%s %d", snapshotInfo.Interval, snapshotInfo.Number))
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if *format == outputFormatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(entries)
+		if err != nil {
+			slog.Error("Can't write the matches: " + err.Error())
+			return exitError
+		}
+		return exitOK
+	}
+	for _, entry := range entries {
+		entryPath := entry.Path
+		if entry.IsDir {
+			entryPath += "/"
+		}
+		fmt.Printf("%s  %s  %s  in %s: %s\n", entryPath, utils.HumanReadableSize(entry.Size), entry.ModTime.Local().Format(time.DateTime), entry.Name, strings.Join(entry.Snapshots, ", "))
+	}
+	return exitOK
+}
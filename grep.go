@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"regexp"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+type grepEntry struct {
+	Path      string   `json:"path"`
+	Line      int      `json:"line"`
+	Text      string   `json:"text"`
+	Snapshots []string `json:"snapshots"`
+}
+
+func grepCommand(args []string) int {
+	flagSet := flag.NewFlagSet("grep", flag.ExitOnError)
+	var snapshotArgs stringsFlag
+	flagSet.Var(&snapshotArgs, "snapshot", "Number or dir name of a snapshot to search, can be repeated. Every snapshot when not set")
+	interval := flagSet.String("interval", "", "Interval of the snapshot numbers, the first interval when empty")
+	ignoreCase := flagSet.Bool("i", false, "Ignore case")
+	maxSize := flagSet.String("max-size", "10M", "Skip the files bigger than this")
+	format := flagSet.String("format", outputFormatText, "Output format: text or json")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync grep <name> <regex> [--snapshot N]... [-i] [--max-size SIZE]")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 2 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	if *format != outputFormatText && *format != outputFormatJSON {
+		slog.Error(fmt.Sprintf("Unknown format %s, must be %s or %s", *format, outputFormatText, outputFormatJSON))
+		return exitUsage
+	}
+	pattern := positional[1]
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		slog.Error("Invalid regex: " + err.Error())
+		return exitUsage
+	}
+	maxBytes, err := utils.ParseSize(*maxSize)
+	if err != nil {
+		slog.Error("Invalid --max-size: " + err.Error())
+		return exitUsage
+	}
+
+	snapshotName := positional[0]
+	snapshotConfig, err := configs.GetSnapshotConfigByName(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("An error occurred: " + err.Error())
+		return exitError
+	}
+	if snapshotConfig == nil {
+		slog.Error("Snapshot template " + snapshotName + " does not exist.")
+		return exitError
+	}
+	snapshotsInfo, err := snapshots.GetSnapshotsInfo(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("Can't get snapshots of snapshot " + snapshotName + ": " + err.Error())
+		return exitError
+	}
+	if len(snapshotArgs) > 0 {
+		selected := []*structs.SnapshotInfo{}
+		for _, snapshotArg := range snapshotArgs {
+			snapshotInfo, err := findSnapshot(snapshotConfig, snapshotsInfo, *interval, snapshotArg)
+			if err != nil {
+				slog.Error(err.Error())
+				return exitError
+			}
+			selected = append(selected, snapshotInfo)
+		}
+		snapshotsInfo = selected
+	}
+	// newest first, so that the last snapshot of a match is the oldest having it
+	sortSnapshotsForList(snapshotsInfo, listSortDate)
+	matches, err := snapshots.GrepSnapshots(snapshotConfig, snapshotsInfo, regex, maxBytes)
+	if err != nil {
+		slog.Error("Can't search the snapshots of " + snapshotName + ": " + err.Error())
+		return exitError
+	}
+
+	entries := []grepEntry{}
+	for _, match := range matches {
+		entry := grepEntry{Path: match.SrcPath, Line: match.Line, Text: match.Text}
+		for _, snapshotInfo := range match.Snapshots {
+			entry.Snapshots = append(entry.Snapshots, fmt.Sprintf("%s %d", snapshotInfo.Interval, snapshotInfo.Number))
+		}
+		entries = append(entries, entry)
+	}
+	if *format == outputFormatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(entries)
+		if err != nil {
+			slog.Error("Can't write the matches: " + err.Error())
+			return exitError
+		}
+		return exitOK
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s:%d: %s  [%s]\n", entry.Path, entry.Line, entry.Text, strings.Join(entry.Snapshots, ", "))
+	}
+	return exitOK
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	listFormatTable = "table"
+	listFormatJSON  = "json"
+	listFormatYAML  = "yaml"
+	listFormatCSV   = "csv"
+)
+
+const (
+	listSortNumber = "number"
+	listSortDate   = "date"
+)
+
+// snapshotListEntry is the stable shape of a snapshot in the machine readable
+// list formats, independent from the internal structs.
+type snapshotListEntry struct {
+	Name            string    `json:"name" yaml:"name"`
+	Interval        string    `json:"interval" yaml:"interval"`
+	Number          int       `json:"number" yaml:"number"`
+	Path            string    `json:"path" yaml:"path"`
+	Created         time.Time `json:"created" yaml:"created"`
+	DurationSeconds float64   `json:"duration_seconds" yaml:"duration_seconds"`
+	Size            int64     `json:"size" yaml:"size"`
+	ExclusiveSize   int64     `json:"exclusive_size" yaml:"exclusive_size"`
+	Tags            []string  `json:"tags" yaml:"tags"`
+	Pinned          bool      `json:"pinned" yaml:"pinned"`
+	Status          string    `json:"status" yaml:"status"`
+	Note            string    `json:"note" yaml:"note"`
+	Host            string    `json:"host" yaml:"host"`
+	Version         string    `json:"version" yaml:"version"`
+	ConfigHash      string    `json:"config_hash" yaml:"config_hash"`
+}
+
+type snapshotList struct {
+	Snapshots   []snapshotListEntry `json:"snapshots" yaml:"snapshots"`
+	TotalOnDisk int64               `json:"total_on_disk" yaml:"total_on_disk"`
+}
+
+func newSnapshotListEntry(snapshotInfo *structs.SnapshotInfo) snapshotListEntry {
+	entry := snapshotListEntry{
+		Name:       snapshotInfo.SnapshotName,
+		Interval:   snapshotInfo.Interval,
+		Number:     snapshotInfo.Number,
+		Path:       snapshotInfo.Abspath,
+		Created:    snapshotInfo.Timestamp,
+		Tags:       snapshotInfo.Metadata.Tags,
+		Pinned:     snapshotInfo.Metadata.Pinned,
+		Status:     snapshotInfo.Metadata.Status,
+		Note:       snapshotInfo.Metadata.Note,
+		Host:       snapshotInfo.Metadata.Host,
+		Version:    snapshotInfo.Metadata.Version,
+		ConfigHash: snapshotInfo.Metadata.ConfigHash,
+	}
+	if entry.Tags == nil {
+		entry.Tags = []string{}
+	}
+	// snapshots made by older versions have no metadata
+	if len(entry.Status) == 0 {
+		entry.Status = "unknown"
+	}
+	if !snapshotInfo.Metadata.StartedAt.IsZero() && !snapshotInfo.Metadata.FinishedAt.IsZero() {
+		entry.DurationSeconds = snapshotInfo.Metadata.FinishedAt.Sub(snapshotInfo.Metadata.StartedAt).Seconds()
+	}
+	if snapshotInfo.Metadata.Size != nil {
+		entry.Size = snapshotInfo.Metadata.Size.Apparent
+		entry.ExclusiveSize = snapshotInfo.Metadata.Size.Exclusive
+	}
+	return entry
+}
+
+func sortSnapshotsForList(snapshotsInfo []*structs.SnapshotInfo, sortBy string) error {
+	switch sortBy {
+	case listSortNumber:
+		slices.SortStableFunc(snapshotsInfo, func(a *structs.SnapshotInfo, b *structs.SnapshotInfo) int {
+			if a.Interval != b.Interval {
+				return strings.Compare(a.Interval, b.Interval)
+			}
+			return a.Number - b.Number
+		})
+	case listSortDate:
+		slices.SortStableFunc(snapshotsInfo, func(a *structs.SnapshotInfo, b *structs.SnapshotInfo) int {
+			return b.Timestamp.Compare(a.Timestamp)
+		})
+	default:
+		return fmt.Errorf("unknown sort %s, must be %s or %s", sortBy, listSortNumber, listSortDate)
+	}
+	return nil
+}
+
+func writeSnapshotList(writer io.Writer, format string, snapshotsInfo []*structs.SnapshotInfo, totalOnDisk int64) error {
+	list := snapshotList{Snapshots: []snapshotListEntry{}, TotalOnDisk: totalOnDisk}
+	for _, snapshotInfo := range snapshotsInfo {
+		list.Snapshots = append(list.Snapshots, newSnapshotListEntry(snapshotInfo))
+	}
+	switch format {
+	case listFormatTable:
+		tableWriter := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tableWriter, "NUMBER\tINTERVAL\tCREATED\tDURATION\tSIZE\tEXCLUSIVE\tTAGS\tSTATUS\tNOTE")
+		for _, entry := range list.Snapshots {
+			tags := strings.Join(entry.Tags, ",")
+			if entry.Pinned {
+				tags = strings.TrimPrefix(tags+",pinned", ",")
+			}
+			fmt.Fprintf(tableWriter, "%d\t%s\t%s\t%.1fs\t%s\t%s\t%s\t%s\t%s\n", entry.Number, entry.Interval, entry.Created.Local().Format(time.DateTime), entry.DurationSeconds, utils.HumanReadableSize(entry.Size), utils.HumanReadableSize(entry.ExclusiveSize), tags, entry.Status, entry.Note)
+		}
+		tableWriter.Flush()
+		if len(list.Snapshots) > 0 {
+			fmt.Fprintf(writer, "Total on disk: %s\n", utils.HumanReadableSize(totalOnDisk))
+		}
+		return nil
+	case listFormatJSON:
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	case listFormatYAML:
+		encoder := yaml.NewEncoder(writer)
+		defer encoder.Close()
+		return encoder.Encode(list)
+	case listFormatCSV:
+		csvWriter := csv.NewWriter(writer)
+		csvWriter.Write([]string{"name", "interval", "number", "path", "created", "duration_seconds", "size", "exclusive_size", "tags", "pinned", "status", "host", "version", "config_hash", "note"})
+		for _, entry := range list.Snapshots {
+			csvWriter.Write([]string{
+				entry.Name,
+				entry.Interval,
+				strconv.Itoa(entry.Number),
+				entry.Path,
+				entry.Created.Format(time.RFC3339),
+				strconv.FormatFloat(entry.DurationSeconds, 'f', 3, 64),
+				strconv.FormatInt(entry.Size, 10),
+				strconv.FormatInt(entry.ExclusiveSize, 10),
+				strings.Join(entry.Tags, ";"),
+				strconv.FormatBool(entry.Pinned),
+				entry.Status,
+				entry.Host,
+				entry.Version,
+				entry.ConfigHash,
+				entry.Note,
+			})
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+	return fmt.Errorf("unknown format %s, must be %s, %s, %s or %s", format, listFormatTable, listFormatJSON, listFormatYAML, listFormatCSV)
+}
+
+func listCommand(args []string) int {
+	flagSet := flag.NewFlagSet("list", flag.ExitOnError)
+	format := flagSet.String("format", listFormatTable, "Output format: table, json, yaml or csv")
+	sortBy := flagSet.String("sort", listSortNumber, "Sort by number or date")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync list <name> [--format table|json|yaml|csv] [--sort number|date]")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	if !slices.Contains([]string{listFormatTable, listFormatJSON, listFormatYAML, listFormatCSV}, *format) {
+		slog.Error(fmt.Sprintf("Unknown format %s, must be %s, %s, %s or %s", *format, listFormatTable, listFormatJSON, listFormatYAML, listFormatCSV))
+		return exitUsage
+	}
+	snapshotName := positional[0]
+	snapshotConfig, err := configs.GetSnapshotConfigByName(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("An error occurred: " + err.Error())
+		return exitError
+	}
+	if snapshotConfig == nil {
+		slog.Error("Snapshot template " + snapshotName + " does not exist.")
+		return exitError
+	}
+	// finish or undo rotations interrupted by a crash before listing
+	err = snapshots.RecoverSnapshots(snapshotConfig)
+	if err != nil {
+		slog.Error("Can't recover snapshots of " + snapshotName + ": " + err.Error())
+	}
+	snapshotsInfo, err := snapshots.GetSnapshotsInfo(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("Can't get snapshots of snapshot " + snapshotName + ": " + err.Error())
+		return exitError
+	}
+	totalOnDisk, err := snapshots.GetSnapshotsUsage(snapshotConfig, snapshotsInfo)
+	if err != nil {
+		slog.Warn("Can't evaluate snapshots size: " + err.Error())
+	}
+	err = sortSnapshotsForList(snapshotsInfo, *sortBy)
+	if err != nil {
+		slog.Error(err.Error())
+		return exitUsage
+	}
+	err = writeSnapshotList(os.Stdout, *format, snapshotsInfo, totalOnDisk)
+	if err != nil {
+		slog.Error("Can't list snapshots: " + err.Error())
+		return exitError
+	}
+	return exitOK
+}
@@ -1,160 +1,384 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path"
 	"peppeosmio/snapsync/configs"
 	"peppeosmio/snapsync/snapshots"
 	"peppeosmio/snapsync/structs"
 	"peppeosmio/snapsync/utils"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
-	"github.com/go-co-op/gocron/v2"
 	"golang.org/x/exp/slog"
 )
 
+// exit codes of the commands, so that scripts can tell the outcomes apart
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+	// exitNothingToRestore means there is no snapshot matching the restore selection
+	exitNothingToRestore = 3
+	// exitPartialFailure means the command did part of its work: some of the dirs
+	// of the snapshot were not restored, or the snapshot was taken but a later
+	// step like the post snapshot commands failed
+	exitPartialFailure = 4
+	// exitBusy means another snapsync process is working on the same snapshots
+	exitBusy = 5
+)
+
+// formats of the commands that print either text or json
+const (
+	outputFormatText = "text"
+	outputFormatJSON = "json"
+)
+
+// command is a subcommand of snapsync
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+	// configFlags tells if the command takes --configs-dir and --expand-vars
+	configFlags bool
+}
+
+// getCommands returns the subcommands in the order they are shown in the usage.
+func getCommands() []command {
+	return []command{
+		{"run", "Take a snapshot of every snapshot config once and exit", runCommand, true},
+		{"daemon", "Take the snapshots on the cron schedules of the configs", daemonCommand, true},
+		{"snap", "Take a snapshot of a snapshot config now", snapCommand, true},
+		{"list", "List the snapshots of a snapshot config", listCommand, true},
+		{"restore", "Restore a snapshot, or some paths of it", restoreCommand, true},
+		{"prune", "Delete the snapshots the retention policy doesn't keep", pruneCommand, true},
+		{"check", "Validate the configs and the paths they use", checkCommand, true},
+		{"diff", "Compare two snapshots, or a snapshot with the sources", diffCommand, true},
+		{"status", "Show the newest snapshots and the daemon schedule", statusCommand, true},
+		{"version", "Print the snapsync version", versionCommand, false},
+		{"versions", "List the versions of a file across the snapshots", versionsCommand, true},
+		{"find", "Find files by name, time or size in the snapshots", findCommand, true},
+		{"grep", "Search the content of the files in the snapshots", grepCommand, true},
+		{"serve", "Browse the snapshots over HTTP", serveCommand, true},
+		{"tui", "Browse the snapshots in the terminal", tuiCommand, true},
+		{"pin", "Exempt a snapshot from pruning", func(args []string) int { return annotateCommand("pin", args) }, true},
+		{"unpin", "Let a pinned snapshot be pruned again", func(args []string) int { return annotateCommand("unpin", args) }, true},
+		{"tag", "Add tags to a snapshot", func(args []string) int { return annotateCommand("tag", args) }, true},
+		{"untag", "Remove tags from a snapshot", func(args []string) int { return annotateCommand("untag", args) }, true},
+		{"note", "Set or remove the note of a snapshot", func(args []string) int { return annotateCommand("note", args) }, true},
+		{"migrate-naming", "Rename the numbered snapshots of a snapshot config to timestamp names", migrateNamingCommand, true},
+	}
+}
+
+func printUsage(writer io.Writer) {
+	fmt.Fprintln(writer, "Usage: snapsync <command> [arguments]")
+	fmt.Fprintln(writer)
+	fmt.Fprintln(writer, "Commands:")
+	tableWriter := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	for _, command := range getCommands() {
+		fmt.Fprintf(tableWriter, "  %s\t%s\n", command.name, command.summary)
+	}
+	tableWriter.Flush()
+	fmt.Fprintln(writer)
+	fmt.Fprintln(writer, "Run snapsync <command> -h for the arguments of a command.")
+}
+
 func main() {
 	lvl := new(slog.LevelVar)
 	lvl.Set(slog.LevelDebug)
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 		Level: lvl,
 	})))
-	restoreFlag := flag.String("restore", "", "Restore a snapshot")
-	listFlag := flag.String("list", "", "List the snapshot by name")
-	expandVarsFlag := flag.Bool("expand-vars", true, "Expand environment variables")
+	os.Exit(runSubcommand(os.Args[1:]))
+}
 
-	defaultConfigsPath, err := configs.GetDefaultConfigsDir()
+func runSubcommand(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return legacyCommand(args)
+	}
+	if args[0] == "help" {
+		printUsage(os.Stdout)
+		return exitOK
+	}
+	for _, command := range getCommands() {
+		if command.name == args[0] {
+			return command.run(args[1:])
+		}
+	}
+	slog.Error("Unknown command " + args[0])
+	printUsage(os.Stderr)
+	return exitUsage
+}
+
+// legacyCommand handles the flags that chose what to do before the
+// subcommands existed. They are deprecated aliases of list, restore and
+// migrate-naming, and without any of them snapsync runs the configs without a
+// cron once and schedules the others, like run followed by daemon.
+func legacyCommand(args []string) int {
+	flagSet := flag.NewFlagSet("snapsync", flag.ExitOnError)
+	restoreFlag := flagSet.String("restore", "", "Deprecated, use snapsync restore <name>")
+	listFlag := flagSet.String("list", "", "Deprecated, use snapsync list <name>")
+	formatFlag := flagSet.String("format", listFormatTable, "Deprecated, use snapsync list <name> --format")
+	sortFlag := flagSet.String("sort", listSortNumber, "Deprecated, use snapsync list <name> --sort")
+	migrateNamingFlag := flagSet.String("migrate-naming", "", "Deprecated, use snapsync migrate-naming <name>")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
 	if err != nil {
 		slog.Error("Can't get default config path: " + err.Error())
-		return
+		return exitError
 	}
-	configsDirFlag := flag.String("configs-dir", defaultConfigsPath, "Directory of the config files")
-	err = os.MkdirAll(*configsDirFlag, 0700)
-	if err != nil {
-		slog.Error("Can't create configs dir " + *configsDirFlag + ": " + err.Error())
-		return
+	flagSet.Usage = func() {
+		printUsage(flagSet.Output())
+		fmt.Fprintln(flagSet.Output())
+		fmt.Fprintln(flagSet.Output(), "Deprecated flags, used without a command:")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	commonArgs := []string{"--expand-vars=" + strconv.FormatBool(*expandVars), "--configs-dir", *configsDir}
+
+	// snapsync --configs-dir DIR <command> ...
+	if flagSet.NArg() > 0 {
+		return runSubcommand(forwardConfigFlags(flagSet, flagSet.Args()))
+	}
+	if len(*listFlag) > 0 {
+		slog.Warn("-list is deprecated, use snapsync list <name>")
+		return listCommand(append([]string{*listFlag, "--format", *formatFlag, "--sort", *sortFlag}, commonArgs...))
+	}
+	if len(*migrateNamingFlag) > 0 {
+		slog.Warn("-migrate-naming is deprecated, use snapsync migrate-naming <name>")
+		return migrateNamingCommand(append([]string{*migrateNamingFlag}, commonArgs...))
+	}
+	if len(*restoreFlag) > 0 {
+		slog.Warn("-restore is deprecated, use snapsync restore <name>")
+		return restoreCommand(append([]string{*restoreFlag}, commonArgs...))
+	}
+
+	slog.Warn("Running snapsync without a command is deprecated, use snapsync run or snapsync daemon")
+	config, snapshotsConfigs, exitCode := loadConfigsForRun(*configsDir, *expandVars)
+	if exitCode != exitOK {
+		return exitCode
+	}
+	withoutCron := []*structs.SnapshotConfig{}
+	for _, snapshotConfig := range snapshotsConfigs {
+		if !hasCron(snapshotConfig) {
+			withoutCron = append(withoutCron, snapshotConfig)
+		}
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	exitCode = runSnapshots(ctx, config, withoutCron, "")
+	stop()
+	if len(withoutCron) == len(snapshotsConfigs) {
+		return exitCode
+	}
+	return runDaemon(config, *configsDir, *expandVars, snapshotsConfigs, defaultGracePeriod)
+}
 
-	flag.Parse()
+// forwardConfigFlags adds the --configs-dir and --expand-vars set in flagSet
+// before the command to its args, if the command takes them.
+func forwardConfigFlags(flagSet *flag.FlagSet, args []string) []string {
+	index := slices.IndexFunc(getCommands(), func(command command) bool { return command.name == args[0] })
+	if index < 0 || !getCommands()[index].configFlags {
+		return args
+	}
+	forwarded := []string{args[0]}
+	flagSet.Visit(func(setFlag *flag.Flag) {
+		if setFlag.Name == "configs-dir" || setFlag.Name == "expand-vars" {
+			forwarded = append(forwarded, "--"+setFlag.Name+"="+setFlag.Value.String())
+		}
+	})
+	return append(forwarded, args[1:]...)
+}
 
-	config, err := configs.LoadConfig(*configsDirFlag, *expandVarsFlag)
+func versionCommand(args []string) int {
+	flagSet := flag.NewFlagSet("version", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync version")
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 0 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	fmt.Printf("snapsync %s (%s %s/%s)\n", utils.GetVersion(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return exitOK
+}
+
+func migrateNamingCommand(args []string) int {
+	flagSet := flag.NewFlagSet("migrate-naming", flag.ExitOnError)
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync migrate-naming <name>")
+		fmt.Fprintln(flagSet.Output(), "Renames the numbered snapshots to timestamp names, set naming: timestamp in the config afterwards.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	snapshotName := positional[0]
+	snapshotConfig, err := configs.GetSnapshotConfigByName(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("An error occurred: " + err.Error())
+		return exitError
+	}
+	if snapshotConfig == nil {
+		slog.Error("Snapshot template " + snapshotName + " does not exist.")
+		return exitError
+	}
+	migrated, err := snapshots.MigrateToTimestampNaming(snapshotConfig)
 	if err != nil {
-		slog.Error("Can't get " + *configsDirFlag + ": " + err.Error())
-		return
+		slog.Error("Can't migrate snapshots of " + snapshotName + ": " + err.Error())
+		return exitError
 	}
+	slog.Info(fmt.Sprintf("Migrated %d snapshots of %s to timestamp naming", migrated, snapshotName))
+	return exitOK
+}
 
-	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(*configsDirFlag, *expandVarsFlag)
+// loadSnapshotsUsage fills the sizes of snapshotsInfo and returns the total
+// space used on disk, or the error as a string to print in place of sizes.
+func loadSnapshotsUsage(configsDir string, expandVars bool, snapshotName string, snapshotsInfo []*structs.SnapshotInfo) string {
+	snapshotConfig, err := configs.GetSnapshotConfigByName(configsDir, expandVars, snapshotName)
+	if err != nil || snapshotConfig == nil {
+		return "unknown"
+	}
+	total, err := snapshots.GetSnapshotsUsage(snapshotConfig, snapshotsInfo)
 	if err != nil {
-		slog.Error("Can't get snapshots configs in " + *configsDirFlag + ": " + err.Error())
+		return fmt.Sprintf("can't evaluate snapshots size: %s", err.Error())
 	}
+	return utils.HumanReadableSize(total)
+}
 
-	if len(*listFlag) > 0 {
-		snapshotsInfo, err := snapshots.GetSnapshotsInfo(*configsDirFlag, *expandVarsFlag, *listFlag)
-		if err != nil {
-			slog.Error("Can't get snapshots of snapshot " + *listFlag + ": " + err.Error())
-			return
-		}
-		for _, snapshotInfo := range snapshotsInfo {
-			size, err := snapshotInfo.Size()
-			sizeStr := ""
-			if err != nil {
-				sizeStr = fmt.Sprintf("can't evaluate snapshot size: %s", err.Error())
-			} else {
-				sizeStr = utils.HumanReadableSize(size)
-			}
-			fmt.Printf("[%d] Snapshot: %s, Interval: %s, Size: %s\n", snapshotInfo.Number, snapshotInfo.SnapshotName, snapshotInfo.Interval, sizeStr)
-		}
-		return
+func getSizeString(snapshotInfo *structs.SnapshotInfo) string {
+	size := snapshotInfo.Metadata.Size
+	if size == nil {
+		return "unknown"
 	}
+	return fmt.Sprintf("%s (exclusive %s)", utils.HumanReadableSize(size.Apparent), utils.HumanReadableSize(size.Exclusive))
+}
 
-	if len(*restoreFlag) > 0 {
-		snapshotsInfo, err := snapshots.GetSnapshotsInfo(*configsDirFlag, *expandVarsFlag, *restoreFlag)
-		if err != nil {
-			slog.Error("Can't get snapshots of snapshot " + *listFlag + ": " + err.Error())
-			return
-		}
-		for len(snapshotsInfo) == 0 {
-			slog.Info("There are no snapshots to restore for " + *restoreFlag)
-			return
+func pruneCommand(args []string) int {
+	flagSet := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := flagSet.Bool("dry-run", false, "Only show which snapshots would be kept or removed")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync prune [--dry-run] <name>")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	snapshotName := positional[0]
+	snapshotConfig, err := configs.GetSnapshotConfigByName(*configsDir, *expandVars, snapshotName)
+	if err != nil {
+		slog.Error("An error occurred: " + err.Error())
+		return exitError
+	}
+	if snapshotConfig == nil {
+		slog.Error("Snapshot template " + snapshotName + " does not exist.")
+		return exitError
+	}
+	decisions, err := snapshots.Prune(snapshotConfig, *dryRun)
+	for _, decision := range decisions {
+		action := "keep"
+		if !decision.Keep {
+			action = "remove"
 		}
-		printSnapshots := func() {
-			for i, snapshotInfo := range snapshotsInfo {
-				fmt.Println()
-				fmt.Printf("[%d]\tName: %s\n", i, snapshotInfo.SnapshotName)
-				fmt.Printf("\tInterval: %s\n", snapshotInfo.Interval)
-				fmt.Printf("\tNumber: %d\n", snapshotInfo.Number)
-				size, err := snapshotInfo.Size()
-				if err != nil {
-					fmt.Printf("\tSize: (error: %s)\n", err.Error())
-				} else {
-					fmt.Printf("\tSize: %s\n", utils.HumanReadableSize(size))
-				}
-			}
+		line := fmt.Sprintf("%-6s  %s  %s  %s", action, path.Base(decision.SnapshotInfo.Abspath), decision.SnapshotInfo.Timestamp.Local().Format(time.DateTime), strings.Join(decision.Reasons, ", "))
+		fmt.Println(strings.TrimSpace(line))
+	}
+	if err != nil {
+		slog.Error("Can't prune snapshots of " + snapshotName + ": " + err.Error())
+		return exitError
+	}
+	return exitOK
+}
+
+// addConfigFlags defines --configs-dir and --expand-vars, the flags of the
+// commands that load the configs, on flagSet.
+func addConfigFlags(flagSet *flag.FlagSet) (configsDir *string, expandVars *bool, err error) {
+	defaultConfigsPath, err := configs.GetDefaultConfigsDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	configsDir = flagSet.String("configs-dir", defaultConfigsPath, "Directory of the config files")
+	expandVars = flagSet.Bool("expand-vars", true, "Expand environment variables")
+	return configsDir, expandVars, nil
+}
+
+// parseInterspersed parses args with flagSet allowing flags after the
+// positional arguments, like "restore <name> --yes", and returns the latter.
+// A flag that isn't boolean takes the next arg as its value unless it is
+// written as --flag=value. Everything after "--" is positional, like
+// "grep <name> -- -pattern". Errors are handled as flagSet is set to.
+func parseInterspersed(flagSet *flag.FlagSet, args []string) (positional []string) {
+	flagArgs := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
 		}
-		printSnapshots()
-		fmt.Println()
-		fmt.Print("Choose which snapshot to restore: ")
-		input := 0
-		fmt.Scan(&input)
-		for input < 0 || input > len(snapshotsInfo)-1 {
-			fmt.Println("Invalid number.")
-			printSnapshots()
-			fmt.Print("Choose which snapshot to restore: ")
-			fmt.Scan(&input)
+		if len(arg) < 2 || arg[0] != '-' {
+			positional = append(positional, arg)
+			continue
 		}
-		snapshotConfig, err := configs.GetSnapshotConfigByName(*configsDirFlag, *expandVarsFlag, snapshotsInfo[input].SnapshotName)
-		if err != nil {
-			slog.Error("An error occurred: " + err.Error())
-			return
+		flagArgs = append(flagArgs, arg)
+		name, _, hasValue := strings.Cut(strings.TrimPrefix(arg[1:], "-"), "=")
+		definedFlag := flagSet.Lookup(name)
+		if hasValue || definedFlag == nil || i+1 == len(args) {
+			// flagSet reports the unknown flags and the missing values
+			continue
 		}
-		err = snapshots.RestoreSnapshot(config, snapshotsInfo[input], snapshotConfig)
-		if err != nil {
-			slog.Error("An error occurred while restoring the snapshot: " + err.Error())
-			return
+		boolFlag, ok := definedFlag.Value.(interface{ IsBoolFlag() bool })
+		if !ok || !boolFlag.IsBoolFlag() {
+			i++
+			flagArgs = append(flagArgs, args[i])
 		}
-		return
 	}
-
-	snapshotTask := func(snapshotConfig *structs.SnapshotConfig) {
-		snapshotErr := snapshots.ExecuteSnapshot(config, snapshotConfig)
-		if snapshotErr != nil {
-			slog.Error(fmt.Sprintf("[%s] can't execute snapshot: %s", snapshotConfig.SnapshotName, err.Error()))
-		}
+	if flagSet.Parse(flagArgs) != nil {
+		return nil
 	}
-	snapshotsConfigsToSchedule := []*structs.SnapshotConfig{}
-	for _, snapshotConfig := range snapshotsConfigs {
-
-		if len(snapshotConfig.Cron) > 0 {
-			snapshotsConfigsToSchedule = append(snapshotsConfigsToSchedule, snapshotConfig)
+	return positional
+}
 
-		} else {
-			snapshotTask(snapshotConfig)
+// findSnapshot returns the snapshot named by arg: the number of a snapshot
+// of interval, or the base interval if empty, or the name of its dir.
+func findSnapshot(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo, interval string, arg string) (*structs.SnapshotInfo, error) {
+	for _, snapshotInfo := range snapshotsInfo {
+		if path.Base(snapshotInfo.Abspath) == arg {
+			return snapshotInfo, nil
 		}
 	}
-	if len(snapshotsConfigsToSchedule) > 0 {
-		scheduler, err := gocron.NewScheduler()
-		for _, snapshotConfig := range snapshotsConfigsToSchedule {
-			_, err := scheduler.NewJob(
-				gocron.CronJob(snapshotConfig.Cron, false),
-				gocron.NewTask(
-					snapshotTask,
-					snapshotConfig,
-				),
-			)
-			if err != nil {
-				slog.Error("Can't add cron job for snapshot " + snapshotConfig.SnapshotName + ". Cron string is " + snapshotConfig.Cron)
-				return
-			}
-			slog.Info(fmt.Sprintf("[%s] scheduled with cron %s", snapshotConfig.SnapshotName, snapshotConfig.Cron))
-		}
-		if err != nil {
-			slog.Error("can't create scheduler.")
-			return
-		}
-		scheduler.Start()
-		for {
-			time.Sleep(1 * time.Second)
-		}
+	number, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a snapshot number nor a snapshot dir name", arg)
+	}
+	if len(interval) == 0 {
+		interval = snapshotConfig.Interval
+	}
+	selected := snapshots.SelectSnapshot(snapshotsInfo, snapshots.SnapshotSelector{Interval: interval, Number: number})
+	if selected == nil {
+		return nil, fmt.Errorf("%s has no snapshot %d in interval %s", snapshotConfig.SnapshotName, number, interval)
 	}
+	return selected, nil
 }
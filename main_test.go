@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []string
+		wantPositional []string
+		wantYes        bool
+		wantConfigsDir string
+		wantErr        bool
+	}{
+		{"flags after positional", []string{"name", "--configs-dir", "dir", "other", "--yes"}, []string{"name", "other"}, true, "dir", false},
+		{"single dash flags", []string{"-yes", "-configs-dir", "dir", "name"}, []string{"name"}, true, "dir", false},
+		{"flag value with equals", []string{"--configs-dir=dir", "name"}, []string{"name"}, false, "dir", false},
+		{"bool flag doesn't take the next arg", []string{"--yes", "name"}, []string{"name"}, true, "", false},
+		{"bool flag value", []string{"--yes=false", "name"}, []string{"name"}, false, "", false},
+		{"flag value starting with a dash", []string{"--configs-dir", "-dir", "name"}, []string{"name"}, false, "-dir", false},
+		{"flag value that is a double dash", []string{"--configs-dir", "--", "name"}, []string{"name"}, false, "--", false},
+		{"positional after double dash", []string{"name", "--", "--yes", "-pattern"}, []string{"name", "--yes", "-pattern"}, false, "", false},
+		{"single dash is positional", []string{"-", "--yes"}, []string{"-"}, true, "", false},
+		{"unknown flag", []string{"name", "--unknown"}, nil, false, "", true},
+		{"missing flag value", []string{"name", "--configs-dir"}, nil, false, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+			flagSet.SetOutput(io.Discard)
+			yes := flagSet.Bool("yes", false, "")
+			configsDir := flagSet.String("configs-dir", "", "")
+			positional := parseInterspersed(flagSet, test.args)
+			if test.wantErr {
+				if positional != nil {
+					t.Errorf("got positional %v, want an error", positional)
+				}
+				return
+			}
+			if !slices.Equal(positional, test.wantPositional) || *yes != test.wantYes || *configsDir != test.wantConfigsDir {
+				t.Errorf("got %v, yes %v, configs dir %q", positional, *yes, *configsDir)
+			}
+		})
+	}
+}
+
+func TestRunSubcommand(t *testing.T) {
+	configsDir := writeTestConfigs(t, t.TempDir(), t.TempDir())
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"command", []string{"list", "t", "--configs-dir", configsDir, "--expand-vars=false"}, exitOK},
+		{"global flags before the command", []string{"--configs-dir", configsDir, "list", "t"}, exitOK},
+		{"global flags before a command with double dash", []string{"--configs-dir", configsDir, "list", "--", "t"}, exitOK},
+		{"global flags before a command without them", []string{"--configs-dir", configsDir, "version"}, exitOK},
+		{"legacy list flag", []string{"-list", "t", "-configs-dir", configsDir}, exitOK},
+		{"legacy migrate flag", []string{"-migrate-naming", "t", "-configs-dir", configsDir}, exitError},
+		{"unknown command", []string{"unknown"}, exitUsage},
+		{"help", []string{"help"}, exitOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := runSubcommand(test.args); got != test.want {
+				t.Errorf("got exit code %d, want %d", got, test.want)
+			}
+		})
+	}
+}
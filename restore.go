@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// restoreAtLayouts are the accepted formats of --at, in local time
+var restoreAtLayouts = []string{time.DateTime, "2006-01-02 15:04", time.DateOnly, time.RFC3339}
+
+// stdinReader is shared by the prompts so that no buffered input is lost between them
+var stdinReader = bufio.NewReader(os.Stdin)
+
+type restoreOptions struct {
+	selector snapshots.SnapshotSelector
+	restore  snapshots.RestoreOptions
+	yes      bool
+	dryRun   bool
+	undo     bool
+}
+
+// stringsFlag is a flag that can be repeated
+type stringsFlag []string
+
+func (values *stringsFlag) String() string {
+	return strings.Join(*values, ", ")
+}
+
+func (values *stringsFlag) Set(value string) error {
+	*values = append(*values, value)
+	return nil
+}
+
+func parseRestoreAt(value string) (time.Time, error) {
+	for _, layout := range restoreAtLayouts {
+		at, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return at, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use a format like \"2006-01-02 15:04\"", value)
+}
+
+func restoreCommand(args []string) int {
+	flagSet := flag.NewFlagSet("restore", flag.ExitOnError)
+	number := flagSet.Int("snapshot", -1, "Number of the snapshot to restore, 0 being the newest")
+	interval := flagSet.String("interval", "", "Interval of --snapshot, the first interval when empty")
+	at := flagSet.String("at", "", "Restore the newest snapshot taken at or before this local time, like \"2026-10-15 14:00\"")
+	tag := flagSet.String("tag", "", "Restore the newest snapshot with this tag")
+	var paths stringsFlag
+	flagSet.Var(&paths, "path", "Absolute source path of a file or dir to restore instead of every dir, can be repeated")
+	target := flagSet.String("target", "", "Recreate the source paths under this dir instead of restoring over them")
+	dryRun := flagSet.Bool("dry-run", false, "Only show the files that would be created, overwritten or deleted")
+	undo := flagSet.Bool("undo", false, "Put back what the last restore overwrote, from its pre restore snapshot")
+	yes := flagSet.Bool("yes", false, "Don't ask for confirmation")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync restore <name> [--snapshot N | --at TIME | --tag TAG] [--path PATH]... [--target DIR] [--dry-run] [--yes]")
+		fmt.Fprintln(flagSet.Output(), "       snapsync restore <name> --undo [--dry-run] [--yes]")
+		flagSet.PrintDefaults()
+		fmt.Fprintln(flagSet.Output(), "Without a selection the snapshots are listed and one is chosen interactively.")
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	selectors := 0
+	if *number >= 0 {
+		selectors++
+	}
+	if len(*at) > 0 {
+		selectors++
+	}
+	if len(*tag) > 0 {
+		selectors++
+	}
+	if selectors > 1 {
+		slog.Error("Only one of --snapshot, --at and --tag can be used")
+		return exitUsage
+	}
+	if *undo && (selectors > 0 || len(paths) > 0 || len(*target) > 0) {
+		slog.Error("--undo can't be used with --snapshot, --at, --tag, --path or --target")
+		return exitUsage
+	}
+	if selectors == 0 && *yes && !*undo {
+		slog.Error("--yes needs --snapshot, --at or --tag to know which snapshot to restore")
+		return exitUsage
+	}
+	if len(*interval) > 0 && *number < 0 {
+		slog.Error("--interval can only be used with --snapshot")
+		return exitUsage
+	}
+	options := restoreOptions{
+		selector: snapshots.SnapshotSelector{Interval: *interval, Number: *number, Tag: *tag},
+		restore:  snapshots.RestoreOptions{Paths: paths},
+		yes:      *yes,
+		dryRun:   *dryRun,
+		undo:     *undo,
+	}
+	if len(*at) > 0 {
+		options.selector.At, err = parseRestoreAt(*at)
+		if err != nil {
+			slog.Error(err.Error())
+			return exitUsage
+		}
+	}
+	if len(*target) > 0 {
+		options.restore.Target, err = filepath.Abs(*target)
+		if err != nil {
+			slog.Error("Can't get the absolute path of " + *target + ": " + err.Error())
+			return exitUsage
+		}
+	}
+	config, err := configs.LoadConfig(*configsDir, *expandVars)
+	if err != nil {
+		slog.Error("Can't get " + *configsDir + ": " + err.Error())
+		return exitError
+	}
+	return restore(config, *configsDir, *expandVars, positional[0], options)
+}
+
+// restore restores a snapshot of snapshotName and returns the exit code. The
+// snapshot is chosen by options, or interactively if options select nothing.
+func restore(config *structs.Config, configsDir string, expandVars bool, snapshotName string, options restoreOptions) int {
+	snapshotConfig, err := configs.GetSnapshotConfigByName(configsDir, expandVars, snapshotName)
+	if err != nil {
+		slog.Error("An error occurred: " + err.Error())
+		return exitError
+	}
+	if snapshotConfig == nil {
+		slog.Error("Snapshot template " + snapshotName + " does not exist.")
+		return exitError
+	}
+	err = snapshots.RecoverSnapshots(snapshotConfig)
+	if err != nil {
+		slog.Error("Can't recover snapshots of " + snapshotName + ": " + err.Error())
+		return exitError
+	}
+	snapshotsInfo, err := snapshots.GetSnapshotsInfo(configsDir, expandVars, snapshotName)
+	if err != nil {
+		slog.Error("Can't get snapshots of snapshot " + snapshotName + ": " + err.Error())
+		return exitError
+	}
+	if len(snapshotsInfo) == 0 {
+		slog.Info("There are no snapshots to restore for " + snapshotName)
+		return exitNothingToRestore
+	}
+
+	var snapshotInfo *structs.SnapshotInfo
+	selector := options.selector
+	if options.undo {
+		snapshotInfo, err = snapshots.GetLastRestore(snapshotConfig)
+		if err != nil {
+			slog.Error("Can't find the last restore of " + snapshotName + ": " + err.Error())
+			return exitError
+		}
+		if snapshotInfo == nil {
+			slog.Info("There is no restore to undo for " + snapshotName)
+			return exitNothingToRestore
+		}
+		fmt.Printf("Undoing the restore of %s\n", snapshotInfo.Metadata.Restore.Snapshot)
+		options.restore = snapshots.RestoreOptions{Paths: snapshotInfo.Metadata.Restore.Paths, Undo: true}
+		printSnapshotInfo(-1, snapshotInfo)
+		fmt.Println()
+	} else if selector.Number >= 0 || !selector.At.IsZero() || len(selector.Tag) > 0 || len(selector.Path) > 0 {
+		if selector.Number >= 0 && len(selector.Interval) == 0 {
+			selector.Interval = snapshotConfig.Interval
+		}
+		snapshotInfo = snapshots.SelectSnapshot(snapshotsInfo, selector)
+		if snapshotInfo == nil {
+			slog.Info("No snapshot of " + snapshotName + " matches the selection")
+			return exitNothingToRestore
+		}
+		if !options.yes || options.dryRun {
+			printSnapshotInfo(-1, snapshotInfo)
+			fmt.Println()
+		}
+	} else {
+		// the pre restore snapshots hold only what a restore overwrote, they are restored with --undo
+		snapshotsInfo = slices.DeleteFunc(snapshotsInfo, func(snapshotInfo *structs.SnapshotInfo) bool {
+			return snapshotInfo.Interval == structs.PreRestoreInterval
+		})
+		if len(snapshotsInfo) == 0 {
+			slog.Info("There are no snapshots to restore for " + snapshotName)
+			return exitNothingToRestore
+		}
+		loadSnapshotsUsage(configsDir, expandVars, snapshotName, snapshotsInfo)
+		snapshotInfo, err = chooseSnapshot(snapshotsInfo)
+		if err != nil {
+			slog.Error("Can't read the chosen snapshot: " + err.Error())
+			return exitError
+		}
+	}
+
+	if options.dryRun || !options.yes {
+		previews, err := snapshots.PreviewRestore(snapshotInfo, snapshotConfig, options.restore)
+		if errors.Is(err, snapshots.ErrNothingToRestore) {
+			slog.Info(err.Error())
+			return exitNothingToRestore
+		}
+		if err != nil {
+			slog.Error("Can't preview the restore: " + err.Error())
+			return exitError
+		}
+		printRestorePreviews(previews, options.dryRun)
+		if options.dryRun {
+			return exitOK
+		}
+		confirmed, err := askConfirmation(fmt.Sprintf("Restore %s?", snapshotInfo.Abspath))
+		if err != nil {
+			slog.Error("Can't read the answer: " + err.Error())
+			return exitError
+		}
+		if !confirmed {
+			slog.Info("Restore cancelled")
+			return exitError
+		}
+	}
+
+	slog.Info(fmt.Sprintf("Restoring %s", snapshotInfo.Abspath))
+	err = snapshots.RestoreSnapshot(config, snapshotInfo, snapshotConfig, options.restore)
+	if errors.Is(err, snapshots.ErrNothingToRestore) {
+		slog.Info(err.Error())
+		return exitNothingToRestore
+	}
+	if errors.Is(err, snapshots.ErrPartialRestore) {
+		slog.Error("The snapshot was only partially restored: " + err.Error())
+		return exitPartialFailure
+	}
+	if errors.Is(err, snapshots.ErrSnapshotsLocked) {
+		slog.Error("Can't restore the snapshot: " + err.Error())
+		return exitBusy
+	}
+	if err != nil {
+		slog.Error("An error occurred while restoring the snapshot: " + err.Error())
+		return exitError
+	}
+	return exitOK
+}
+
+func printSnapshotInfo(index int, snapshotInfo *structs.SnapshotInfo) {
+	fmt.Println()
+	if index >= 0 {
+		fmt.Printf("[%d]", index)
+	}
+	fmt.Printf("\tName: %s\n", snapshotInfo.SnapshotName)
+	fmt.Printf("\tInterval: %s\n", snapshotInfo.Interval)
+	fmt.Printf("\tNumber: %d\n", snapshotInfo.Number)
+	fmt.Printf("\tCreated: %s\n", snapshotInfo.Timestamp.Local().Format(time.DateTime))
+	fmt.Printf("\tSize: %s\n", getSizeString(snapshotInfo))
+	if len(snapshotInfo.Metadata.Tags) > 0 {
+		fmt.Printf("\tTags: %s\n", strings.Join(snapshotInfo.Metadata.Tags, ", "))
+	}
+	if snapshotInfo.Metadata.Pinned {
+		fmt.Printf("\tPinned: yes\n")
+	}
+	if len(snapshotInfo.Metadata.Note) > 0 {
+		fmt.Printf("\tNote: %s\n", snapshotInfo.Metadata.Note)
+	}
+}
+
+// printRestorePreviews prints the changes of every restore root, one per line
+// when verbose, and their counts and sizes.
+func printRestorePreviews(previews []*snapshots.RestorePreview, verbose bool) {
+	for _, preview := range previews {
+		fmt.Printf("%s:\n", preview.Root)
+		if verbose {
+			for _, change := range preview.Changes {
+				changePath := change.Path
+				if change.IsDir {
+					changePath += "/"
+				}
+				fmt.Printf("  %-9s  %10s  %s\n", change.Action, utils.HumanReadableSize(change.Size), changePath)
+			}
+		}
+		for _, action := range []string{snapshots.RestoreActionCreate, snapshots.RestoreActionOverwrite, snapshots.RestoreActionDelete} {
+			count, bytes := preview.Count(action)
+			fmt.Printf("  files to %s: %d (%s)\n", action, count, utils.HumanReadableSize(bytes))
+		}
+	}
+	fmt.Println()
+}
+
+func chooseSnapshot(snapshotsInfo []*structs.SnapshotInfo) (*structs.SnapshotInfo, error) {
+	for {
+		for i, snapshotInfo := range snapshotsInfo {
+			printSnapshotInfo(i, snapshotInfo)
+		}
+		fmt.Println()
+		fmt.Print("Choose which snapshot to restore: ")
+		// a closed stdin must not restore anything
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		input, err := strconv.Atoi(line)
+		if err == nil && input >= 0 && input < len(snapshotsInfo) {
+			return snapshotsInfo[input], nil
+		}
+		fmt.Println("Invalid number.")
+	}
+}
+
+func askConfirmation(question string) (bool, error) {
+	fmt.Print(question + " [y/N] ")
+	answer, err := readLine()
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes", nil
+}
+
+func readLine() (string, error) {
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && len(line) == 0 {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"testing"
+)
+
+// writeTestConfigs writes the config of snapshot t, which snapshots srcDir
+// into snapshotsDir, and returns the configs dir.
+func writeTestConfigs(t *testing.T, srcDir string, snapshotsDir string) string {
+	t.Helper()
+	configsDir := t.TempDir()
+	snapshotConfig := fmt.Sprintf(`snapshot_name: t
+snapshots_dir: %s
+interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+`, snapshotsDir, srcDir)
+	err := os.WriteFile(path.Join(configsDir, "t.yml"), []byte(snapshotConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configsDir
+}
+
+func TestRestoreExitCodes(t *testing.T) {
+	srcDir := t.TempDir()
+	snapshotsDir := t.TempDir()
+	configsDir := writeTestConfigs(t, srcDir, snapshotsDir)
+	config := &structs.Config{Engine: structs.EngineNative}
+	selectNewest := restoreOptions{selector: snapshots.SnapshotSelector{Number: 0}, yes: true}
+
+	if code := restore(config, configsDir, false, "t", selectNewest); code != exitNothingToRestore {
+		t.Errorf("without snapshots: got exit code %d, want %d", code, exitNothingToRestore)
+	}
+	if code := restore(config, configsDir, false, "missing", selectNewest); code != exitError {
+		t.Errorf("unknown snapshot: got exit code %d, want %d", code, exitError)
+	}
+
+	snapshotPath := path.Join(snapshotsDir, snapshots.GetSnapshotDirName("t", "daily", 0))
+	err := os.MkdirAll(path.Join(snapshotPath, "src"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(snapshotPath, "src", "file"), []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selectMissing := restoreOptions{selector: snapshots.SnapshotSelector{Number: 1}, yes: true}
+	if code := restore(config, configsDir, false, "t", selectMissing); code != exitNothingToRestore {
+		t.Errorf("no matching snapshot: got exit code %d, want %d", code, exitNothingToRestore)
+	}
+	if code := restore(config, configsDir, false, "t", selectNewest); code != exitOK {
+		t.Errorf("restore: got exit code %d, want %d", code, exitOK)
+	}
+	content, err := os.ReadFile(path.Join(srcDir, "file"))
+	if err != nil || string(content) != "content" {
+		t.Errorf("file not restored: %q, %v", content, err)
+	}
+}
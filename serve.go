@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/server"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const defaultServeListen = "127.0.0.1:8080"
+
+func serveCommand(args []string) int {
+	flagSet := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flagSet.String("listen", "", "Address to bind, serve_listen of config.yml or "+defaultServeListen+" when empty")
+	username := flagSet.String("username", "", "Basic auth username, serve_username of config.yml when empty")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync serve [--listen ADDRESS] [--username USER]")
+		fmt.Fprintln(flagSet.Output(), "The password is serve_password of config.yml or the SNAPSYNC_SERVE_PASSWORD environment variable.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 0 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	config, err := configs.LoadConfig(*configsDir, *expandVars)
+	if err != nil {
+		slog.Error("Can't get " + *configsDir + ": " + err.Error())
+		return exitError
+	}
+	if len(*listen) == 0 {
+		*listen = config.ServeListen
+	}
+	if len(*listen) == 0 {
+		*listen = defaultServeListen
+	}
+	if len(*username) == 0 {
+		*username = config.ServeUsername
+	}
+	password := os.Getenv("SNAPSYNC_SERVE_PASSWORD")
+	if len(password) == 0 {
+		password = config.ServePassword
+	}
+	// the snapshots hold copies of every file of the sources, they are never served without a password
+	if len(*username) == 0 || len(password) == 0 {
+		slog.Error("snapsync serve needs a username and a password")
+		return exitUsage
+	}
+
+	httpServer := &http.Server{
+		Addr:              *listen,
+		Handler:           server.NewServer(*configsDir, *expandVars, *username, password),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	slog.Info("Serving the snapshots on http://" + *listen)
+	err = httpServer.ListenAndServe()
+	if err != nil {
+		slog.Error("Can't serve the snapshots: " + err.Error())
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,412 @@
+// Package server implements the read-only HTTP browser of snapsync serve.
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// hiddenFiles are the files snapsync writes at the root of every snapshot
+var hiddenFiles = []string{structs.SnapshotMetadataFileName, structs.SnapshotIndexFileName}
+
+type Server struct {
+	configsDir string
+	expandVars bool
+	username   string
+	password   string
+}
+
+// NewServer returns a handler browsing the snapshots of the configs in
+// configsDir, which asks every request for username and password.
+func NewServer(configsDir string, expandVars bool, username string, password string) *Server {
+	return &Server{configsDir: configsDir, expandVars: expandVars, username: username, password: password}
+}
+
+func (server *Server) authorized(request *http.Request) bool {
+	username, password, ok := request.BasicAuth()
+	if !ok {
+		return false
+	}
+	usernameOk := subtle.ConstantTimeCompare([]byte(username), []byte(server.username)) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(server.password)) == 1
+	return usernameOk && passwordOk
+}
+
+// ServeHTTP routes /, /<name>/ and /<name>/<snapshot dir>/<path in snapshot>.
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !server.authorized(request) {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="snapsync", charset="UTF-8"`)
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean(request.URL.Path), "/"), "/", 3)
+	var err error
+	switch {
+	case parts[0] == "":
+		err = server.serveConfigs(writer)
+	case len(parts) == 1:
+		err = server.serveSnapshots(writer, parts[0])
+	default:
+		relPath := "."
+		if len(parts) == 3 {
+			relPath = parts[2]
+		}
+		err = server.serveSnapshotPath(writer, request, parts[0], parts[1], relPath)
+	}
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Can't serve %s: %s", request.URL.Path, err.Error()))
+	}
+}
+
+func (server *Server) serveConfigs(writer http.ResponseWriter) error {
+	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(server.configsDir, server.expandVars)
+	if err != nil {
+		http.Error(writer, "can't load the snapshot configs", http.StatusInternalServerError)
+		return err
+	}
+	page := listPage{Title: "Snapshot configs"}
+	for _, snapshotConfig := range snapshotsConfigs {
+		var dirs []string
+		for _, dir := range snapshotConfig.Dirs {
+			dirs = append(dirs, dir.SrcDirAbspath)
+		}
+		page.Rows = append(page.Rows, listRow{
+			Link:    "/" + snapshotConfig.SnapshotName + "/",
+			Name:    snapshotConfig.SnapshotName,
+			Columns: []string{strings.Join(dirs, ", ")},
+		})
+	}
+	page.Headers = []string{"Name", "Dirs"}
+	return renderList(writer, page)
+}
+
+func (server *Server) getSnapshot(snapshotName string, snapshotDirName string) (*structs.SnapshotInfo, []*structs.SnapshotInfo, error) {
+	snapshotsInfo, err := snapshots.GetSnapshotsInfo(server.configsDir, server.expandVars, snapshotName)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, snapshotInfo := range snapshotsInfo {
+		if path.Base(snapshotInfo.Abspath) == snapshotDirName {
+			return snapshotInfo, snapshotsInfo, nil
+		}
+	}
+	return nil, snapshotsInfo, nil
+}
+
+func (server *Server) serveSnapshots(writer http.ResponseWriter, snapshotName string) error {
+	_, snapshotsInfo, err := server.getSnapshot(snapshotName, "")
+	if err != nil {
+		http.Error(writer, "can't list the snapshots", http.StatusInternalServerError)
+		return err
+	}
+	page := listPage{Title: "Snapshots of " + snapshotName, Parent: "/", Headers: []string{"Snapshot", "Interval", "Number", "Created", "Size", "Tags", "Status"}}
+	for _, snapshotInfo := range snapshotsInfo {
+		size := "unknown"
+		if snapshotInfo.Metadata.Size != nil {
+			size = utils.HumanReadableSize(snapshotInfo.Metadata.Size.Apparent)
+		}
+		dirName := path.Base(snapshotInfo.Abspath)
+		page.Rows = append(page.Rows, listRow{
+			Link: "/" + snapshotName + "/" + dirName + "/",
+			Name: dirName,
+			Columns: []string{
+				snapshotInfo.Interval,
+				fmt.Sprint(snapshotInfo.Number),
+				snapshotInfo.Timestamp.Local().Format(time.DateTime),
+				size,
+				strings.Join(snapshotInfo.Metadata.Tags, ", "),
+				snapshotInfo.Metadata.Status,
+			},
+		})
+	}
+	return renderList(writer, page)
+}
+
+// resolveSnapshotPath returns the path of relPath in the snapshot at
+// snapshotPath, refusing anything that leads outside of it.
+func resolveSnapshotPath(snapshotPath string, relPath string) (string, error) {
+	relPath = strings.TrimPrefix(path.Clean("/"+relPath), "/")
+	if slices.Contains(hiddenFiles, relPath) {
+		return "", fs.ErrNotExist
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(snapshotPath)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(snapshotPath, relPath))
+	if err != nil {
+		return "", err
+	}
+	insideRelPath, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || insideRelPath == ".." || strings.HasPrefix(insideRelPath, "../") {
+		return "", fs.ErrNotExist
+	}
+	return resolved, nil
+}
+
+func (server *Server) serveSnapshotPath(writer http.ResponseWriter, request *http.Request, snapshotName string, snapshotDirName string, relPath string) error {
+	snapshotInfo, _, err := server.getSnapshot(snapshotName, snapshotDirName)
+	if err != nil {
+		http.Error(writer, "can't list the snapshots", http.StatusInternalServerError)
+		return err
+	}
+	if snapshotInfo == nil {
+		http.NotFound(writer, request)
+		return nil
+	}
+	filePath, err := resolveSnapshotPath(snapshotInfo.Abspath, relPath)
+	if err != nil {
+		http.NotFound(writer, request)
+		return nil
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		http.NotFound(writer, request)
+		return nil
+	}
+	if !info.IsDir() {
+		file, err := openRegularFile(filePath)
+		if errors.Is(err, errNotRegularFile) {
+			http.NotFound(writer, request)
+			return nil
+		}
+		if err != nil {
+			http.Error(writer, "can't open the file", http.StatusInternalServerError)
+			return err
+		}
+		defer file.Close()
+		// the stat of the open file, in case the path was replaced
+		info, err = file.Stat()
+		if err != nil {
+			http.Error(writer, "can't stat the file", http.StatusInternalServerError)
+			return err
+		}
+		writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.Name()))
+		http.ServeContent(writer, request, info.Name(), info.ModTime(), file)
+		return nil
+	}
+
+	archiveName := snapshotDirName
+	if path.Clean("/"+relPath) != "/" {
+		archiveName = path.Base(path.Clean("/" + relPath))
+	}
+	switch request.URL.Query().Get("download") {
+	case "tar":
+		writer.Header().Set("Content-Type", "application/x-tar")
+		writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveName+".tar"))
+		return writeTar(writer, filePath, archiveName, relPath == ".")
+	case "zip":
+		writer.Header().Set("Content-Type", "application/zip")
+		writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveName+".zip"))
+		return writeZip(writer, filePath, archiveName, relPath == ".")
+	}
+
+	if !strings.HasSuffix(request.URL.Path, "/") {
+		http.Redirect(writer, request, request.URL.Path+"/", http.StatusMovedPermanently)
+		return nil
+	}
+	entries, err := os.ReadDir(filePath)
+	if err != nil {
+		http.Error(writer, "can't read the directory", http.StatusInternalServerError)
+		return err
+	}
+	page := listPage{
+		Title:    snapshotDirName + "/" + strings.TrimPrefix(path.Clean("/"+relPath), "/"),
+		Parent:   "../",
+		Headers:  []string{"Name", "Size", "Modified"},
+		Archives: true,
+	}
+	for _, entry := range entries {
+		if relPath == "." && slices.Contains(hiddenFiles, entry.Name()) {
+			continue
+		}
+		entryInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name := entry.Name()
+		size := utils.HumanReadableSize(entryInfo.Size())
+		if entry.IsDir() {
+			name += "/"
+			size = ""
+		}
+		page.Rows = append(page.Rows, listRow{
+			// the "./" keeps a name with a colon from being read as a URL scheme
+			Link:    "./" + (&url.URL{Path: name}).EscapedPath(),
+			Name:    name,
+			Columns: []string{size, entryInfo.ModTime().Local().Format(time.DateTime)},
+		})
+	}
+	return renderList(writer, page)
+}
+
+// walkArchive calls add for every dir and regular file in dirPath with its
+// name in the archive, rooted at archiveName.
+func walkArchive(dirPath string, archiveName string, isSnapshotRoot bool, add func(filePath string, name string, info fs.FileInfo) error) error {
+	return filepath.Walk(dirPath, func(filePath string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return err
+		}
+		if isSnapshotRoot && slices.Contains(hiddenFiles, relPath) {
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		return add(filePath, path.Join(archiveName, filepath.ToSlash(relPath)), info)
+	})
+}
+
+func writeTar(writer io.Writer, dirPath string, archiveName string, isSnapshotRoot bool) error {
+	tarWriter := tar.NewWriter(writer)
+	err := walkArchive(dirPath, archiveName, isSnapshotRoot, func(filePath string, name string, info fs.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = tarWriter.WriteHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return copyFile(tarWriter, filePath)
+	})
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+func writeZip(writer io.Writer, dirPath string, archiveName string, isSnapshotRoot bool) error {
+	zipWriter := zip.NewWriter(writer)
+	err := walkArchive(dirPath, archiveName, isSnapshotRoot, func(filePath string, name string, info fs.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		fileWriter, err := zipWriter.CreateHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return copyFile(fileWriter, filePath)
+	})
+	if err != nil {
+		return err
+	}
+	return zipWriter.Close()
+}
+
+// errNotRegularFile is returned for the paths that are not served, like fifos
+var errNotRegularFile = errors.New("not a regular file")
+
+// openRegularFile opens filePath only if it's a regular file. Opening doesn't
+// follow a symlink or wait for a writer of a fifo.
+func openRegularFile(filePath string) (*os.File, error) {
+	file, err := os.OpenFile(filePath, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, errNotRegularFile
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, errNotRegularFile
+	}
+	return file, nil
+}
+
+func copyFile(writer io.Writer, filePath string) error {
+	file, err := openRegularFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+type listRow struct {
+	Link    string
+	Name    string
+	Columns []string
+}
+
+type listPage struct {
+	Title   string
+	Parent  string
+	Headers []string
+	Rows    []listRow
+	// Archives shows the links to download the dir as an archive
+	Archives bool
+}
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>snapsync - {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 1em; text-align: left; }
+tr:nth-child(even) { background: #f0f0f0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{if .Parent}}<a href="{{.Parent}}">Up</a>{{end}}{{if .Archives}} | Download as <a href="?download=tar">tar</a> or <a href="?download=zip">zip</a>{{end}}</p>
+<table>
+<tr>{{range .Headers}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr><td><a href="{{.Link}}">{{.Name}}</a></td>{{range .Columns}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func renderList(writer http.ResponseWriter, page listPage) error {
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return listTemplate.Execute(writer, page)
+}
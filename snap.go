@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+)
+
+type snapRequest struct {
+	Name      string   `json:"name"`
+	Comment   string   `json:"comment,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	SkipHooks bool     `json:"skip_hooks,omitempty"`
+}
+
+type snapResponse struct {
+	// Snapshot is the path of the snapshot, set whenever it was taken
+	Snapshot string `json:"snapshot,omitempty"`
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exit_code"`
+}
+
+func snapCommand(args []string) int {
+	flagSet := flag.NewFlagSet("snap", flag.ExitOnError)
+	comment := flagSet.String("comment", "", "Note of the snapshot")
+	var tags stringsFlag
+	flagSet.Var(&tags, "tag", "Tag of the snapshot, can be repeated")
+	skipHooks := flagSet.Bool("skip-hooks", false, "Don't run the pre and post snapshot commands")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync snap <name> [--comment TEXT] [--tag TAG]... [--skip-hooks]")
+		fmt.Fprintln(flagSet.Output(), "Takes a snapshot in the first interval now, through the daemon if it is running.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	for _, tag := range tags {
+		err = validateTag(tag)
+		if err != nil {
+			slog.Error(err.Error())
+			return exitUsage
+		}
+	}
+	request := snapRequest{Name: positional[0], Comment: *comment, Tags: tags, SkipHooks: *skipHooks}
+
+	response := snapResponse{}
+	handled, err := callDaemon(*configsDir, controlRequest{Command: controlCommandSnap, Snap: &request}, &response)
+	if err != nil {
+		slog.Error(err.Error())
+		return exitError
+	}
+	if handled {
+		slog.Info("The snapshot was taken by the running daemon")
+	} else {
+		config, err := configs.LoadConfig(*configsDir, *expandVars)
+		if err != nil {
+			slog.Error("Can't get " + *configsDir + ": " + err.Error())
+			return exitError
+		}
+		snapshotConfig, err := configs.GetSnapshotConfigByName(*configsDir, *expandVars, request.Name)
+		if err != nil {
+			slog.Error("An error occurred: " + err.Error())
+			return exitError
+		}
+		if snapshotConfig == nil {
+			slog.Error("Snapshot template " + request.Name + " does not exist.")
+			return exitError
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		response = takeSnapshot(ctx, config, snapshotConfig, request)
+	}
+	if len(response.Snapshot) > 0 {
+		printSnapSummary(response.Snapshot)
+	}
+	if len(response.Error) > 0 {
+		slog.Error(response.Error)
+	}
+	return response.ExitCode
+}
+
+// takeSnapshot takes the snapshot asked by request in the first interval of
+// snapshotConfig, from the snap command or from the daemon.
+func takeSnapshot(ctx context.Context, config *structs.Config, snapshotConfig *structs.SnapshotConfig, request snapRequest) snapResponse {
+	intervalConfig, err := configs.GetIntervalConfig(snapshotConfig, snapshotConfig.Interval)
+	if err != nil {
+		return snapResponse{Error: err.Error(), ExitCode: exitError}
+	}
+	options := snapshots.SnapshotOptions{Note: request.Comment, Tags: request.Tags, SkipHooks: request.SkipHooks}
+	snapshotPath, err := snapshots.ExecuteSnapshot(ctx, config, intervalConfig, options)
+	response := snapResponse{Snapshot: snapshotPath, ExitCode: exitOK}
+	if err != nil {
+		response.Error = fmt.Sprintf("Can't take snapshot of %s: %s", snapshotConfig.SnapshotName, err.Error())
+		switch {
+		case errors.Is(err, snapshots.ErrSnapshotsLocked):
+			response.ExitCode = exitBusy
+		case len(snapshotPath) > 0:
+			response.ExitCode = exitPartialFailure
+		default:
+			response.ExitCode = exitError
+		}
+	}
+	return response
+}
+
+func printSnapSummary(snapshotPath string) {
+	snapshotInfo, err := snapshots.GetSnapshotInfo(snapshotPath)
+	if err != nil {
+		slog.Warn("Can't read the snapshot: " + err.Error())
+		return
+	}
+	metadata := snapshotInfo.Metadata
+	fmt.Printf("Snapshot %s\n", path.Base(snapshotPath))
+	fmt.Printf("\tPath: %s\n", snapshotPath)
+	fmt.Printf("\tStatus: %s\n", metadata.Status)
+	fmt.Printf("\tDuration: %.2f s\n", metadata.FinishedAt.Sub(metadata.StartedAt).Seconds())
+	for _, dirRun := range metadata.Dirs {
+		if dirRun.Missing {
+			fmt.Printf("\t%s: missing, previous copy kept\n", dirRun.SrcDirAbspath)
+			continue
+		}
+		fmt.Printf("\t%s: %d files (%s), %d copied (%s)\n", dirRun.SrcDirAbspath, dirRun.Files, utils.HumanReadableSize(dirRun.TotalSize), dirRun.TransferredFiles, utils.HumanReadableSize(dirRun.TransferredSize))
+		if dirRun.SkippedFiles > 0 {
+			fmt.Printf("\t%s: %d dangling or looping symlinks skipped\n", dirRun.SrcDirAbspath, dirRun.SkippedFiles)
+		}
+	}
+	for _, hookRun := range metadata.Hooks {
+		fmt.Printf("\t%s snapshot command exited with %d: %s\n", hookRun.Phase, hookRun.ExitCode, hookRun.Command)
+	}
+}
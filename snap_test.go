@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"syscall"
+	"testing"
+)
+
+func TestTakeSnapshotExitCodes(t *testing.T) {
+	srcDir := t.TempDir()
+	snapshotsDir := t.TempDir()
+	configsDir := writeTestConfigs(t, srcDir, snapshotsDir)
+	snapshotConfig, err := configs.GetSnapshotConfigByName(configsDir, false, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &structs.Config{Engine: structs.EngineNative}
+
+	response := takeSnapshot(context.Background(), config, snapshotConfig, snapRequest{Name: "t", Tags: []string{"manual"}})
+	if response.ExitCode != exitOK || len(response.Snapshot) == 0 {
+		t.Fatalf("got %+v, want a snapshot", response)
+	}
+	snapshotInfo, err := snapshots.GetSnapshotInfo(response.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshotInfo.Metadata.Tags) != 1 || snapshotInfo.Metadata.Tags[0] != "manual" {
+		t.Errorf("got tags %v, want the requested ones", snapshotInfo.Metadata.Tags)
+	}
+
+	// another process holds the lock of the interval
+	lockFile, err := os.Create(path.Join(snapshotsDir, "."+snapshots.GetSnapshotDirPrefix("t", "daily")+"lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockFile.Close()
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = takeSnapshot(context.Background(), config, snapshotConfig, snapRequest{Name: "t"})
+	if response.ExitCode != exitBusy {
+		t.Errorf("got %+v, want exit code %d", response, exitBusy)
+	}
+}
+
+func TestCallDaemon(t *testing.T) {
+	configsDir := t.TempDir()
+	response := snapResponse{}
+	handled, err := callDaemon(configsDir, controlRequest{Command: controlCommandSnap}, &response)
+	if err != nil || handled {
+		t.Fatalf("got %v, %v without a daemon, want not handled", handled, err)
+	}
+	listener, err := listenControl(configsDir, func(request controlRequest) any {
+		return snapResponse{Snapshot: request.Snap.Name, ExitCode: exitPartialFailure}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, err = listenControl(configsDir, func(request controlRequest) any { return nil })
+	if err == nil {
+		t.Error("a second daemon could listen on the same configs dir")
+	}
+	handled, err = callDaemon(configsDir, controlRequest{Command: controlCommandSnap, Snap: &snapRequest{Name: "t"}}, &response)
+	if err != nil || !handled {
+		t.Fatalf("got %v, %v, want handled", handled, err)
+	}
+	if response.Snapshot != "t" || response.ExitCode != exitPartialFailure {
+		t.Errorf("got %+v", response)
+	}
+}
@@ -0,0 +1,44 @@
+package snapshots
+
+import (
+	"fmt"
+	"os"
+	"peppeosmio/snapsync/structs"
+)
+
+// UpdateSnapshotMetadata changes the metadata of snapshotInfo with update,
+// holding the lock of its interval so that a rotation can't rename the
+// snapshot in the meantime. The metadata is inside the snapshot, so it follows
+// the later renames.
+func UpdateSnapshotMetadata(snapshotConfig *structs.SnapshotConfig, snapshotInfo *structs.SnapshotInfo, update func(metadata *structs.SnapshotMetadata)) error {
+	intervalConfig := *snapshotConfig
+	intervalConfig.Interval = snapshotInfo.Interval
+	unlock, err := lockSnapshots(&intervalConfig)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = checkSnapshotUnchanged(snapshotInfo)
+	if err != nil {
+		return err
+	}
+	return updateSnapshotMetadata(snapshotInfo.Abspath, update)
+}
+
+// checkSnapshotUnchanged fails if the path of snapshotInfo holds another
+// snapshot, or none, since it was listed. A numbered snapshot may have been
+// rotated or pruned in the meantime. The lock of its interval must be held.
+func checkSnapshotUnchanged(snapshotInfo *structs.SnapshotInfo) error {
+	_, err := os.Stat(snapshotInfo.Abspath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s was removed", snapshotInfo.Abspath)
+	}
+	current, err := loadSnapshotInfo(snapshotInfo.Abspath)
+	if err != nil {
+		return err
+	}
+	if !current.Timestamp.Equal(snapshotInfo.Timestamp) {
+		return fmt.Errorf("%s was rotated, list the snapshots again", snapshotInfo.Abspath)
+	}
+	return nil
+}
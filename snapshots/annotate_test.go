@@ -0,0 +1,84 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"peppeosmio/snapsync/structs"
+	"testing"
+	"time"
+)
+
+func TestPinnedSnapshotSurvivesRotation(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "content"})
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 2
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+`, srcDir))
+	config := &structs.Config{Engine: structs.EngineNative}
+	_, err := ExecuteSnapshot(context.Background(), config, snapshotConfig, SnapshotOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinnedStartedAt := snapshotsInfo[0].Metadata.StartedAt
+	err = UpdateSnapshotMetadata(snapshotConfig, snapshotsInfo[0], func(metadata *structs.SnapshotMetadata) {
+		metadata.Pinned = true
+		metadata.Tags = append(metadata.Tags, "keep")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = ExecuteSnapshot(context.Background(), config, snapshotConfig, SnapshotOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshotsInfo, err = listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshotsInfo) != 3 {
+		t.Fatalf("got %d snapshots, want the 2 retained and the pinned one", len(snapshotsInfo))
+	}
+	pinned := snapshotsInfo[len(snapshotsInfo)-1]
+	if !pinned.Metadata.Pinned || !pinned.Metadata.StartedAt.Equal(pinnedStartedAt) || len(pinned.Metadata.Tags) != 1 {
+		t.Errorf("got %s with %+v, want the pinned snapshot", pinned.Abspath, pinned.Metadata)
+	}
+	for _, snapshotInfo := range snapshotsInfo[:len(snapshotsInfo)-1] {
+		if snapshotInfo.Metadata.Pinned || len(snapshotInfo.Metadata.Tags) > 0 {
+			t.Errorf("%s got the pin or the tags of another snapshot", snapshotInfo.Abspath)
+		}
+	}
+}
+
+func TestUpdateSnapshotMetadataRefusesRotatedSnapshot(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 2\n")
+	writeNumberedSnapshots(t, snapshotConfig.SnapshotsDir, time.Now())
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// listed before another snapshot took its number
+	stale := *snapshotsInfo[0]
+	stale.Timestamp = stale.Timestamp.Add(-time.Hour)
+	err = UpdateSnapshotMetadata(snapshotConfig, &stale, func(metadata *structs.SnapshotMetadata) {
+		metadata.Pinned = true
+	})
+	if err == nil {
+		t.Fatal("got no error pinning a rotated snapshot")
+	}
+	metadata, err := readSnapshotMetadata(snapshotsInfo[0].Abspath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Pinned {
+		t.Error("the snapshot that took the number was pinned")
+	}
+}
@@ -0,0 +1,265 @@
+package snapshots
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func hasSpaceBudget(snapshotConfig *structs.SnapshotConfig) bool {
+	return len(snapshotConfig.MinFreeSpace) > 0 || len(snapshotConfig.MaxTotalSize) > 0
+}
+
+// parseMinFreeSpace accepts a size or a percentage of the filesystem size.
+func parseMinFreeSpace(minFreeSpace string, filesystemSize int64) (int64, error) {
+	if len(minFreeSpace) == 0 {
+		return 0, nil
+	}
+	if strings.HasSuffix(minFreeSpace, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(minFreeSpace, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid percentage %s", minFreeSpace)
+		}
+		return int64(float64(filesystemSize) * percent / 100), nil
+	}
+	return utils.ParseSize(minFreeSpace)
+}
+
+// lockAllIntervals locks every interval of snapshotConfig except the ones in
+// alreadyLocked, which the caller holds.
+func lockAllIntervals(snapshotConfig *structs.SnapshotConfig, alreadyLocked ...string) (unlock func(), err error) {
+	unlocks := []func(){}
+	unlock = func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, interval := range snapshotConfig.Intervals {
+		if slices.Contains(alreadyLocked, interval.Name) {
+			continue
+		}
+		intervalConfig, err := configs.GetIntervalConfig(snapshotConfig, interval.Name)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		intervalUnlock, err := lockSnapshots(intervalConfig)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, intervalUnlock)
+		err = recoverSnapshots(intervalConfig)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+// estimateSnapshotSize returns the bytes a new snapshot would take: the files
+// that differ from the newest snapshot are copied, the others are hard linked.
+func estimateSnapshotSize(snapshotConfig *structs.SnapshotConfig, newestSnapshotPath string) (size int64, err error) {
+	for _, dir := range snapshotConfig.Dirs {
+		linkDestDir := ""
+		if len(newestSnapshotPath) > 0 {
+			linkDestDir = path.Join(newestSnapshotPath, dir.DstDirInSnapshot)
+		}
+		dirSize, err := estimateTreeSize(newExcludeMatcher(dir.Excludes), dir.SrcDirAbspath, linkDestDir, "")
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return size, err
+		}
+		size += dirSize
+	}
+	return size, nil
+}
+
+func estimateTreeSize(matcher *excludeMatcher, srcDir string, linkDestDir string, relDir string) (size int64, err error) {
+	entries, err := os.ReadDir(path.Join(srcDir, relDir))
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		entryRel := path.Join(relDir, entry.Name())
+		entryInfo, err := os.Stat(path.Join(srcDir, entryRel))
+		if err != nil || matcher.excluded(entryRel, entryInfo.IsDir()) {
+			continue
+		}
+		if entryInfo.IsDir() {
+			// every snapshot has its own directories
+			size += 4096
+			dirSize, err := estimateTreeSize(matcher, srcDir, linkDestDir, entryRel)
+			if err != nil {
+				return size, err
+			}
+			size += dirSize
+			continue
+		}
+		if !entryInfo.Mode().IsRegular() {
+			continue
+		}
+		if len(linkDestDir) > 0 {
+			linkDestInfo, err := os.Lstat(path.Join(linkDestDir, entryRel))
+			if err == nil && sameFileNative(entryInfo, linkDestInfo) {
+				continue
+			}
+		}
+		size += entryInfo.Size()
+	}
+	return size, nil
+}
+
+// checkSpaceBudget makes room for the next snapshot of snapshotConfig.
+func checkSpaceBudget(snapshotConfig *structs.SnapshotConfig) error {
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		return err
+	}
+	newestSnapshotPath := ""
+	if len(snapshotsInfo) > 0 {
+		newestSnapshotPath = snapshotsInfo[0].Abspath
+	}
+	needed, err := estimateSnapshotSize(snapshotConfig, newestSnapshotPath)
+	if err != nil {
+		return fmt.Errorf("can't estimate snapshot size: %s", err.Error())
+	}
+	slog.Debug(fmt.Sprintf("[%s] next snapshot needs about %s", snapshotConfig.SnapshotName, utils.HumanReadableSize(needed)))
+	return enforceSpaceBudget(snapshotConfig, needed)
+}
+
+// sortForSpacePruning sorts snapshotsInfo in the order they are deleted to make
+// room: the pre restore snapshots, then the intervals from the most frequent
+// one like the rotation of rsnapshot tiers does, each from the oldest snapshot.
+func sortForSpacePruning(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo) {
+	ranks := map[string]int{structs.PreRestoreInterval: -1}
+	for i, interval := range snapshotConfig.Intervals {
+		ranks[interval.Name] = i
+	}
+	slices.SortStableFunc(snapshotsInfo, func(a *structs.SnapshotInfo, b *structs.SnapshotInfo) int {
+		if ranks[a.Interval] != ranks[b.Interval] {
+			return ranks[a.Interval] - ranks[b.Interval]
+		}
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+}
+
+// enforceSpaceBudget deletes unpinned snapshots, from the lowest interval up
+// and the oldest first, until needed more bytes fit within min_free_space and
+// max_total_size, but never leaves less than min_snapshots snapshots. It returns an error if the
+// limits still don't hold.
+func enforceSpaceBudget(snapshotConfig *structs.SnapshotConfig, needed int64, alreadyLocked ...string) error {
+	if !hasSpaceBudget(snapshotConfig) {
+		return nil
+	}
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	err := os.MkdirAll(snapshotConfig.SnapshotsDir, 0700)
+	if err != nil {
+		return fmt.Errorf("%s can't create snapshot dir %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotsDir, err.Error())
+	}
+	unlock, err := lockAllIntervals(snapshotConfig, alreadyLocked...)
+	if err != nil {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer unlock()
+
+	free, filesystemSize, err := getFreeSpace(snapshotConfig.SnapshotsDir)
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	minFree, err := parseMinFreeSpace(snapshotConfig.MinFreeSpace, filesystemSize)
+	if err != nil {
+		return fmt.Errorf("%s min_free_space: %s", snapshotLogPrefix, err.Error())
+	}
+	snapshotsInfo, err := listSnapshots(snapshotConfig.SnapshotsDir, snapshotConfig.SnapshotName, "")
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	var maxTotal int64
+	var index *usageIndex
+	if len(snapshotConfig.MaxTotalSize) > 0 {
+		maxTotal, err = utils.ParseSize(snapshotConfig.MaxTotalSize)
+		if err != nil {
+			return fmt.Errorf("%s max_total_size: %s", snapshotLogPrefix, err.Error())
+		}
+		index, err = newSnapshotsUsageIndex(snapshotsInfo)
+		if err != nil {
+			return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+		}
+	}
+	fits := func() bool {
+		if minFree > 0 && free-needed < minFree {
+			return false
+		}
+		if index != nil && index.total+needed > maxTotal {
+			return false
+		}
+		return true
+	}
+
+	sortForSpacePruning(snapshotConfig, snapshotsInfo)
+	minSnapshots := snapshotConfig.MinSnapshots
+	if minSnapshots < 1 {
+		minSnapshots = 1
+	}
+	// every interval is sorted from the oldest, so the newest snapshot of the
+	// first interval is the last one
+	newestSnapshotPath := ""
+	for _, snapshotInfo := range snapshotsInfo {
+		if len(snapshotConfig.Intervals) > 0 && snapshotInfo.Interval == snapshotConfig.Intervals[0].Name {
+			newestSnapshotPath = snapshotInfo.Abspath
+		}
+	}
+	remaining := len(snapshotsInfo)
+	for _, snapshotInfo := range snapshotsInfo {
+		if fits() || remaining <= minSnapshots {
+			break
+		}
+		// the newest snapshot holds the latest state and is the base of the next one
+		if snapshotInfo.Abspath == newestSnapshotPath {
+			continue
+		}
+		if snapshotInfo.Metadata.Pinned {
+			continue
+		}
+		// a pre restore snapshot is needed to undo a restore for a while
+		if snapshotInfo.Metadata.KeepUntil != nil && time.Now().Before(*snapshotInfo.Metadata.KeepUntil) {
+			continue
+		}
+		slog.Info(fmt.Sprintf("%s removing snapshot %s to free space", snapshotLogPrefix, snapshotInfo.Abspath))
+		err = os.RemoveAll(snapshotInfo.Abspath)
+		if err != nil {
+			return fmt.Errorf("%s can't remove snapshot %s: %s", snapshotLogPrefix, snapshotInfo.Abspath, err.Error())
+		}
+		if index != nil {
+			index.remove(snapshotInfo.Abspath)
+		}
+		remaining--
+		free, _, err = getFreeSpace(snapshotConfig.SnapshotsDir)
+		if err != nil {
+			return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+		}
+	}
+	if !fits() {
+		message := fmt.Sprintf("%s not enough space for %s: %s free", snapshotLogPrefix, utils.HumanReadableSize(needed), utils.HumanReadableSize(free))
+		if minFree > 0 {
+			message += fmt.Sprintf(" with %s to keep free", utils.HumanReadableSize(minFree))
+		}
+		if index != nil {
+			message += fmt.Sprintf(", %s used of %s", utils.HumanReadableSize(index.total), utils.HumanReadableSize(maxTotal))
+		}
+		return fmt.Errorf("%s", message)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package snapshots
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"testing"
+	"time"
+)
+
+func TestSortForSpacePruning(t *testing.T) {
+	snapshotConfig := &structs.SnapshotConfig{
+		Intervals: []structs.SnapshotInterval{{Name: "daily"}, {Name: "weekly"}, {Name: "monthly"}},
+	}
+	now := time.Now()
+	snapshotsInfo := []*structs.SnapshotInfo{
+		{Abspath: "monthly.0", Interval: "monthly", Timestamp: now.AddDate(0, -2, 0)},
+		{Abspath: "weekly.0", Interval: "weekly", Timestamp: now.AddDate(0, 0, -14)},
+		{Abspath: "daily.0", Interval: "daily", Timestamp: now},
+		{Abspath: "daily.1", Interval: "daily", Timestamp: now.AddDate(0, 0, -1)},
+		{Abspath: "pre-restore.0", Interval: structs.PreRestoreInterval, Timestamp: now},
+	}
+	sortForSpacePruning(snapshotConfig, snapshotsInfo)
+	want := []string{"pre-restore.0", "daily.1", "daily.0", "weekly.0", "monthly.0"}
+	for i, snapshotInfo := range snapshotsInfo {
+		if snapshotInfo.Abspath != want[i] {
+			t.Fatalf("position %d: got %s, want %s", i, snapshotInfo.Abspath, want[i])
+		}
+	}
+}
+
+func TestSnapshotsUsageIndexIgnoresOtherConfigs(t *testing.T) {
+	snapshotsDir := t.TempDir()
+	writeTestTree(t, path.Join(snapshotsDir, "a.daily.0"), map[string]string{"file": "1234"})
+	writeTestTree(t, path.Join(snapshotsDir, "b.daily.0"), map[string]string{"file": "123456789"})
+	snapshotsInfo, err := listSnapshots(snapshotsDir, "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := newSnapshotsUsageIndex(snapshotsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.snapshotInodes) != 1 {
+		t.Fatalf("got %d snapshots indexed, want 1", len(index.snapshotInodes))
+	}
+	if index.apparent[path.Join(snapshotsDir, "a.daily.0")] != 4 {
+		t.Errorf("got apparent size %d, want 4", index.apparent[path.Join(snapshotsDir, "a.daily.0")])
+	}
+}
+
+func TestExecuteSnapshotBudgetReportsLockedSnapshots(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "content"})
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+max_total_size: 1G
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+`, srcDir))
+	err := os.MkdirAll(snapshotConfig.SnapshotsDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	_, err = ExecuteSnapshot(context.Background(), &structs.Config{Engine: structs.EngineNative}, snapshotConfig, SnapshotOptions{})
+	if !errors.Is(err, ErrSnapshotsLocked) {
+		t.Errorf("got %v, want the snapshots locked", err)
+	}
+}
@@ -0,0 +1,115 @@
+package snapshots
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"peppeosmio/snapsync/structs"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// commandWaitDelay is how long a command canceled with SIGTERM has to exit
+// before it is killed
+const commandWaitDelay = 10 * time.Second
+
+// runCommand executes name with args without going through a shell, so paths
+// containing spaces, quotes or $ are passed verbatim. The returned error
+// includes the exit code and what the command wrote to stderr. When ctx is
+// canceled the command gets SIGTERM, so that rsync and hooks can clean up.
+func runCommand(ctx context.Context, name string, args ...string) (stdout string, stderr string, err error) {
+	stdout, stderr, _, err = runCommandExitCode(ctx, false, name, args...)
+	return stdout, stderr, err
+}
+
+// runCommandExitCode is runCommand also returning the exit code, -1 if the
+// command couldn't run or was killed by a signal. With processGroup the command
+// runs in its own process group and cancelling signals the whole group, so that
+// the children of a shell are stopped too.
+func runCommandExitCode(ctx context.Context, processGroup bool, name string, args ...string) (stdout string, stderr string, exitCode int, err error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		if processGroup {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		}
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	if processGroup {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	cmd.WaitDelay = commandWaitDelay
+	var stdoutBuffer, stderrBuffer bytes.Buffer
+	cmd.Stdout = &stdoutBuffer
+	cmd.Stderr = &stderrBuffer
+	slog.Debug(fmt.Sprintf("Running %s %s", name, strings.Join(args, " ")))
+	err = cmd.Run()
+	stdout = stdoutBuffer.String()
+	stderr = strings.TrimSpace(stderrBuffer.String())
+	exitCode = cmd.ProcessState.ExitCode()
+	if err != nil {
+		exitErr := &exec.ExitError{}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%s timed out", name)
+		} else if ctx.Err() != nil {
+			err = fmt.Errorf("%s was canceled: %s", name, ctx.Err().Error())
+		} else if errors.As(err, &exitErr) {
+			err = fmt.Errorf("%s exited with code %d", name, exitErr.ExitCode())
+		}
+		if len(stderr) > 0 {
+			err = fmt.Errorf("%s: %s", err.Error(), stderr)
+		}
+	}
+	return stdout, stderr, exitCode, err
+}
+
+func getShell(config *structs.Config) string {
+	if len(config.Shell) > 0 {
+		return config.Shell
+	}
+	return "/bin/sh"
+}
+
+// GetExecutables returns the external programs run to take the snapshots of
+// snapshotConfig, as configured in config.
+func GetExecutables(config *structs.Config, snapshotConfig *structs.SnapshotConfig) []string {
+	executables := []string{}
+	if config.Engine == structs.EngineRsync {
+		executables = append(executables, getRsyncExecutable(config), getCpExecutable(config))
+	}
+	if len(snapshotConfig.PreSnapshotCommands) > 0 || len(snapshotConfig.PostSnapshotCommands) > 0 {
+		executables = append(executables, getShell(config))
+	}
+	return executables
+}
+
+// maxHookOutput is how much of stdout and stderr of a hook is kept in the
+// snapshot metadata, the end of the output being the most useful
+const maxHookOutput = 16 * 1024
+
+// runHook executes a pre or post snapshot command with the configured shell.
+// Hooks are the only place where shell syntax is wanted.
+func runHook(ctx context.Context, config *structs.Config, phase string, command string) (hookRun structs.HookRun, err error) {
+	before := time.Now()
+	stdout, stderr, exitCode, err := runCommandExitCode(ctx, true, getShell(config), "-c", command)
+	hookRun = structs.HookRun{
+		Phase:           phase,
+		Command:         command,
+		ExitCode:        exitCode,
+		Stdout:          truncateHookOutput(strings.TrimSpace(stdout)),
+		Stderr:          truncateHookOutput(stderr),
+		DurationSeconds: time.Since(before).Seconds(),
+		TimedOut:        err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded),
+	}
+	return hookRun, err
+}
+
+func truncateHookOutput(output string) string {
+	if len(output) <= maxHookOutput {
+		return output
+	}
+	return "..." + strings.ToValidUTF8(output[len(output)-maxHookOutput:], "")
+}
@@ -0,0 +1,113 @@
+package snapshots
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunCommandPassesArgsVerbatim(t *testing.T) {
+	for _, arg := range []string{"a b", "it's", `"quoted"`, "$HOME", "`id`", "; echo injected", "-- x"} {
+		stdout, _, err := runCommand(context.Background(), "printf", "%s", arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stdout != arg {
+			t.Errorf("got %q, want %q", stdout, arg)
+		}
+	}
+}
+
+func TestRunCommandErrorHasExitCodeAndStderr(t *testing.T) {
+	_, stderr, err := runCommand(context.Background(), "sh", "-c", "echo oops >&2; exit 3")
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	if stderr != "oops" {
+		t.Errorf("got stderr %q, want oops", stderr)
+	}
+	if !strings.Contains(err.Error(), "exited with code 3") || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("got %q, want the exit code and stderr", err.Error())
+	}
+}
+
+func TestRunHookUsesShell(t *testing.T) {
+	hookRun, err := runHook(context.Background(), &structs.Config{}, structs.HookPhasePre, "echo $((1 + 2)) | tr 3 x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hookRun.Stdout != "x" {
+		t.Errorf("got %q, want the shell to run the pipeline", hookRun.Stdout)
+	}
+}
+
+func TestRunHookRecordsFailure(t *testing.T) {
+	hookRun, err := runHook(context.Background(), &structs.Config{}, structs.HookPhasePost, "echo out; echo err >&2; exit 4")
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	want := structs.HookRun{Phase: structs.HookPhasePost, Command: "echo out; echo err >&2; exit 4", ExitCode: 4, Stdout: "out", Stderr: "err"}
+	hookRun.DurationSeconds = 0
+	if hookRun != want {
+		t.Errorf("got %+v, want %+v", hookRun, want)
+	}
+}
+
+func TestTruncateHookOutputKeepsTheEnd(t *testing.T) {
+	output := strings.Repeat("a", maxHookOutput) + "end"
+	truncated := truncateHookOutput(output)
+	if !strings.HasPrefix(truncated, "...") || !strings.HasSuffix(truncated, "end") || len(truncated) != maxHookOutput+3 {
+		t.Errorf("got %d bytes, want the last %d with a ... prefix", len(truncated), maxHookOutput)
+	}
+}
+
+// processAlive tells if pid is running, a zombie waiting to be reaped counts as exited
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestRunHookCancelStopsChildren(t *testing.T) {
+	pidPath := path.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for !pathExists(pidPath) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+	before := time.Now()
+	hookRun, err := runHook(ctx, &structs.Config{}, structs.HookPhasePre, fmt.Sprintf("sleep 30 & echo $! > %[1]s.tmp; mv %[1]s.tmp %[1]s; wait", pidPath))
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Errorf("got %v, want the hook canceled", err)
+	}
+	if time.Since(before) > commandWaitDelay {
+		t.Errorf("the canceled hook ran for %s", time.Since(before))
+	}
+	if hookRun.ExitCode != -1 {
+		t.Errorf("got exit code %d, want -1 for a killed hook", hookRun.ExitCode)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(readTestFile(t, pidPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); processAlive(pid) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if processAlive(pid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Error("the child of the hook is still running")
+	}
+}
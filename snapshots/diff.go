@@ -0,0 +1,288 @@
+package snapshots
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"slices"
+	"syscall"
+)
+
+const (
+	DiffAdded    = "added"
+	DiffRemoved  = "removed"
+	DiffModified = "modified"
+	// DiffMetadata is a file or dir with the same content but different permissions, owner or time
+	DiffMetadata = "metadata"
+)
+
+// DiffChange is a difference between two snapshots, or a snapshot and the
+// sources. Path is where the file lives in the sources.
+type DiffChange struct {
+	Change  string `json:"change"`
+	Path    string `json:"path"`
+	IsDir   bool   `json:"is_dir"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+	// Metadata lists what changed for DiffMetadata: mode, owner or mtime
+	Metadata []string `json:"metadata,omitempty"`
+}
+
+// diffSide is one of the two trees compared for a SnapshotDir
+type diffSide struct {
+	root    string
+	matcher *excludeMatcher
+}
+
+// DiffSnapshots compares the snapshot from with the snapshot to, or with the
+// live sources if to is nil. Files with the same inode are unchanged without
+// being read, which is what hard linked snapshots make cheap.
+func DiffSnapshots(snapshotConfig *structs.SnapshotConfig, from *structs.SnapshotInfo, to *structs.SnapshotInfo) (changes []DiffChange, err error) {
+	for _, dir := range snapshotConfig.Dirs {
+		snapshotSide := func(snapshotInfo *structs.SnapshotInfo) diffSide {
+			var excludes []string
+			// a dir snapshotted at the root of the snapshot shares it with the snapsync files
+			if path.Clean("/"+dir.DstDirInSnapshot) == "/" {
+				excludes = getSnapsyncFilesExcludes()
+			}
+			return diffSide{root: path.Join(snapshotInfo.Abspath, dir.DstDirInSnapshot), matcher: newExcludeMatcher(excludes)}
+		}
+		fromSide := snapshotSide(from)
+		// the files excluded from the snapshots are not differences
+		toSide := diffSide{root: dir.SrcDirAbspath, matcher: newExcludeMatcher(dir.Excludes)}
+		if to != nil {
+			toSide = snapshotSide(to)
+		}
+		dirChanges, err := diffTree(fromSide, toSide, dir.SrcDirAbspath, ".")
+		if err != nil {
+			return changes, err
+		}
+		changes = append(changes, dirChanges...)
+	}
+	return changes, nil
+}
+
+// readDiffDir returns the entries of relDir in side that are not excluded,
+// following symlinks like the snapshots do. A missing dir has no entries.
+func readDiffDir(side diffSide, relDir string) (map[string]os.FileInfo, error) {
+	infos := map[string]os.FileInfo{}
+	dirPath := path.Join(side.root, relDir)
+	entries, err := os.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return infos, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read directory %s: %s", dirPath, err.Error())
+	}
+	for _, entry := range entries {
+		entryRel := path.Join(relDir, entry.Name())
+		info, err := os.Stat(path.Join(side.root, entryRel))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't stat %s: %s", path.Join(side.root, entryRel), err.Error())
+		}
+		if side.matcher.excluded(entryRel, info.IsDir()) || (!info.IsDir() && !info.Mode().IsRegular()) {
+			continue
+		}
+		infos[entry.Name()] = info
+	}
+	return infos, nil
+}
+
+func diffTree(fromSide diffSide, toSide diffSide, sourceRoot string, relDir string) (changes []DiffChange, err error) {
+	fromInfos, err := readDiffDir(fromSide, relDir)
+	if err != nil {
+		return nil, err
+	}
+	toInfos, err := readDiffDir(toSide, relDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range fromInfos {
+		names = append(names, name)
+	}
+	for name := range toInfos {
+		if _, ok := fromInfos[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		entryRel := path.Join(relDir, name)
+		sourcePath := path.Join(sourceRoot, entryRel)
+		fromInfo, inFrom := fromInfos[name]
+		toInfo, inTo := toInfos[name]
+		// a file replaced by a dir, or the opposite, is removed and added again
+		if inFrom && inTo && fromInfo.IsDir() != toInfo.IsDir() {
+			removed, err := diffOneSide(fromSide, sourceRoot, entryRel, fromInfo, DiffRemoved)
+			if err != nil {
+				return nil, err
+			}
+			added, err := diffOneSide(toSide, sourceRoot, entryRel, toInfo, DiffAdded)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, removed...)
+			changes = append(changes, added...)
+			continue
+		}
+		if !inTo {
+			removed, err := diffOneSide(fromSide, sourceRoot, entryRel, fromInfo, DiffRemoved)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, removed...)
+			continue
+		}
+		if !inFrom {
+			added, err := diffOneSide(toSide, sourceRoot, entryRel, toInfo, DiffAdded)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, added...)
+			continue
+		}
+		if fromInfo.IsDir() {
+			// the time of a dir changes with its content, only its mode and owner are compared
+			metadata := diffMetadata(fromInfo, toInfo)
+			metadata = slices.DeleteFunc(metadata, func(field string) bool { return field == "mtime" })
+			if len(metadata) > 0 {
+				changes = append(changes, DiffChange{Change: DiffMetadata, Path: sourcePath, IsDir: true, Metadata: metadata})
+			}
+			dirChanges, err := diffTree(fromSide, toSide, sourceRoot, entryRel)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, dirChanges...)
+			continue
+		}
+		change, err := diffFile(path.Join(fromSide.root, entryRel), fromInfo, path.Join(toSide.root, entryRel), toInfo)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			change.Path = sourcePath
+			changes = append(changes, *change)
+		}
+	}
+	return changes, nil
+}
+
+// diffOneSide reports entryRel and everything inside it as change.
+func diffOneSide(side diffSide, sourceRoot string, entryRel string, info os.FileInfo, change string) ([]DiffChange, error) {
+	diffChange := DiffChange{Change: change, Path: path.Join(sourceRoot, entryRel), IsDir: info.IsDir()}
+	if !info.IsDir() {
+		if change == DiffAdded {
+			diffChange.NewSize = info.Size()
+		} else {
+			diffChange.OldSize = info.Size()
+		}
+	}
+	changes := []DiffChange{diffChange}
+	if !info.IsDir() {
+		return changes, nil
+	}
+	infos, err := readDiffDir(side, entryRel)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range infos {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		childChanges, err := diffOneSide(side, sourceRoot, path.Join(entryRel, name), infos[name], change)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, childChanges...)
+	}
+	return changes, nil
+}
+
+// diffFile compares two regular files, returning nil if they are the same.
+func diffFile(fromPath string, fromInfo os.FileInfo, toPath string, toInfo os.FileInfo) (*DiffChange, error) {
+	if os.SameFile(fromInfo, toInfo) {
+		return nil, nil
+	}
+	change := &DiffChange{OldSize: fromInfo.Size(), NewSize: toInfo.Size()}
+	if fromInfo.Size() != toInfo.Size() {
+		change.Change = DiffModified
+		return change, nil
+	}
+	metadata := diffMetadata(fromInfo, toInfo)
+	// like the snapshots do, a file with the same size and time has the same content
+	if !slices.Contains(metadata, "mtime") {
+		if len(metadata) == 0 {
+			return nil, nil
+		}
+		change.Change = DiffMetadata
+		change.Metadata = metadata
+		return change, nil
+	}
+	same, err := sameContent(fromPath, toPath)
+	if err != nil {
+		return nil, err
+	}
+	if !same {
+		change.Change = DiffModified
+		return change, nil
+	}
+	change.Change = DiffMetadata
+	change.Metadata = metadata
+	return change, nil
+}
+
+func diffMetadata(fromInfo os.FileInfo, toInfo os.FileInfo) (metadata []string) {
+	if fromInfo.Mode() != toInfo.Mode() {
+		metadata = append(metadata, "mode")
+	}
+	fromStat, fromOk := fromInfo.Sys().(*syscall.Stat_t)
+	toStat, toOk := toInfo.Sys().(*syscall.Stat_t)
+	if fromOk && toOk && (fromStat.Uid != toStat.Uid || fromStat.Gid != toStat.Gid) {
+		metadata = append(metadata, "owner")
+	}
+	if !fromInfo.ModTime().Equal(toInfo.ModTime()) {
+		metadata = append(metadata, "mtime")
+	}
+	return metadata
+}
+
+func sameContent(fromPath string, toPath string) (bool, error) {
+	fromFile, err := os.Open(fromPath)
+	if err != nil {
+		return false, fmt.Errorf("can't open %s: %s", fromPath, err.Error())
+	}
+	defer fromFile.Close()
+	toFile, err := os.Open(toPath)
+	if err != nil {
+		return false, fmt.Errorf("can't open %s: %s", toPath, err.Error())
+	}
+	defer toFile.Close()
+	fromBuffer := make([]byte, 64*1024)
+	toBuffer := make([]byte, 64*1024)
+	for {
+		fromRead, fromErr := io.ReadFull(fromFile, fromBuffer)
+		toRead, toErr := io.ReadFull(toFile, toBuffer)
+		if !bytes.Equal(fromBuffer[:fromRead], toBuffer[:toRead]) {
+			return false, nil
+		}
+		if fromErr == io.EOF || fromErr == io.ErrUnexpectedEOF {
+			return toErr == io.EOF || toErr == io.ErrUnexpectedEOF, nil
+		}
+		if fromErr != nil {
+			return false, fmt.Errorf("can't read %s: %s", fromPath, fromErr.Error())
+		}
+		if toErr != nil {
+			return false, fmt.Errorf("can't read %s: %s", toPath, toErr.Error())
+		}
+	}
+}
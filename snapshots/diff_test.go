@@ -0,0 +1,108 @@
+package snapshots
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	fromPath := t.TempDir()
+	toPath := t.TempDir()
+	srcDir := t.TempDir()
+	writeTestTree(t, path.Join(fromPath, "src"), map[string]string{
+		"linked":    "linked",
+		"grown":     "old",
+		"rewritten": "old",
+		"touched":   "same",
+		"chmodded":  "same",
+		"gone/file": "gone",
+		"replaced":  "file",
+	})
+	writeTestTree(t, path.Join(toPath, "src"), map[string]string{
+		"grown":        "older",
+		"rewritten":    "new",
+		"touched":      "same",
+		"chmodded":     "same",
+		"added":        "added",
+		"replaced/sub": "dir",
+	})
+	err := os.Link(path.Join(fromPath, "src", "linked"), path.Join(toPath, "src", "linked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTime := time.Now().Add(-time.Hour)
+	for _, filePath := range []string{path.Join(fromPath, "src", "rewritten"), path.Join(fromPath, "src", "touched"), path.Join(fromPath, "src", "chmodded"), path.Join(toPath, "src", "chmodded")} {
+		err = os.Chtimes(filePath, oldTime, oldTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Chmod(path.Join(toPath, "src", "chmodded"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+`, srcDir))
+	changes, err := DiffSnapshots(snapshotConfig, &structs.SnapshotInfo{Abspath: fromPath}, &structs.SnapshotInfo{Abspath: toPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, fmt.Sprintf("%s %s %s", change.Change, strings.TrimPrefix(change.Path, srcDir+"/"), strings.Join(change.Metadata, ",")))
+	}
+	want := []string{
+		"added added ",
+		"metadata chmodded mode",
+		"removed gone ",
+		"removed gone/file ",
+		"modified grown ",
+		"removed replaced ",
+		"added replaced ",
+		"added replaced/sub ",
+		"modified rewritten ",
+		"metadata touched mtime",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDiffSnapshotsAgainstSourcesSkipsExcludes(t *testing.T) {
+	snapshotPath := t.TempDir()
+	srcDir := t.TempDir()
+	writeTestTree(t, path.Join(snapshotPath, "src"), map[string]string{"file": "file"})
+	writeTestTree(t, srcDir, map[string]string{"file": "file", "live.cache": "cache", "new": "new"})
+	mtime := time.Now().Add(-time.Hour)
+	for _, filePath := range []string{path.Join(snapshotPath, "src", "file"), path.Join(srcDir, "file")} {
+		err := os.Chtimes(filePath, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+    excludes:
+      - "*.cache"
+`, srcDir))
+	changes, err := DiffSnapshots(snapshotConfig, &structs.SnapshotInfo{Abspath: snapshotPath}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Change != DiffAdded || changes[0].Path != path.Join(srcDir, "new") {
+		t.Errorf("got %+v, want only the new file added", changes)
+	}
+}
@@ -0,0 +1,130 @@
+package snapshots
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"regexp"
+	"syscall"
+)
+
+// binaryCheckSize is how much of a file is looked at for NUL bytes to tell
+// binaries apart, like grep does
+const binaryCheckSize = 8000
+
+// GrepMatch is a line matched in a file. The same line of the same path in
+// several snapshots is a single match.
+type GrepMatch struct {
+	SrcPath   string
+	Line      int
+	Text      string
+	Snapshots []*structs.SnapshotInfo
+}
+
+type grepLine struct {
+	number int
+	text   string
+}
+
+// GrepSnapshots searches regex in the files of snapshotsInfo up to maxSize
+// bytes, skipping binaries. Every inode is read once, since its hard links in
+// the other snapshots have the same content.
+func GrepSnapshots(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo, regex *regexp.Regexp, maxSize int64) (matches []*GrepMatch, err error) {
+	type matchKey struct {
+		srcPath string
+		line    int
+		text    string
+	}
+	matchesByKey := map[matchKey]*GrepMatch{}
+	linesByInode := map[uint64][]grepLine{}
+	for _, snapshotInfo := range snapshotsInfo {
+		entries, err := loadSnapshotIndex(snapshotConfig, snapshotInfo)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir || entry.Size > maxSize {
+				continue
+			}
+			srcPath, ok := snapshotConfig.GetSrcPath(entry.Path)
+			if !ok {
+				continue
+			}
+			lines, visited := linesByInode[entry.Inode]
+			if !visited || entry.Inode == 0 {
+				lines, err = grepFile(path.Join(snapshotInfo.Abspath, entry.Path), regex)
+				if err != nil {
+					return nil, err
+				}
+				linesByInode[entry.Inode] = lines
+			}
+			for _, line := range lines {
+				key := matchKey{srcPath: srcPath, line: line.number, text: line.text}
+				match, ok := matchesByKey[key]
+				if !ok {
+					match = &GrepMatch{SrcPath: srcPath, Line: line.number, Text: line.text}
+					matchesByKey[key] = match
+					matches = append(matches, match)
+				}
+				match.Snapshots = append(match.Snapshots, snapshotInfo)
+			}
+		}
+	}
+	return matches, nil
+}
+
+// grepFile returns the lines of filePath matching regex, or none if the file
+// is binary or not a regular file. A file deleted since the index was written
+// has no lines.
+func grepFile(filePath string, regex *regexp.Regexp) (lines []grepLine, err error) {
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't stat %s: %s", filePath, err.Error())
+	}
+	// symlinks can point out of the snapshot, and fifos would block the read
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	// in case it was replaced since the stat, don't follow or block either
+	file, err := os.OpenFile(filePath, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ELOOP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open %s: %s", filePath, err.Error())
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, 64*1024)
+	head, err := reader.Peek(binaryCheckSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, fmt.Errorf("can't read %s: %s", filePath, err.Error())
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+	number := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			number++
+			line = bytes.TrimRight(line, "\r\n")
+			if regex.Match(line) {
+				lines = append(lines, grepLine{number: number, text: string(line)})
+			}
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %s", filePath, err.Error())
+		}
+	}
+}
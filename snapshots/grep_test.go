@@ -0,0 +1,47 @@
+package snapshots
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"syscall"
+	"testing"
+)
+
+func TestGrepSnapshotsReadsOnlyRegularFiles(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, `interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: /src
+    dst_dir_in_snapshot: src
+`)
+	snapshotPath := path.Join(snapshotConfig.SnapshotsDir, "t.daily.0")
+	writeTestTree(t, snapshotPath, map[string]string{"src/file": "secret\n"})
+	outside := path.Join(t.TempDir(), "outside")
+	err := os.WriteFile(outside, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outside, path.Join(snapshotPath, "src", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// opening a fifo for reading blocks until a writer opens it
+	err = syscall.Mkfifo(path.Join(snapshotPath, "src", "fifo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := GrepSnapshots(snapshotConfig, snapshotsInfo, regexp.MustCompile("secret"), 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].SrcPath != "/src/file" {
+		for _, match := range matches {
+			t.Errorf("unexpected match in %s", match.SrcPath)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package snapshots
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/structs"
+	"testing"
+	"time"
+)
+
+// writeTestTree creates the files under dirPath, with their parent dirs.
+func writeTestTree(t *testing.T, dirPath string, files map[string]string) {
+	t.Helper()
+	for relPath, content := range files {
+		filePath := path.Join(dirPath, relPath)
+		err := os.MkdirAll(path.Dir(filePath), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filePath, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestSnapshotConfig loads snapshot t from configYml like snapsync does,
+// with its snapshots in a temp dir.
+func newTestSnapshotConfig(t *testing.T, configYml string) *structs.SnapshotConfig {
+	t.Helper()
+	configsDir := t.TempDir()
+	configYml = fmt.Sprintf("snapshot_name: t\nsnapshots_dir: %s\n%s", t.TempDir(), configYml)
+	err := os.WriteFile(path.Join(configsDir, "t.yml"), []byte(configYml), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(configsDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshotsConfigs[0]
+}
+
+// writeTestSnapshot creates the snapshot t.daily.0 of snapshotConfig with the
+// files, dated an hour ago, and returns it as listed.
+func writeTestSnapshot(t *testing.T, snapshotConfig *structs.SnapshotConfig, files map[string]string) *structs.SnapshotInfo {
+	t.Helper()
+	snapshotPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 0))
+	writeTestTree(t, snapshotPath, files)
+	created := time.Now().Add(-time.Hour)
+	err := os.Chtimes(snapshotPath, created, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotInfo, err := loadSnapshotInfo(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshotInfo
+}
@@ -0,0 +1,243 @@
+package snapshots
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"peppeosmio/snapsync/structs"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// IndexEntry is a file or dir in the index of a snapshot. Path is relative to
+// the root of the snapshot.
+type IndexEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode"`
+	IsDir   bool      `json:"is_dir,omitempty"`
+}
+
+func getIndexPath(snapshotPath string) string {
+	return path.Join(snapshotPath, structs.SnapshotIndexFileName)
+}
+
+// buildSnapshotIndex walks the snapshot at snapshotPath.
+func buildSnapshotIndex(snapshotPath string) (entries []IndexEntry, err error) {
+	matcher := newExcludeMatcher(getSnapsyncFilesExcludes())
+	err = filepath.WalkDir(snapshotPath, func(walkPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if walkPath == snapshotPath {
+			return nil
+		}
+		relPath, err := filepath.Rel(snapshotPath, walkPath)
+		if err != nil {
+			return err
+		}
+		if matcher.excluded(relPath, entry.IsDir()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		key, _, _ := getDiskBytes(info)
+		indexEntry := IndexEntry{Path: relPath, ModTime: info.ModTime(), Inode: key.ino, IsDir: entry.IsDir()}
+		if !entry.IsDir() {
+			indexEntry.Size = info.Size()
+		}
+		entries = append(entries, indexEntry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't walk %s: %s", snapshotPath, err.Error())
+	}
+	return entries, nil
+}
+
+// writeSnapshotIndex indexes the snapshot at snapshotPath, keeping its
+// modification time like writeSnapshotMetadata.
+func writeSnapshotIndex(snapshotPath string) error {
+	entries, err := buildSnapshotIndex(snapshotPath)
+	if err != nil {
+		return err
+	}
+	snapshotStat, err := os.Stat(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("can't stat %s: %s", snapshotPath, err.Error())
+	}
+	var content bytes.Buffer
+	writer := gzip.NewWriter(&content)
+	err = json.NewEncoder(writer).Encode(entries)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("can't encode the index of %s: %s", snapshotPath, err.Error())
+	}
+	err = writeFileAtomic(getIndexPath(snapshotPath), content.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(snapshotPath, snapshotStat.ModTime(), snapshotStat.ModTime())
+}
+
+func readSnapshotIndex(snapshotPath string) (entries []IndexEntry, err error) {
+	indexPath := getIndexPath(snapshotPath)
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", indexPath, err.Error())
+	}
+	err = json.NewDecoder(reader).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s: %s", indexPath, err.Error())
+	}
+	return entries, nil
+}
+
+// loadSnapshotIndex returns the index of the snapshot, creating it for the
+// snapshots taken before indexes existed. The index is written under the lock
+// of the interval, and only if the snapshot wasn't rotated since it was listed.
+func loadSnapshotIndex(snapshotConfig *structs.SnapshotConfig, snapshotInfo *structs.SnapshotInfo) ([]IndexEntry, error) {
+	entries, err := readSnapshotIndex(snapshotInfo.Abspath)
+	if err == nil {
+		return entries, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	intervalConfig := *snapshotConfig
+	intervalConfig.Interval = snapshotInfo.Interval
+	unlock, err := lockSnapshots(&intervalConfig)
+	if err != nil {
+		// a busy or read only snapshot can still be searched
+		slog.Debug(fmt.Sprintf("Can't write the index of %s: %s", snapshotInfo.Abspath, err.Error()))
+		return buildSnapshotIndex(snapshotInfo.Abspath)
+	}
+	defer unlock()
+	err = checkSnapshotUnchanged(snapshotInfo)
+	if err != nil {
+		return nil, err
+	}
+	err = writeSnapshotIndex(snapshotInfo.Abspath)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Can't write the index of %s: %s", snapshotInfo.Abspath, err.Error()))
+		return buildSnapshotIndex(snapshotInfo.Abspath)
+	}
+	return readSnapshotIndex(snapshotInfo.Abspath)
+}
+
+// FindQuery selects the files of FindFiles. Zero values don't filter.
+type FindQuery struct {
+	// Glob is matched against the base name, or the whole source path if it has a slash
+	Glob string
+	// Regex is matched against the whole source path
+	Regex         *regexp.Regexp
+	ModifiedAfter time.Time
+	// ModifiedBefore excludes the files modified at or after it
+	ModifiedBefore time.Time
+	MinSize        int64
+	// MaxSize is ignored when negative
+	MaxSize int64
+}
+
+func (query *FindQuery) matches(srcPath string, entry IndexEntry) (bool, error) {
+	if !query.ModifiedAfter.IsZero() && !entry.ModTime.After(query.ModifiedAfter) {
+		return false, nil
+	}
+	if !query.ModifiedBefore.IsZero() && !entry.ModTime.Before(query.ModifiedBefore) {
+		return false, nil
+	}
+	if entry.Size < query.MinSize || (query.MaxSize >= 0 && entry.Size > query.MaxSize) {
+		return false, nil
+	}
+	if query.Regex != nil && !query.Regex.MatchString(srcPath) {
+		return false, nil
+	}
+	if len(query.Glob) > 0 {
+		name := path.Base(srcPath)
+		if strings.Contains(query.Glob, "/") {
+			name = srcPath
+		}
+		matched, err := path.Match(query.Glob, name)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// FindMatch is a source path found in some snapshots. The same file, by inode,
+// in several snapshots is a single match.
+type FindMatch struct {
+	SrcPath   string
+	Size      int64
+	ModTime   time.Time
+	IsDir     bool
+	Snapshots []*structs.SnapshotInfo
+}
+
+// FindFiles searches the indexes of snapshotsInfo, indexing the snapshots
+// that have none.
+func FindFiles(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo, query FindQuery) (matches []*FindMatch, err error) {
+	type matchKey struct {
+		srcPath string
+		inode   uint64
+		modTime time.Time
+	}
+	matchesByKey := map[matchKey]*FindMatch{}
+	for _, snapshotInfo := range snapshotsInfo {
+		entries, err := loadSnapshotIndex(snapshotConfig, snapshotInfo)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			srcPath, ok := snapshotConfig.GetSrcPath(entry.Path)
+			if !ok {
+				continue
+			}
+			matched, err := query.matches(srcPath, entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %s", query.Glob, err.Error())
+			}
+			if !matched {
+				continue
+			}
+			// dirs are never hard linked, the time tells their versions apart
+			key := matchKey{srcPath: srcPath, inode: entry.Inode}
+			if entry.IsDir {
+				key = matchKey{srcPath: srcPath, modTime: entry.ModTime}
+			}
+			match, ok := matchesByKey[key]
+			if !ok {
+				match = &FindMatch{SrcPath: srcPath, Size: entry.Size, ModTime: entry.ModTime, IsDir: entry.IsDir}
+				matchesByKey[key] = match
+				matches = append(matches, match)
+			}
+			match.Snapshots = append(match.Snapshots, snapshotInfo)
+		}
+	}
+	slices.SortStableFunc(matches, func(a *FindMatch, b *FindMatch) int {
+		if a.SrcPath != b.SrcPath {
+			return strings.Compare(a.SrcPath, b.SrcPath)
+		}
+		return b.ModTime.Compare(a.ModTime)
+	})
+	return matches, nil
+}
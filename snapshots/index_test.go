@@ -0,0 +1,68 @@
+package snapshots
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLoadSnapshotIndexWritesMissingIndex(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 3\n")
+	snapshotPath := path.Join(snapshotConfig.SnapshotsDir, "t.daily.0")
+	writeTestTree(t, snapshotPath, map[string]string{"file": "1234"})
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err := os.Chtimes(snapshotPath, created, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := loadSnapshotIndex(snapshotConfig, snapshotsInfo[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != "file" {
+		t.Errorf("got entries %+v, want file", entries)
+	}
+	if !pathExists(getIndexPath(snapshotPath)) {
+		t.Errorf("the index was not written")
+	}
+	info, err := os.Stat(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(created) {
+		t.Errorf("writing the index changed the creation time to %s", info.ModTime())
+	}
+}
+
+func TestLoadSnapshotIndexSkipsRotatedSnapshots(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 3\n")
+	snapshotPath := path.Join(snapshotConfig.SnapshotsDir, "t.daily.0")
+	writeTestTree(t, snapshotPath, map[string]string{"old": "1234"})
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err := os.Chtimes(snapshotPath, created, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a rotation puts another snapshot at the listed path
+	err = os.Rename(snapshotPath, path.Join(snapshotConfig.SnapshotsDir, "t.daily.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestTree(t, snapshotPath, map[string]string{"new": "1234"})
+	_, err = loadSnapshotIndex(snapshotConfig, snapshotsInfo[0])
+	if err == nil {
+		t.Errorf("the rotated snapshot was indexed")
+	}
+	if pathExists(getIndexPath(snapshotPath)) {
+		t.Errorf("the index of the rotated snapshot was written into the new one")
+	}
+}
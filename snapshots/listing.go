@@ -0,0 +1,125 @@
+package snapshots
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"slices"
+	"strings"
+	"time"
+)
+
+func GetSnapshotDirTimestampName(snapshotName string, interval string, timestamp time.Time) string {
+	return GetSnapshotDirPrefix(snapshotName, interval) + timestamp.UTC().Format(structs.SnapshotTimestampLayout)
+}
+
+// loadSnapshotInfo parses a snapshot dir name and loads its metadata.
+// Numbered snapshots have no timestamp in their name, so the start time in the
+// metadata is used instead, or the dir modification time for the snapshots
+// taken by older versions.
+func loadSnapshotInfo(snapshotPath string) (*structs.SnapshotInfo, error) {
+	snapshotInfo, err := utils.GetInfoFromSnapshotPath(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	err = loadSnapshotMetadataInfo(snapshotInfo)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotInfo, nil
+}
+
+// loadSnapshotMetadataInfo fills the metadata and the timestamp of the
+// snapshot whose dir name was parsed into snapshotInfo. A snapshot whose
+// metadata can't be read is still returned, with status unknown.
+func loadSnapshotMetadataInfo(snapshotInfo *structs.SnapshotInfo) error {
+	snapshotPath := snapshotInfo.Abspath
+	metadata, err := readSnapshotMetadata(snapshotPath)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("Can't load the metadata of %s: %s", snapshotPath, err.Error()))
+		metadata = structs.SnapshotMetadata{Status: structs.SnapshotStatusUnknown}
+	}
+	snapshotInfo.Metadata = metadata
+	if !snapshotInfo.Timestamped && !snapshotInfo.Metadata.StartedAt.IsZero() {
+		snapshotInfo.Timestamp = snapshotInfo.Metadata.StartedAt
+	} else if !snapshotInfo.Timestamped {
+		stat, err := os.Stat(snapshotPath)
+		if err != nil {
+			return fmt.Errorf("can't stat %s: %s", snapshotPath, err.Error())
+		}
+		snapshotInfo.Timestamp = stat.ModTime()
+	}
+	return nil
+}
+
+// sortSnapshotsInfo sorts the snapshots newest first and gives timestamped
+// snapshots their position number, counted separately for every interval.
+func sortSnapshotsInfo(snapshotsInfo []*structs.SnapshotInfo) {
+	slices.SortStableFunc(snapshotsInfo, func(a *structs.SnapshotInfo, b *structs.SnapshotInfo) int {
+		if a.Interval != b.Interval {
+			return strings.Compare(a.Interval, b.Interval)
+		}
+		if !a.Timestamped && !b.Timestamped {
+			return a.Number - b.Number
+		}
+		return b.Timestamp.Compare(a.Timestamp)
+	})
+	positions := map[string]int{}
+	for _, snapshotInfo := range snapshotsInfo {
+		if snapshotInfo.Timestamped {
+			snapshotInfo.Number = positions[snapshotInfo.Interval]
+		}
+		positions[snapshotInfo.Interval]++
+	}
+}
+
+// listSnapshots returns the snapshots of snapshotName in snapshotsDir, newest
+// first. If interval is empty the snapshots of every interval are returned.
+func listSnapshots(snapshotsDir string, snapshotName string, interval string) (snapshotsInfo []*structs.SnapshotInfo, err error) {
+	entries, err := os.ReadDir(snapshotsDir)
+	if os.IsNotExist(err) {
+		return snapshotsInfo, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read directory %s: %s", snapshotsDir, err.Error())
+	}
+	for _, entry := range entries {
+		// the journal, the lock file and the temp dirs start with a dot
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		snapshotFullPath := path.Join(snapshotsDir, entry.Name())
+		snapshotInfo, err := utils.GetInfoFromSnapshotPath(snapshotFullPath)
+		if err != nil {
+			slog.Debug(fmt.Sprintf("Skipping %s: %s", snapshotFullPath, err.Error()))
+			continue
+		}
+		if snapshotInfo.SnapshotName != snapshotName {
+			continue
+		}
+		if len(interval) > 0 && snapshotInfo.Interval != interval {
+			continue
+		}
+		err = loadSnapshotMetadataInfo(snapshotInfo)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("Skipping %s: %s", snapshotFullPath, err.Error()))
+			continue
+		}
+		snapshotsInfo = append(snapshotsInfo, snapshotInfo)
+	}
+	sortSnapshotsInfo(snapshotsInfo)
+	return snapshotsInfo, nil
+}
+
+func listConfigSnapshots(snapshotConfig *structs.SnapshotConfig) ([]*structs.SnapshotInfo, error) {
+	return listSnapshots(snapshotConfig.SnapshotsDir, snapshotConfig.SnapshotName, snapshotConfig.Interval)
+}
+
+// GetSnapshotInfo loads the snapshot at snapshotPath. The position number of
+// timestamped snapshots is only computed when listing, so it is 0.
+func GetSnapshotInfo(snapshotPath string) (*structs.SnapshotInfo, error) {
+	return loadSnapshotInfo(snapshotPath)
+}
@@ -0,0 +1,76 @@
+package snapshots
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+)
+
+// getSnapsyncFilesExcludes returns the excludes that keep the files written by
+// snapsync at the root of a snapshot out of the dir snapshotted at the root.
+func getSnapsyncFilesExcludes() []string {
+	return []string{"/" + structs.SnapshotMetadataFileName, "/" + structs.SnapshotIndexFileName}
+}
+
+// getConfigHash identifies the SnapshotConfig that took a snapshot, so that
+// the snapshots taken before a config change can be told apart.
+func getConfigHash(snapshotConfig *structs.SnapshotConfig) (string, error) {
+	content, err := json.Marshal(snapshotConfig)
+	if err != nil {
+		return "", fmt.Errorf("can't encode config of %s: %s", snapshotConfig.SnapshotName, err.Error())
+	}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func getMetadataPath(snapshotPath string) string {
+	return path.Join(snapshotPath, structs.SnapshotMetadataFileName)
+}
+
+// readSnapshotMetadata returns empty metadata for snapshots that have none,
+// like the ones created by older versions.
+func readSnapshotMetadata(snapshotPath string) (metadata structs.SnapshotMetadata, err error) {
+	metadataPath := getMetadataPath(snapshotPath)
+	content, err := os.ReadFile(metadataPath)
+	if os.IsNotExist(err) {
+		return metadata, nil
+	}
+	if err != nil {
+		return metadata, fmt.Errorf("can't read %s: %s", metadataPath, err.Error())
+	}
+	err = json.Unmarshal(content, &metadata)
+	if err != nil {
+		return metadata, fmt.Errorf("can't parse %s: %s", metadataPath, err.Error())
+	}
+	return metadata, nil
+}
+
+func writeSnapshotMetadata(snapshotPath string, metadata *structs.SnapshotMetadata) error {
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't encode metadata: %s", err.Error())
+	}
+	snapshotStat, err := os.Stat(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("can't stat %s: %s", snapshotPath, err.Error())
+	}
+	err = writeFileAtomic(getMetadataPath(snapshotPath), content)
+	if err != nil {
+		return err
+	}
+	// the dir modification time is the creation time of numbered snapshots without metadata
+	return os.Chtimes(snapshotPath, snapshotStat.ModTime(), snapshotStat.ModTime())
+}
+
+func updateSnapshotMetadata(snapshotPath string, update func(metadata *structs.SnapshotMetadata)) error {
+	metadata, err := readSnapshotMetadata(snapshotPath)
+	if err != nil {
+		return err
+	}
+	update(&metadata)
+	return writeSnapshotMetadata(snapshotPath, &metadata)
+}
@@ -0,0 +1,138 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExecuteSnapshotRecordsMetadata(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "1234", "dir/other": "12"})
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+naming: timestamp
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+pre_snapshot_commands:
+  - echo pre
+post_snapshot_commands:
+  - echo post >&2
+`, srcDir))
+	config := &structs.Config{Engine: structs.EngineNative}
+	_, err := ExecuteSnapshot(context.Background(), config, snapshotConfig, SnapshotOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := readSnapshotMetadata(snapshotsInfo[0].Abspath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := os.Hostname()
+	configHash, _ := getConfigHash(snapshotConfig)
+	if metadata.Host != host || metadata.Version != utils.GetVersion() || metadata.ConfigHash != configHash {
+		t.Errorf("got host %q, version %q, config hash %q", metadata.Host, metadata.Version, metadata.ConfigHash)
+	}
+	if metadata.Status != structs.SnapshotStatusSuccess || metadata.FinishedAt.Before(metadata.StartedAt) {
+		t.Errorf("got status %q from %s to %s", metadata.Status, metadata.StartedAt, metadata.FinishedAt)
+	}
+	if len(metadata.Dirs) != 1 || metadata.Dirs[0].SrcDirAbspath != srcDir {
+		t.Fatalf("got dirs %+v", metadata.Dirs)
+	}
+	wantStats := structs.SyncStats{Files: 2, TotalSize: 6, TransferredFiles: 2, TransferredSize: 6}
+	if metadata.Dirs[0].SyncStats != wantStats {
+		t.Errorf("got stats %+v, want %+v", metadata.Dirs[0].SyncStats, wantStats)
+	}
+	if len(metadata.Hooks) != 2 || metadata.Hooks[0].Phase != structs.HookPhasePre || metadata.Hooks[0].Stdout != "pre" ||
+		metadata.Hooks[1].Phase != structs.HookPhasePost || metadata.Hooks[1].Stderr != "post" {
+		t.Errorf("got hooks %+v", metadata.Hooks)
+	}
+}
+
+func TestExecuteSnapshotRecordsFailedPostSnapshotCommand(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "1234"})
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+post_snapshot_commands:
+  - exit 7
+`, srcDir))
+	_, err := ExecuteSnapshot(context.Background(), &structs.Config{Engine: structs.EngineNative}, snapshotConfig, SnapshotOptions{})
+	if err == nil {
+		t.Fatal("got no error from the failed post snapshot command")
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := readSnapshotMetadata(snapshotsInfo[0].Abspath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Status != structs.SnapshotStatusPostCommandsFailed || len(metadata.Hooks) != 1 || metadata.Hooks[0].ExitCode != 7 {
+		t.Errorf("got status %q and hooks %+v", metadata.Status, metadata.Hooks)
+	}
+}
+
+func TestParseRsyncStats(t *testing.T) {
+	output := `
+Number of files: 1,234 (reg: 1,000, dir: 234)
+Number of created files: 3
+Number of regular files transferred: 12
+Total file size: 1.50M bytes
+Total transferred file size: 2,048 bytes
+`
+	want := structs.SyncStats{Files: 1000, TotalSize: 1572864, TransferredFiles: 12, TransferredSize: 2048}
+	if stats := parseRsyncStats(output); stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
+
+func TestSnapshotMetadataRoundTrip(t *testing.T) {
+	snapshotPath := t.TempDir()
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err := os.Chtimes(snapshotPath, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startedAt := time.Now().UTC().Truncate(time.Second)
+	want := &structs.SnapshotMetadata{
+		StartedAt:  startedAt,
+		FinishedAt: startedAt.Add(time.Minute),
+		Status:     structs.SnapshotStatusSuccess,
+		Host:       "host",
+		Dirs:       []structs.DirRun{{SrcDirAbspath: "/src", DstDirInSnapshot: "src", SyncStats: structs.SyncStats{Files: 1}}},
+		Hooks:      []structs.HookRun{{Phase: structs.HookPhasePre, Command: "true"}},
+	}
+	err = writeSnapshotMetadata(snapshotPath, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readSnapshotMetadata(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, *want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	info, err := os.Stat(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("the snapshot dir mtime changed to %s", info.ModTime())
+	}
+}
@@ -0,0 +1,96 @@
+package snapshots
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/structs"
+	"time"
+)
+
+// MigrateToTimestampNaming renames the numbered snapshots of snapshotConfig
+// to timestamp names, using their modification time as creation time. The
+// renames go through the journal so an interrupted migration is completed on
+// the next start.
+func MigrateToTimestampNaming(snapshotConfig *structs.SnapshotConfig) (migrated int, err error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	if snapshotConfig.Naming != structs.NamingTimestamp {
+		return 0, fmt.Errorf("%s set naming: %s in the snapshot config before migrating, otherwise the next run creates numbered snapshots again", snapshotLogPrefix, structs.NamingTimestamp)
+	}
+	for _, interval := range snapshotConfig.Intervals {
+		intervalConfig, err := configs.GetIntervalConfig(snapshotConfig, interval.Name)
+		if err != nil {
+			return migrated, err
+		}
+		intervalMigrated, err := migrateIntervalToTimestampNaming(intervalConfig)
+		migrated += intervalMigrated
+		if err != nil {
+			return migrated, err
+		}
+	}
+	// the pre restore snapshots live in their own interval
+	intervalMigrated, err := migrateIntervalToTimestampNaming(getPreRestoreConfig(snapshotConfig, nil))
+	migrated += intervalMigrated
+	return migrated, err
+}
+
+func migrateIntervalToTimestampNaming(snapshotConfig *structs.SnapshotConfig) (migrated int, err error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	unlock, err := lockSnapshots(snapshotConfig)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	defer unlock()
+	err = recoverSnapshots(snapshotConfig)
+	if err != nil {
+		return 0, err
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	journal := &rotationJournal{
+		SnapshotName: snapshotConfig.SnapshotName,
+		Interval:     snapshotConfig.Interval,
+	}
+	usedNames := map[string]bool{}
+	for _, snapshotInfo := range snapshotsInfo {
+		if snapshotInfo.Timestamped {
+			usedNames[path.Base(snapshotInfo.Abspath)] = true
+		}
+	}
+	// snapshotsInfo is sorted newest first, so an older snapshot never gets a
+	// timestamp newer than the ones before it even when mtimes are equal
+	var previousTimestamp time.Time
+	for _, snapshotInfo := range snapshotsInfo {
+		if snapshotInfo.Timestamped {
+			previousTimestamp = snapshotInfo.Timestamp
+			continue
+		}
+		timestamp := snapshotInfo.Timestamp.UTC().Truncate(time.Second)
+		if !previousTimestamp.IsZero() && !timestamp.Before(previousTimestamp) {
+			timestamp = previousTimestamp.Add(-time.Second)
+		}
+		newName := GetSnapshotDirTimestampName(snapshotConfig.SnapshotName, snapshotConfig.Interval, timestamp)
+		for usedNames[newName] {
+			timestamp = timestamp.Add(-time.Second)
+			newName = GetSnapshotDirTimestampName(snapshotConfig.SnapshotName, snapshotConfig.Interval, timestamp)
+		}
+		usedNames[newName] = true
+		previousTimestamp = timestamp
+		journal.Renames = append(journal.Renames, rotationRename{
+			From: snapshotInfo.Abspath,
+			To:   path.Join(snapshotConfig.SnapshotsDir, newName),
+		})
+		slog.Info(fmt.Sprintf("%s %s -> %s", snapshotLogPrefix, path.Base(snapshotInfo.Abspath), newName))
+	}
+	if len(journal.Renames) == 0 {
+		return 0, nil
+	}
+	err = commitJournal(snapshotConfig, journal)
+	if err != nil {
+		return 0, fmt.Errorf("%s can't migrate snapshots: %s", snapshotLogPrefix, err.Error())
+	}
+	return len(journal.Renames), nil
+}
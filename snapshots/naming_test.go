@@ -0,0 +1,123 @@
+package snapshots
+
+import (
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"testing"
+	"time"
+)
+
+func writeNumberedSnapshots(t *testing.T, snapshotsDir string, mtimes ...time.Time) {
+	t.Helper()
+	for number, mtime := range mtimes {
+		snapshotPath := path.Join(snapshotsDir, GetSnapshotDirName("t", "daily", number))
+		writeTestTree(t, snapshotPath, map[string]string{"file": "content"})
+		err := os.Chtimes(snapshotPath, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateToTimestampNaming(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 5\nnaming: timestamp\n")
+	now := time.Now().UTC().Truncate(time.Second)
+	mtimes := []time.Time{now, now.Add(-time.Hour), now.Add(-2 * time.Hour)}
+	writeNumberedSnapshots(t, snapshotConfig.SnapshotsDir, mtimes...)
+	migrated, err := MigrateToTimestampNaming(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 3 {
+		t.Errorf("got %d migrated snapshots, want 3", migrated)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshotsInfo) != 3 {
+		t.Fatalf("got %d snapshots, want 3", len(snapshotsInfo))
+	}
+	for i, snapshotInfo := range snapshotsInfo {
+		wantName := GetSnapshotDirTimestampName("t", "daily", mtimes[i])
+		if path.Base(snapshotInfo.Abspath) != wantName || !snapshotInfo.Timestamped || snapshotInfo.Number != i {
+			t.Errorf("snapshot %d: got %s number %d, want %s", i, path.Base(snapshotInfo.Abspath), snapshotInfo.Number, wantName)
+		}
+	}
+	migrated, err = MigrateToTimestampNaming(snapshotConfig)
+	if err != nil || migrated != 0 {
+		t.Errorf("migrating again: got %d, %v, want nothing to do", migrated, err)
+	}
+}
+
+func TestMigrateToTimestampNamingKeepsOrderOfEqualMtimes(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 5\nnaming: timestamp\n")
+	now := time.Now().UTC().Truncate(time.Second)
+	writeNumberedSnapshots(t, snapshotConfig.SnapshotsDir, now, now, now)
+	_, err := MigrateToTimestampNaming(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshotsInfo) != 3 {
+		t.Fatalf("got %d snapshots, want 3", len(snapshotsInfo))
+	}
+	for i := 1; i < len(snapshotsInfo); i++ {
+		if !snapshotsInfo[i].Timestamp.Before(snapshotsInfo[i-1].Timestamp) {
+			t.Errorf("snapshot %d is not older than snapshot %d", i, i-1)
+		}
+	}
+}
+
+func TestMigrateToTimestampNamingNeedsTimestampNaming(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 5\n")
+	writeNumberedSnapshots(t, snapshotConfig.SnapshotsDir, time.Now())
+	_, err := MigrateToTimestampNaming(snapshotConfig)
+	if err == nil {
+		t.Error("got no error migrating a config with number naming")
+	}
+	if !pathExists(path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 0))) {
+		t.Error("the numbered snapshot was renamed")
+	}
+}
+
+func TestMigrateToTimestampNamingMigratesPreRestoreSnapshots(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 5\nnaming: timestamp\n")
+	snapshotPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", structs.PreRestoreInterval, 0))
+	writeTestTree(t, snapshotPath, map[string]string{"file": "content"})
+	migrated, err := MigrateToTimestampNaming(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listSnapshots(snapshotConfig.SnapshotsDir, "t", structs.PreRestoreInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 || len(snapshotsInfo) != 1 || !snapshotsInfo[0].Timestamped {
+		t.Errorf("got %d migrated and snapshots %+v, want the pre restore snapshot timestamped", migrated, snapshotsInfo)
+	}
+}
+
+func TestListSnapshotsKeepsUnreadableMetadata(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 5\n")
+	writeNumberedSnapshots(t, snapshotConfig.SnapshotsDir, time.Now(), time.Now().Add(-time.Hour))
+	snapshotPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 1))
+	err := os.WriteFile(getMetadataPath(snapshotPath), []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshotsInfo) != 2 {
+		t.Fatalf("got %d snapshots, want 2", len(snapshotsInfo))
+	}
+	if snapshotsInfo[1].Metadata.Status != structs.SnapshotStatusUnknown {
+		t.Errorf("got status %q for the snapshot with broken metadata, want unknown", snapshotsInfo[1].Metadata.Status)
+	}
+}
@@ -0,0 +1,382 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"peppeosmio/snapsync/structs"
+	"strings"
+	"syscall"
+)
+
+// excludeMatcher implements the subset of rsync exclude patterns that snapsync
+// configs use: "name" matches a basename at any depth, "/name" is anchored to
+// the root of the synced dir, "a/b" matches the tail of the relative path and
+// a trailing "/" restricts the pattern to directories.
+type excludeMatcher struct {
+	patterns []excludePattern
+}
+
+type excludePattern struct {
+	pattern  string
+	anchored bool
+	hasSlash bool
+	dirOnly  bool
+}
+
+func newExcludeMatcher(excludes []string) *excludeMatcher {
+	matcher := &excludeMatcher{}
+	for _, exclude := range excludes {
+		exclude = strings.TrimSpace(exclude)
+		if len(exclude) == 0 {
+			continue
+		}
+		pattern := excludePattern{}
+		if strings.HasSuffix(exclude, "/") {
+			pattern.dirOnly = true
+			exclude = strings.TrimSuffix(exclude, "/")
+		}
+		if strings.HasPrefix(exclude, "/") {
+			pattern.anchored = true
+			exclude = strings.TrimPrefix(exclude, "/")
+		}
+		pattern.hasSlash = strings.Contains(exclude, "/")
+		pattern.pattern = exclude
+		matcher.patterns = append(matcher.patterns, pattern)
+	}
+	return matcher
+}
+
+func (matcher *excludeMatcher) excluded(relPath string, isDir bool) bool {
+	for _, pattern := range matcher.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.anchored {
+			if ok, _ := filepath.Match(pattern.pattern, relPath); ok {
+				return true
+			}
+			continue
+		}
+		if !pattern.hasSlash {
+			if ok, _ := filepath.Match(pattern.pattern, path.Base(relPath)); ok {
+				return true
+			}
+			continue
+		}
+		// a pattern with a slash matches the end of the path, starting at a path component
+		candidate := relPath
+		for {
+			if ok, _ := filepath.Match(pattern.pattern, candidate); ok {
+				return true
+			}
+			index := strings.Index(candidate, "/")
+			if index < 0 {
+				break
+			}
+			candidate = candidate[index+1:]
+		}
+	}
+	return false
+}
+
+// syncDirNative makes dstDir a mirror of srcDir, like rsync -aLK --delete.
+// Unchanged files already in dstDir are left alone, files that are unchanged
+// compared to linkDestDir (usually the same dir in the newest snapshot) are
+// hard linked from there, everything else is copied. Entries in dstDir that
+// are not in srcDir are deleted unless they are excluded. What was synced is
+// added to stats. The sync stops between files when ctx is canceled.
+func syncDirNative(ctx context.Context, srcDir string, dstDir string, linkDestDir string, excludes []string, stats *structs.SyncStats) error {
+	srcInfo, err := os.Stat(srcDir)
+	if err != nil {
+		return fmt.Errorf("can't stat %s: %s", srcDir, err.Error())
+	}
+	if !srcInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", srcDir)
+	}
+	err = ensureDirNative(dstDir)
+	if err != nil {
+		return err
+	}
+	ancestors := map[inodeKey]bool{}
+	if key, ok := getDirKey(srcInfo); ok {
+		ancestors[key] = true
+	}
+	err = syncTreeNative(ctx, newExcludeMatcher(excludes), srcDir, dstDir, linkDestDir, "", ancestors, stats)
+	if err != nil {
+		return err
+	}
+	return copyMetadataNative(dstDir, srcInfo)
+}
+
+// getDirKey identifies a directory reached through symlinks
+func getDirKey(info os.FileInfo) (inodeKey, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inodeKey{}, false
+	}
+	return inodeKey{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// syncTreeNative syncs relDir of srcDir into dstDir. ancestors holds the
+// directories being synced above relDir, so that a symlink back to one of them
+// is skipped instead of being followed until the path gets too long.
+func syncTreeNative(ctx context.Context, matcher *excludeMatcher, srcDir string, dstDir string, linkDestDir string, relDir string, ancestors map[inodeKey]bool, stats *structs.SyncStats) error {
+	srcPath := path.Join(srcDir, relDir)
+	dstPath := path.Join(dstDir, relDir)
+	entries, err := os.ReadDir(srcPath)
+	if err != nil {
+		return fmt.Errorf("can't read directory %s: %s", srcPath, err.Error())
+	}
+	synced := map[string]bool{}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return fmt.Errorf("sync of %s was canceled: %s", srcDir, ctx.Err().Error())
+		}
+		entryRel := path.Join(relDir, entry.Name())
+		entrySrc := path.Join(srcDir, entryRel)
+		entryDst := path.Join(dstDir, entryRel)
+		// follow symlinks like rsync -L
+		entryInfo, err := os.Stat(entrySrc)
+		if os.IsNotExist(err) {
+			slog.Warn("Skipping dangling symlink " + entrySrc)
+			stats.SkippedFiles++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("can't stat %s: %s", entrySrc, err.Error())
+		}
+		if matcher.excluded(entryRel, entryInfo.IsDir()) {
+			continue
+		}
+		if entryInfo.IsDir() {
+			key, hasKey := getDirKey(entryInfo)
+			if hasKey && ancestors[key] {
+				slog.Warn("Skipping symlink loop " + entrySrc)
+				stats.SkippedFiles++
+				continue
+			}
+			synced[entry.Name()] = true
+			err = ensureDirNative(entryDst)
+			if err != nil {
+				return err
+			}
+			if hasKey {
+				ancestors[key] = true
+			}
+			err = syncTreeNative(ctx, matcher, srcDir, dstDir, linkDestDir, entryRel, ancestors, stats)
+			delete(ancestors, key)
+			if err != nil {
+				return err
+			}
+			// directory times must be set after the content has been written
+			err = copyMetadataNative(entryDst, entryInfo)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !entryInfo.Mode().IsRegular() {
+			slog.Debug("Skipping special file " + entrySrc)
+			continue
+		}
+		synced[entry.Name()] = true
+		linkDestPath := ""
+		if len(linkDestDir) > 0 {
+			linkDestPath = path.Join(linkDestDir, entryRel)
+		}
+		transferred, err := syncFileNative(entrySrc, entryDst, linkDestPath, entryInfo)
+		if err != nil {
+			return err
+		}
+		stats.Files++
+		stats.TotalSize += entryInfo.Size()
+		if transferred {
+			stats.TransferredFiles++
+			stats.TransferredSize += entryInfo.Size()
+		}
+	}
+
+	dstEntries, err := os.ReadDir(dstPath)
+	if err != nil {
+		return fmt.Errorf("can't read directory %s: %s", dstPath, err.Error())
+	}
+	for _, dstEntry := range dstEntries {
+		if synced[dstEntry.Name()] {
+			continue
+		}
+		entryRel := path.Join(relDir, dstEntry.Name())
+		// like rsync without --delete-excluded, excluded files are protected from deletion
+		if matcher.excluded(entryRel, dstEntry.IsDir()) {
+			continue
+		}
+		entryDst := path.Join(dstDir, entryRel)
+		err = os.RemoveAll(entryDst)
+		if err != nil {
+			return fmt.Errorf("can't delete %s: %s", entryDst, err.Error())
+		}
+	}
+	return nil
+}
+
+func syncFileNative(srcPath string, dstPath string, linkDestPath string, srcInfo os.FileInfo) (transferred bool, err error) {
+	dstInfo, err := os.Lstat(dstPath)
+	if err == nil {
+		if sameFileNative(srcInfo, dstInfo) {
+			return false, nil
+		}
+		if dstInfo.IsDir() {
+			err = os.RemoveAll(dstPath)
+			if err != nil {
+				return false, fmt.Errorf("can't delete %s: %s", dstPath, err.Error())
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return false, fmt.Errorf("can't stat %s: %s", dstPath, err.Error())
+	}
+	if len(linkDestPath) > 0 {
+		linkDestInfo, err := os.Lstat(linkDestPath)
+		if err == nil && sameFileNative(srcInfo, linkDestInfo) {
+			err = os.Remove(dstPath)
+			if err != nil && !os.IsNotExist(err) {
+				return false, fmt.Errorf("can't delete %s: %s", dstPath, err.Error())
+			}
+			err = os.Link(linkDestPath, dstPath)
+			if err == nil {
+				return false, nil
+			}
+			// hard links can fail across filesystems or when the link count is exhausted
+			slog.Debug(fmt.Sprintf("Can't hard link %s to %s, copying instead: %s", linkDestPath, dstPath, err.Error()))
+		}
+	}
+	return true, copyFileNative(srcPath, dstPath, srcInfo)
+}
+
+// sameFileNative uses the same quick check as rsync: size and modification time,
+// plus permissions and, when they are preserved, owner and group, so that a
+// chmod or chown produces a new copy instead of a shared inode.
+func sameFileNative(srcInfo os.FileInfo, dstInfo os.FileInfo) bool {
+	if !dstInfo.Mode().IsRegular() {
+		return false
+	}
+	if srcInfo.Size() != dstInfo.Size() ||
+		!srcInfo.ModTime().Equal(dstInfo.ModTime()) ||
+		srcInfo.Mode().Perm() != dstInfo.Mode().Perm() {
+		return false
+	}
+	srcStat, srcOk := srcInfo.Sys().(*syscall.Stat_t)
+	dstStat, dstOk := dstInfo.Sys().(*syscall.Stat_t)
+	if srcOk && dstOk && os.Geteuid() == 0 {
+		return srcStat.Uid == dstStat.Uid && srcStat.Gid == dstStat.Gid
+	}
+	return true
+}
+
+// copyFileNative writes into a temporary file and renames it over dstPath, so
+// that a file hard linked with older snapshots is replaced instead of modified.
+func copyFileNative(srcPath string, dstPath string, srcInfo os.FileInfo) (err error) {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("can't open %s: %s", srcPath, err.Error())
+	}
+	defer srcFile.Close()
+	tmpFile, err := os.CreateTemp(path.Dir(dstPath), ".snapsync-")
+	if err != nil {
+		return fmt.Errorf("can't create temporary file for %s: %s", dstPath, err.Error())
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+	_, err = io.Copy(tmpFile, srcFile)
+	if err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("can't copy %s to %s: %s", srcPath, dstPath, err.Error())
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("can't write %s: %s", dstPath, err.Error())
+	}
+	err = copyMetadataNative(tmpPath, srcInfo)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, dstPath)
+	if err != nil {
+		return fmt.Errorf("can't rename %s to %s: %s", tmpPath, dstPath, err.Error())
+	}
+	return nil
+}
+
+func ensureDirNative(dirPath string) error {
+	// follow symlinks on the receiving side like rsync -K
+	info, err := os.Stat(dirPath)
+	if err == nil && info.IsDir() {
+		return nil
+	}
+	if err == nil {
+		err = os.Remove(dirPath)
+		if err != nil {
+			return fmt.Errorf("can't delete %s: %s", dirPath, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("can't stat %s: %s", dirPath, err.Error())
+	}
+	err = os.MkdirAll(dirPath, 0700)
+	if err != nil {
+		return fmt.Errorf("can't create directory %s: %s", dirPath, err.Error())
+	}
+	return nil
+}
+
+func copyMetadataNative(dstPath string, srcInfo os.FileInfo) error {
+	// ownership can only be preserved when running as root, like rsync -a.
+	// It must be set before the mode because chown clears the setuid bits.
+	if stat, ok := srcInfo.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		err := os.Lchown(dstPath, int(stat.Uid), int(stat.Gid))
+		if err != nil {
+			return fmt.Errorf("can't set owner of %s: %s", dstPath, err.Error())
+		}
+	}
+	err := os.Chmod(dstPath, srcInfo.Mode().Perm()|(srcInfo.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)))
+	if err != nil {
+		return fmt.Errorf("can't set permissions of %s: %s", dstPath, err.Error())
+	}
+	err = os.Chtimes(dstPath, srcInfo.ModTime(), srcInfo.ModTime())
+	if err != nil {
+		return fmt.Errorf("can't set times of %s: %s", dstPath, err.Error())
+	}
+	return nil
+}
+
+// linkTreeNative recreates srcDir in dstDir hard linking every file, like cp -lr.
+func linkTreeNative(srcDir string, dstDir string) error {
+	return filepath.WalkDir(srcDir, func(srcPath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDir, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := path.Join(dstDir, relPath)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			err = os.MkdirAll(dstPath, 0700)
+			if err != nil {
+				return err
+			}
+			return os.Chmod(dstPath, info.Mode().Perm())
+		}
+		return os.Link(srcPath, dstPath)
+	})
+}
@@ -0,0 +1,114 @@
+package snapshots
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"peppeosmio/snapsync/structs"
+	"syscall"
+	"testing"
+)
+
+func TestExcludeMatcher(t *testing.T) {
+	tests := []struct {
+		excludes []string
+		relPath  string
+		isDir    bool
+		excluded bool
+	}{
+		{[]string{"*.tmp"}, "a.tmp", false, true},
+		{[]string{"*.tmp"}, "dir/a.tmp", false, true},
+		{[]string{"*.tmp"}, "a.txt", false, false},
+		{[]string{"/cache"}, "cache", true, true},
+		{[]string{"/cache"}, "dir/cache", true, false},
+		{[]string{"node_modules/"}, "app/node_modules", true, true},
+		{[]string{"node_modules/"}, "app/node_modules", false, false},
+		{[]string{"build/out"}, "app/build/out", true, true},
+		{[]string{"build/out"}, "app/mybuild/out", true, false},
+		{[]string{" ", ""}, "anything", false, false},
+	}
+	for _, test := range tests {
+		matcher := newExcludeMatcher(test.excludes)
+		excluded := matcher.excluded(test.relPath, test.isDir)
+		if excluded != test.excluded {
+			t.Errorf("excludes %q, path %s (dir %t): got %t, want %t", test.excludes, test.relPath, test.isDir, excluded, test.excluded)
+		}
+	}
+}
+
+func TestSyncDirNativeSkipsSymlinkLoops(t *testing.T) {
+	srcDir := filepath.Join(t.TempDir(), "src")
+	dstDir := filepath.Join(t.TempDir(), "dst")
+	writeTestTree(t, srcDir, map[string]string{"dir/file": "content"})
+	err := os.Symlink("..", filepath.Join(srcDir, "dir", "loop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := structs.SyncStats{}
+	err = syncDirNative(context.Background(), srcDir, dstDir, "", nil, &stats)
+	if err != nil {
+		t.Fatalf("sync failed: %s", err.Error())
+	}
+	content, err := os.ReadFile(filepath.Join(dstDir, "dir", "file"))
+	if err != nil || string(content) != "content" {
+		t.Fatalf("file not synced: %q, %v", content, err)
+	}
+	_, err = os.Lstat(filepath.Join(dstDir, "dir", "loop"))
+	if !os.IsNotExist(err) {
+		t.Errorf("the loop was copied: %v", err)
+	}
+	if stats.Files != 1 || stats.SkippedFiles != 1 {
+		t.Errorf("got %d files and %d skipped, want 1 and 1", stats.Files, stats.SkippedFiles)
+	}
+}
+
+func TestSyncDirNativeCountsDanglingSymlinks(t *testing.T) {
+	srcDir := filepath.Join(t.TempDir(), "src")
+	dstDir := filepath.Join(t.TempDir(), "dst")
+	writeTestTree(t, srcDir, map[string]string{"file": "content"})
+	err := os.Symlink("missing", filepath.Join(srcDir, "dangling"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := structs.SyncStats{}
+	err = syncDirNative(context.Background(), srcDir, dstDir, "", nil, &stats)
+	if err != nil {
+		t.Fatalf("sync failed: %s", err.Error())
+	}
+	if stats.Files != 1 || stats.SkippedFiles != 1 {
+		t.Errorf("got %d files and %d skipped, want 1 and 1", stats.Files, stats.SkippedFiles)
+	}
+}
+
+func TestSyncDirNativeCopiesChownedFiles(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ownership is only preserved as root")
+	}
+	srcDir := filepath.Join(t.TempDir(), "src")
+	previousDir := filepath.Join(t.TempDir(), "previous")
+	dstDir := filepath.Join(t.TempDir(), "dst")
+	writeTestTree(t, srcDir, map[string]string{"file": "content"})
+	err := syncDirNative(context.Background(), srcDir, previousDir, "", nil, &structs.SyncStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chown(filepath.Join(srcDir, "file"), 1234, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := structs.SyncStats{}
+	err = syncDirNative(context.Background(), srcDir, dstDir, previousDir, nil, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TransferredFiles != 1 {
+		t.Errorf("the chowned file was hard linked to the previous copy")
+	}
+	info, err := os.Stat(filepath.Join(previousDir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid == 1234 {
+		t.Errorf("the owner of the previous copy was changed")
+	}
+}
@@ -0,0 +1,198 @@
+package snapshots
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"peppeosmio/snapsync/structs"
+)
+
+const (
+	RestoreActionCreate    = "create"
+	RestoreActionOverwrite = "overwrite"
+	RestoreActionDelete    = "delete"
+)
+
+// RestoreChange is a file or dir that a restore would change. Size is the size
+// of the file written for creations and overwrites, of the file lost for deletions.
+type RestoreChange struct {
+	Action string
+	Path   string
+	Size   int64
+	IsDir  bool
+}
+
+// RestorePreview lists what a restore would change in a restore root, which is
+// a SrcDirAbspath or its copy under the restore target.
+type RestorePreview struct {
+	Root    string
+	Changes []RestoreChange
+}
+
+// Count returns how many changes with action the preview has and their bytes.
+// Dirs are not counted.
+func (preview *RestorePreview) Count(action string) (count int, bytes int64) {
+	for _, change := range preview.Changes {
+		if change.Action == action && !change.IsDir {
+			count++
+			bytes += change.Size
+		}
+	}
+	return count, bytes
+}
+
+// PreviewRestore returns what RestoreSnapshot would change with the same
+// arguments, one preview for every restore root, without changing anything.
+// The files are compared like the native engine does, by size, time and permissions.
+func PreviewRestore(snapshotInfo *structs.SnapshotInfo, snapshotConfig *structs.SnapshotConfig, options RestoreOptions) ([]*RestorePreview, error) {
+	items, err := getRestoreItems(snapshotInfo, snapshotConfig, options)
+	if err != nil {
+		return nil, err
+	}
+	var previews []*RestorePreview
+	previewsByRoot := map[string]*RestorePreview{}
+	for _, item := range items {
+		preview, ok := previewsByRoot[item.restoreRoot]
+		if !ok {
+			preview = &RestorePreview{Root: item.restoreRoot}
+			previewsByRoot[item.restoreRoot] = preview
+			previews = append(previews, preview)
+		}
+		if item.remove {
+			if pathExists(item.restorePath) {
+				err = previewDelete(preview, item.restorePath)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		info, err := os.Stat(item.snapshotPath)
+		if err != nil {
+			return nil, fmt.Errorf("can't stat %s: %s", item.snapshotPath, err.Error())
+		}
+		if info.IsDir() {
+			err = previewDir(preview, newExcludeMatcher(item.excludes), item.snapshotPath, item.restorePath, ".")
+		} else {
+			err = previewFile(preview, item.restorePath, info)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return previews, nil
+}
+
+// previewDir mirrors syncTreeNative for relDir of snapshotDir restored to restoreDir.
+func previewDir(preview *RestorePreview, matcher *excludeMatcher, snapshotDir string, restoreDir string, relDir string) error {
+	restorePath := path.Join(restoreDir, relDir)
+	restoreInfo, err := os.Stat(restorePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't stat %s: %s", restorePath, err.Error())
+	}
+	restoreExists := err == nil
+	if restoreExists && !restoreInfo.IsDir() {
+		err = previewDelete(preview, restorePath)
+		if err != nil {
+			return err
+		}
+		restoreExists = false
+	}
+	if !restoreExists {
+		preview.Changes = append(preview.Changes, RestoreChange{Action: RestoreActionCreate, Path: restorePath, IsDir: true})
+	}
+
+	snapshotPath := path.Join(snapshotDir, relDir)
+	entries, err := os.ReadDir(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("can't read directory %s: %s", snapshotPath, err.Error())
+	}
+	restored := map[string]bool{}
+	for _, entry := range entries {
+		entryRel := path.Join(relDir, entry.Name())
+		entryInfo, err := os.Stat(path.Join(snapshotDir, entryRel))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("can't stat %s: %s", path.Join(snapshotDir, entryRel), err.Error())
+		}
+		if matcher.excluded(entryRel, entryInfo.IsDir()) {
+			continue
+		}
+		if entryInfo.IsDir() {
+			restored[entry.Name()] = true
+			err = previewDir(preview, matcher, snapshotDir, restoreDir, entryRel)
+		} else if entryInfo.Mode().IsRegular() {
+			restored[entry.Name()] = true
+			err = previewFile(preview, path.Join(restoreDir, entryRel), entryInfo)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !restoreExists {
+		return nil
+	}
+	restoreEntries, err := os.ReadDir(restorePath)
+	if err != nil {
+		return fmt.Errorf("can't read directory %s: %s", restorePath, err.Error())
+	}
+	for _, restoreEntry := range restoreEntries {
+		entryRel := path.Join(relDir, restoreEntry.Name())
+		if restored[restoreEntry.Name()] || matcher.excluded(entryRel, restoreEntry.IsDir()) {
+			continue
+		}
+		err = previewDelete(preview, path.Join(restoreDir, entryRel))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func previewFile(preview *RestorePreview, restorePath string, snapshotInfo os.FileInfo) error {
+	restoreInfo, err := os.Lstat(restorePath)
+	if os.IsNotExist(err) {
+		preview.Changes = append(preview.Changes, RestoreChange{Action: RestoreActionCreate, Path: restorePath, Size: snapshotInfo.Size()})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't stat %s: %s", restorePath, err.Error())
+	}
+	if sameFileNative(snapshotInfo, restoreInfo) {
+		return nil
+	}
+	if restoreInfo.IsDir() {
+		err = previewDelete(preview, restorePath)
+		if err != nil {
+			return err
+		}
+		preview.Changes = append(preview.Changes, RestoreChange{Action: RestoreActionCreate, Path: restorePath, Size: snapshotInfo.Size()})
+		return nil
+	}
+	preview.Changes = append(preview.Changes, RestoreChange{Action: RestoreActionOverwrite, Path: restorePath, Size: snapshotInfo.Size()})
+	return nil
+}
+
+// previewDelete adds the deletion of restorePath and of everything inside it.
+func previewDelete(preview *RestorePreview, restorePath string) error {
+	return filepath.WalkDir(restorePath, func(walkPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		change := RestoreChange{Action: RestoreActionDelete, Path: walkPath, IsDir: entry.IsDir()}
+		if !entry.IsDir() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			change.Size = info.Size()
+		}
+		preview.Changes = append(preview.Changes, change)
+		return nil
+	})
+}
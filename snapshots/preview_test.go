@@ -0,0 +1,85 @@
+package snapshots
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"peppeosmio/snapsync/structs"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPreviewRestore(t *testing.T) {
+	srcDir := t.TempDir()
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+`, srcDir))
+	snapshotInfo := writeTestSnapshot(t, snapshotConfig, map[string]string{
+		"src/same":       "same",
+		"src/changed":    "old",
+		"src/new":        "new",
+		"src/dir/nested": "nested",
+	})
+	writeTestTree(t, srcDir, map[string]string{
+		"same":       "same",
+		"changed":    "newer",
+		"extra":      "extra",
+		"extradir/x": "x",
+	})
+	mtime := time.Now().Add(-time.Hour)
+	for _, filePath := range []string{path.Join(snapshotInfo.Abspath, "src", "same"), path.Join(srcDir, "same")} {
+		err := os.Chtimes(filePath, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	previews, err := PreviewRestore(snapshotInfo, snapshotConfig, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(previews) != 1 || previews[0].Root != srcDir {
+		t.Fatalf("got %+v, want one preview of %s", previews, srcDir)
+	}
+	var got []string
+	for _, change := range previews[0].Changes {
+		relPath, _ := filepath.Rel(srcDir, change.Path)
+		got = append(got, change.Action+" "+relPath)
+	}
+	slices.Sort(got)
+	want := []string{
+		"create dir",
+		"create dir/nested",
+		"create new",
+		"delete extra",
+		"delete extradir",
+		"delete extradir/x",
+		"overwrite changed",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if count, bytes := previews[0].Count(RestoreActionDelete); count != 2 || bytes != 6 {
+		t.Errorf("got %d deletions of %d bytes, want 2 of 6", count, bytes)
+	}
+	if content, _ := os.ReadFile(path.Join(srcDir, "changed")); string(content) != "newer" {
+		t.Error("the preview changed the source")
+	}
+
+	// once restored, there is nothing left to change
+	err = RestoreSnapshot(&structs.Config{Engine: structs.EngineNative}, snapshotInfo, snapshotConfig, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previews, err = PreviewRestore(snapshotInfo, snapshotConfig, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(previews[0].Changes) != 0 {
+		t.Errorf("got %+v after the restore, want no changes", previews[0].Changes)
+	}
+}
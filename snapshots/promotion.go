@@ -0,0 +1,133 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/structs"
+	"slices"
+	"time"
+)
+
+// ExecuteInterval runs the tier named interval of snapshotConfig: the first
+// tier takes a new snapshot of the sources, the others promote a snapshot of
+// the tier below. Canceling ctx stops a snapshot being taken.
+func ExecuteInterval(ctx context.Context, config *structs.Config, snapshotConfig *structs.SnapshotConfig, interval string) error {
+	for i, snapshotInterval := range snapshotConfig.Intervals {
+		if snapshotInterval.Name != interval {
+			continue
+		}
+		intervalConfig, err := configs.GetIntervalConfig(snapshotConfig, interval)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			_, err = ExecuteSnapshot(ctx, config, intervalConfig, SnapshotOptions{})
+			return err
+		}
+		lowerIntervalConfig, err := configs.GetIntervalConfig(snapshotConfig, snapshotConfig.Intervals[i-1].Name)
+		if err != nil {
+			return err
+		}
+		return promoteSnapshot(lowerIntervalConfig, intervalConfig, snapshotInterval.Promote)
+	}
+	return fmt.Errorf("snapshot %s has no interval %s", snapshotConfig.SnapshotName, interval)
+}
+
+// promoteSnapshot makes the oldest snapshot of the lower tier the newest
+// snapshot of the upper tier, like rsnapshot does. Nothing is promoted until
+// the lower tier is full, so no snapshot is promoted before it would be pruned.
+func promoteSnapshot(lowerIntervalConfig *structs.SnapshotConfig, intervalConfig *structs.SnapshotConfig, promote string) error {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", intervalConfig.SnapshotName)
+	before := time.Now().UnixMilli()
+	err := os.MkdirAll(intervalConfig.SnapshotsDir, 0700)
+	if err != nil {
+		return fmt.Errorf("%s can't create snapshot dir %s: %s", snapshotLogPrefix, intervalConfig.SnapshotsDir, err.Error())
+	}
+	// always lock the lower tier first so that two promotions can't deadlock
+	unlockLower, err := lockSnapshots(lowerIntervalConfig)
+	if err != nil {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer unlockLower()
+	unlock, err := lockSnapshots(intervalConfig)
+	if err != nil {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer unlock()
+	err = recoverSnapshots(lowerIntervalConfig)
+	if err != nil {
+		return err
+	}
+	err = recoverSnapshots(intervalConfig)
+	if err != nil {
+		return err
+	}
+
+	lowerSnapshots, err := listConfigSnapshots(lowerIntervalConfig)
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	if lowerIntervalConfig.RetentionPolicy == nil && lowerIntervalConfig.Retention <= 0 {
+		return fmt.Errorf("%s %s has no retention, so it has no snapshot to promote", snapshotLogPrefix, lowerIntervalConfig.Interval)
+	}
+	if len(lowerSnapshots) == 0 || len(lowerSnapshots) < lowerIntervalConfig.Retention {
+		slog.Info(fmt.Sprintf("%s %s has %d of %d snapshots, nothing to promote to %s yet", snapshotLogPrefix, lowerIntervalConfig.Interval, len(lowerSnapshots), lowerIntervalConfig.Retention, intervalConfig.Interval))
+		return nil
+	}
+	var oldestSnapshot *structs.SnapshotInfo
+	if lowerIntervalConfig.RetentionPolicy != nil {
+		// a retention policy doesn't keep a fixed count of snapshots
+		oldestSnapshot = slices.MinFunc(lowerSnapshots, func(a *structs.SnapshotInfo, b *structs.SnapshotInfo) int {
+			return a.Timestamp.Compare(b.Timestamp)
+		})
+	} else {
+		oldestSnapshot = lowerSnapshots[lowerIntervalConfig.Retention-1]
+	}
+
+	promotedPath := oldestSnapshot.Abspath
+	if promote == structs.PromoteLink {
+		tmpDir, err := os.MkdirTemp(intervalConfig.SnapshotsDir, getTmpDirPrefix(intervalConfig))
+		if err != nil {
+			return fmt.Errorf("%s can't create tmp dir: %s", snapshotLogPrefix, err.Error())
+		}
+		defer os.RemoveAll(tmpDir)
+		err = linkTreeNative(oldestSnapshot.Abspath, tmpDir)
+		if err != nil {
+			return fmt.Errorf("%s can't link %s into %s: %s", snapshotLogPrefix, oldestSnapshot.Abspath, tmpDir, err.Error())
+		}
+		// the pin and the tags belong to the original, not to the copy
+		if oldestSnapshot.Metadata.Pinned || len(oldestSnapshot.Metadata.Tags) > 0 {
+			err = updateSnapshotMetadata(tmpDir, func(metadata *structs.SnapshotMetadata) {
+				metadata.Pinned = false
+				metadata.Tags = nil
+			})
+			if err != nil {
+				return fmt.Errorf("%s can't reset the metadata of %s: %s", snapshotLogPrefix, tmpDir, err.Error())
+			}
+		}
+		// the copy keeps the creation time of the original
+		os.Chtimes(tmpDir, oldestSnapshot.Timestamp, oldestSnapshot.Timestamp)
+		promotedPath = tmpDir
+	}
+	slog.Info(fmt.Sprintf("%s promoting %s to %s", snapshotLogPrefix, oldestSnapshot.Abspath, intervalConfig.Interval))
+	_, err = rotateSnapshots(intervalConfig, promotedPath, oldestSnapshot.Timestamp)
+	if err != nil {
+		return fmt.Errorf("%s can't rotate snapshots: %s", snapshotLogPrefix, err.Error())
+	}
+	_, err = pruneSnapshots(intervalConfig, false)
+	if err != nil {
+		return err
+	}
+	_, err = pruneSnapshots(lowerIntervalConfig, false)
+	if err != nil {
+		return err
+	}
+
+	after := time.Now().UnixMilli()
+	seconds := float64(after-before) / 1000
+	slog.Info(fmt.Sprintf("%s promotion to %s done in %.2f s", snapshotLogPrefix, intervalConfig.Interval, seconds))
+	return nil
+}
@@ -0,0 +1,162 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testTiersYml = `intervals:
+  - name: hourly
+    retention: 2
+  - name: daily
+    retention: 2
+    promote: %s
+`
+
+// writeHourlySnapshots creates the numbered hourly snapshots, each with a file
+// holding its number.
+func writeHourlySnapshots(t *testing.T, snapshotConfig *structs.SnapshotConfig, count int) {
+	t.Helper()
+	for number := 0; number < count; number++ {
+		snapshotPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "hourly", number))
+		writeTestTree(t, snapshotPath, map[string]string{"file": GetSnapshotDirName("t", "hourly", number)})
+		mtime := time.Now().Add(-time.Duration(number) * time.Hour)
+		err := os.Chtimes(snapshotPath, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTestFile(t *testing.T, filePath string) string {
+	t.Helper()
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestExecuteIntervalMovesOldestSnapshot(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(testTiersYml, structs.PromoteMove))
+	writeHourlySnapshots(t, snapshotConfig, 2)
+	err := ExecuteInterval(context.Background(), &structs.Config{Engine: structs.EngineNative}, snapshotConfig, "daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dailyPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 0))
+	if content := readTestFile(t, path.Join(dailyPath, "file")); content != "t.hourly.1" {
+		t.Errorf("got %s promoted, want the oldest hourly snapshot", content)
+	}
+	if pathExists(path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "hourly", 1))) {
+		t.Error("the promoted snapshot is still in the hourly tier")
+	}
+	if !pathExists(path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "hourly", 0))) {
+		t.Error("the newest hourly snapshot is gone")
+	}
+}
+
+func TestExecuteIntervalLinksOldestSnapshot(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(testTiersYml, structs.PromoteLink))
+	writeHourlySnapshots(t, snapshotConfig, 2)
+	err := ExecuteInterval(context.Background(), &structs.Config{Engine: structs.EngineNative}, snapshotConfig, "daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hourlyFile := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "hourly", 1), "file")
+	dailyFile := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 0), "file")
+	hourlyStat, err := os.Stat(hourlyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dailyStat, err := os.Stat(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hourlyStat.Sys().(*syscall.Stat_t).Ino != dailyStat.Sys().(*syscall.Stat_t).Ino {
+		t.Error("the promoted copy doesn't hard link the hourly snapshot")
+	}
+}
+
+func TestExecuteIntervalWaitsForFullLowerTier(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(testTiersYml, structs.PromoteMove))
+	writeHourlySnapshots(t, snapshotConfig, 1)
+	err := ExecuteInterval(context.Background(), &structs.Config{Engine: structs.EngineNative}, snapshotConfig, "daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pathExists(path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 0))) {
+		t.Error("a snapshot was promoted before the hourly tier was full")
+	}
+	if !pathExists(path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "hourly", 0))) {
+		t.Error("the hourly snapshot is gone")
+	}
+}
+
+func TestExecuteIntervalResetsPinOfLinkedCopy(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(testTiersYml, structs.PromoteLink))
+	writeHourlySnapshots(t, snapshotConfig, 2)
+	hourlyPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "hourly", 1))
+	err := writeSnapshotMetadata(hourlyPath, &structs.SnapshotMetadata{Pinned: true, Tags: []string{"release"}, Note: "kept"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ExecuteInterval(context.Background(), &structs.Config{Engine: structs.EngineNative}, snapshotConfig, "daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dailyMetadata, err := readSnapshotMetadata(path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dailyMetadata.Pinned || len(dailyMetadata.Tags) > 0 || dailyMetadata.Note != "kept" {
+		t.Errorf("got promoted copy metadata %+v, want only the note", dailyMetadata)
+	}
+	hourlyMetadata, err := readSnapshotMetadata(hourlyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hourlyMetadata.Pinned || len(hourlyMetadata.Tags) != 1 {
+		t.Errorf("the original lost its pin or tags: %+v", hourlyMetadata)
+	}
+}
+
+func TestExecuteIntervalPromotesOldestWithRetentionPolicy(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, `intervals:
+  - name: hourly
+    retention: 1
+    retention_policy:
+      keep_last: 3
+  - name: daily
+    retention: 2
+`)
+	writeHourlySnapshots(t, snapshotConfig, 3)
+	err := ExecuteInterval(context.Background(), &structs.Config{Engine: structs.EngineNative}, snapshotConfig, "daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dailyFile := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 0), "file")
+	if got := readTestFile(t, dailyFile); got != GetSnapshotDirName("t", "hourly", 2) {
+		t.Errorf("got %s promoted, want the oldest hourly snapshot", got)
+	}
+}
+
+func TestPromoteSnapshotWithoutRetention(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(testTiersYml, structs.PromoteMove))
+	writeHourlySnapshots(t, snapshotConfig, 2)
+	hourlyConfig := *snapshotConfig
+	hourlyConfig.Interval = "hourly"
+	hourlyConfig.Retention = 0
+	dailyConfig := *snapshotConfig
+	dailyConfig.Interval = "daily"
+	err := promoteSnapshot(&hourlyConfig, &dailyConfig, structs.PromoteMove)
+	if err == nil {
+		t.Error("got no error promoting from a tier without retention")
+	}
+}
@@ -0,0 +1,382 @@
+package snapshots
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrPartialRestore is returned by RestoreSnapshot when some of the dirs were
+// restored and others were not.
+var ErrPartialRestore = errors.New("snapshot partially restored")
+
+// ErrNothingToRestore is returned by RestoreSnapshot when a path to restore is
+// not in the snapshot.
+var ErrNothingToRestore = errors.New("nothing to restore")
+
+// SnapshotSelector chooses the snapshot to restore. Only one of Number, At, Tag
+// and Path is expected to be set; Number is ignored when negative.
+type SnapshotSelector struct {
+	// Interval restricts Number to a tier, since every tier counts from 0
+	Interval string
+	Number   int
+	// At selects the newest snapshot taken at or before it
+	At time.Time
+	// Tag selects the newest snapshot with the tag
+	Tag string
+	// Path selects the snapshot in this dir
+	Path string
+}
+
+// SelectSnapshot returns the snapshot of snapshotsInfo chosen by selector, or
+// nil if no snapshot matches. snapshotsInfo must be sorted like listSnapshots does.
+func SelectSnapshot(snapshotsInfo []*structs.SnapshotInfo, selector SnapshotSelector) *structs.SnapshotInfo {
+	var selected *structs.SnapshotInfo
+	for _, snapshotInfo := range snapshotsInfo {
+		if len(selector.Interval) > 0 && snapshotInfo.Interval != selector.Interval {
+			continue
+		}
+		// the pre restore snapshots hold only what a restore overwrote
+		if len(selector.Interval) == 0 && len(selector.Tag) == 0 && len(selector.Path) == 0 && snapshotInfo.Interval == structs.PreRestoreInterval {
+			continue
+		}
+		switch {
+		case selector.Number >= 0:
+			if snapshotInfo.Number != selector.Number {
+				continue
+			}
+		case !selector.At.IsZero():
+			if snapshotInfo.Timestamp.After(selector.At) {
+				continue
+			}
+		case len(selector.Tag) > 0:
+			if !slices.Contains(snapshotInfo.Metadata.Tags, selector.Tag) {
+				continue
+			}
+		case len(selector.Path) > 0:
+			if snapshotInfo.Abspath != selector.Path {
+				continue
+			}
+		}
+		// the tiers are listed one after the other, so compare across them
+		if selected == nil || snapshotInfo.Timestamp.After(selected.Timestamp) {
+			selected = snapshotInfo
+		}
+	}
+	return selected
+}
+
+// RestoreOptions limits what RestoreSnapshot restores.
+type RestoreOptions struct {
+	// Paths are absolute source paths of files or subtrees to restore instead of
+	// every dir. Nothing outside them is touched.
+	Paths []string
+	// Target is a dir under which the absolute source paths are recreated,
+	// instead of restoring over the live sources
+	Target string
+	// Undo restores a pre restore snapshot. Only the dirs and paths recorded
+	// in it are touched: the ones that didn't exist before the restore are
+	// deleted, the others put back. No pre restore snapshot is taken.
+	Undo bool
+}
+
+// restoreItem is a file or tree of a snapshot and where it is restored
+type restoreItem struct {
+	snapshotPath string
+	restorePath  string
+	// snapshotRoot and restoreRoot are the SnapshotDir containing the item
+	snapshotRoot string
+	restoreRoot  string
+	dir          structs.SnapshotDir
+	excludes     []string
+	// remove is set when undoing the restore of a path that didn't exist
+	remove bool
+}
+
+// getUndoRecord returns the restore that snapshotInfo can undo.
+func getUndoRecord(snapshotInfo *structs.SnapshotInfo) (*structs.RestoreRecord, error) {
+	record := snapshotInfo.Metadata.Restore
+	if record == nil {
+		return nil, fmt.Errorf("%w: %s is not a pre restore snapshot", ErrNothingToRestore, snapshotInfo.Abspath)
+	}
+	return record, nil
+}
+
+// getRestoreItems maps the options to what has to be restored. Paths are matched
+// against the dir with the longest SrcDirAbspath containing them.
+func getRestoreItems(snapshotInfo *structs.SnapshotInfo, snapshotConfig *structs.SnapshotConfig, options RestoreOptions) ([]restoreItem, error) {
+	var items []restoreItem
+	if len(options.Target) > 0 {
+		if !path.IsAbs(options.Target) {
+			return nil, fmt.Errorf("target %s is not an absolute path", options.Target)
+		}
+		for _, dir := range snapshotConfig.Dirs {
+			if isSubpath(dir.SrcDirAbspath, options.Target) || isSubpath(options.Target, dir.SrcDirAbspath) {
+				return nil, fmt.Errorf("target %s overlaps with the source dir %s", options.Target, dir.SrcDirAbspath)
+			}
+		}
+	}
+	newItem := func(dir structs.SnapshotDir, relPath string) restoreItem {
+		item := restoreItem{
+			snapshotRoot: path.Join(snapshotInfo.Abspath, dir.DstDirInSnapshot),
+			restoreRoot:  path.Join(options.Target, dir.SrcDirAbspath),
+			dir:          dir,
+		}
+		item.snapshotPath = path.Join(item.snapshotRoot, relPath)
+		item.restorePath = path.Join(item.restoreRoot, relPath)
+		if relPath == "." {
+			// the excluded files were never snapshotted, so a restore doesn't delete them either
+			item.excludes = append(item.excludes, dir.Excludes...)
+			// a dir snapshotted at the root of the snapshot shares it with the snapsync files
+			if path.Clean("/"+dir.DstDirInSnapshot) == "/" {
+				item.excludes = append(item.excludes, getSnapsyncFilesExcludes()...)
+			}
+		}
+		return item
+	}
+	var record *structs.RestoreRecord
+	if options.Undo {
+		var err error
+		record, err = getUndoRecord(snapshotInfo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(options.Paths) == 0 {
+		for _, dir := range snapshotConfig.Dirs {
+			item := newItem(dir, ".")
+			if options.Undo {
+				// the snapshot may hold other dirs, carried over from older pre restore snapshots
+				if !slices.Contains(record.Dirs, dir.SrcDirAbspath) {
+					continue
+				}
+				item.remove = slices.Contains(record.Missing, item.restorePath)
+			}
+			items = append(items, item)
+		}
+		if len(items) == 0 {
+			return nil, fmt.Errorf("%w: no dir of %s is in %s", ErrNothingToRestore, snapshotConfig.SnapshotName, snapshotInfo.Abspath)
+		}
+		return items, nil
+	}
+	for _, restorePath := range options.Paths {
+		if !path.IsAbs(restorePath) {
+			return nil, fmt.Errorf("%s is not an absolute path", restorePath)
+		}
+		restorePath = path.Clean(restorePath)
+		dir, relPath, found := snapshotConfig.GetSnapshotDir(restorePath)
+		if !found {
+			return nil, fmt.Errorf("%w: %s is not in any dir of %s", ErrNothingToRestore, restorePath, snapshotConfig.SnapshotName)
+		}
+		item := newItem(*dir, relPath)
+		item.remove = options.Undo && slices.Contains(record.Missing, item.restorePath)
+		if !item.remove && !pathExists(item.snapshotPath) {
+			return nil, fmt.Errorf("%w: %s is not in snapshot %s", ErrNothingToRestore, restorePath, snapshotInfo.Abspath)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// isSubpath tells if subPath is dirPath or is inside it
+func isSubpath(dirPath string, subPath string) bool {
+	relPath, err := filepath.Rel(path.Clean(dirPath), path.Clean(subPath))
+	return err == nil && relPath != ".." && !strings.HasPrefix(relPath, "../")
+}
+
+// ensureRestoreParents creates the missing parents of item.restorePath. The
+// returned function gives them the permissions, owner and times they have in
+// the snapshot, and must be called once item is restored. The parents of the
+// restore root are not in the snapshot and are created private.
+func ensureRestoreParents(item restoreItem) (copyParentsMetadata func() error, err error) {
+	copyParentsMetadata = func() error { return nil }
+	relPath, err := filepath.Rel(item.restoreRoot, item.restorePath)
+	if err != nil {
+		return nil, err
+	}
+	if relPath == "." {
+		return copyParentsMetadata, os.MkdirAll(path.Dir(item.restoreRoot), 0700)
+	}
+	var created []string
+	for relDir := path.Dir(relPath); !pathExists(path.Join(item.restoreRoot, relDir)); relDir = path.Dir(relDir) {
+		created = append(created, relDir)
+		if relDir == "." {
+			break
+		}
+	}
+	err = os.MkdirAll(path.Join(item.restoreRoot, path.Dir(relPath)), 0700)
+	if err != nil {
+		return nil, err
+	}
+	copyParentsMetadata = func() error {
+		// the deepest dirs first, so that setting their times doesn't change the parents
+		for _, relDir := range created {
+			info, err := os.Stat(path.Join(item.snapshotRoot, relDir))
+			if err != nil {
+				return fmt.Errorf("can't stat %s: %s", path.Join(item.snapshotRoot, relDir), err.Error())
+			}
+			err = copyMetadataNative(path.Join(item.restoreRoot, relDir), info)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return copyParentsMetadata, nil
+}
+
+// RestoreSnapshot restores snapshotInfo over the source dirs of snapshotConfig,
+// or under options.Target, limited to options.Paths when set.
+func RestoreSnapshot(config *structs.Config, snapshotInfo *structs.SnapshotInfo, snapshotConfig *structs.SnapshotConfig, options RestoreOptions) error {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	items, err := getRestoreItems(snapshotInfo, snapshotConfig, options)
+	if err != nil {
+		return err
+	}
+	// a restore over the live sources can't be taken back without a copy of them
+	if len(options.Target) == 0 && !options.Undo {
+		preRestorePath, err := takePreRestoreSnapshot(config, snapshotConfig, snapshotInfo, items, options)
+		if err != nil {
+			return fmt.Errorf("can't take the pre restore snapshot: %s", err.Error())
+		}
+		slog.Info(fmt.Sprintf("%s saved the current state in %s", snapshotLogPrefix, preRestorePath))
+	}
+	// the snapshot can't be rotated or pruned while it is copied
+	intervalConfig := *snapshotConfig
+	intervalConfig.Interval = snapshotInfo.Interval
+	unlock, err := lockSnapshots(&intervalConfig)
+	if err != nil {
+		return fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer unlock()
+	err = checkSnapshotUnchanged(snapshotInfo)
+	if err != nil {
+		return fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	failed := 0
+	var lastErr error
+	for _, item := range items {
+		err = restoreItemPath(config, item)
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s can't restore %s to %s: %s", snapshotLogPrefix, item.snapshotPath, item.restorePath, err.Error()))
+			failed++
+			lastErr = err
+			continue
+		}
+		slog.Info(fmt.Sprintf("%s restored %s to %s", snapshotLogPrefix, item.snapshotPath, item.restorePath))
+	}
+	if failed == 0 && options.Undo {
+		err = updateSnapshotMetadata(snapshotInfo.Abspath, func(metadata *structs.SnapshotMetadata) {
+			if metadata.Restore != nil {
+				metadata.Restore.Undone = true
+			}
+		})
+		if err != nil {
+			slog.Warn(snapshotLogPrefix + " " + err.Error())
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	if failed < len(items) {
+		return fmt.Errorf("%w: %d of %d paths failed, the last error is: %s", ErrPartialRestore, failed, len(items), lastErr.Error())
+	}
+	return fmt.Errorf("nothing restored, the last error is: %s", lastErr.Error())
+}
+
+func restoreItemPath(config *structs.Config, item restoreItem) error {
+	if item.remove {
+		return os.RemoveAll(item.restorePath)
+	}
+	copyParentsMetadata, err := ensureRestoreParents(item)
+	if err != nil {
+		return fmt.Errorf("can't create the parents of %s: %s", item.restorePath, err.Error())
+	}
+	info, err := os.Stat(item.snapshotPath)
+	if err != nil {
+		return fmt.Errorf("can't stat %s: %s", item.snapshotPath, err.Error())
+	}
+	// a restore isn't run by the daemon, and stopping it halfway would leave
+	// the sources mixed with the snapshot
+	if info.IsDir() {
+		_, err = syncDir(context.Background(), config, item.snapshotPath, item.restorePath, "", item.excludes)
+	} else {
+		err = syncFile(context.Background(), config, item.snapshotPath, item.restorePath)
+	}
+	if err != nil {
+		return err
+	}
+	return copyParentsMetadata()
+}
+
+// getPreRestoreConfig returns the config of the pre restore snapshots of
+// snapshotConfig, which take only dirs.
+func getPreRestoreConfig(snapshotConfig *structs.SnapshotConfig, dirs []structs.SnapshotDir) *structs.SnapshotConfig {
+	preRestoreConfig := *snapshotConfig
+	preRestoreConfig.Interval = structs.PreRestoreInterval
+	preRestoreConfig.Naming = structs.NamingTimestamp
+	preRestoreConfig.Cron = ""
+	// the newest is always kept to undo the last restore, the others until their KeepUntil
+	preRestoreConfig.Retention = 1
+	preRestoreConfig.RetentionPolicy = &structs.RetentionPolicy{KeepLast: 1}
+	preRestoreConfig.Dirs = dirs
+	preRestoreConfig.PreSnapshotCommands = nil
+	preRestoreConfig.PostSnapshotCommands = nil
+	return &preRestoreConfig
+}
+
+// takePreRestoreSnapshot snapshots the dirs that items are going to overwrite,
+// recording the restore so that it can be undone.
+func takePreRestoreSnapshot(config *structs.Config, snapshotConfig *structs.SnapshotConfig, snapshotInfo *structs.SnapshotInfo, items []restoreItem, options RestoreOptions) (string, error) {
+	var dirs []structs.SnapshotDir
+	record := &structs.RestoreRecord{Snapshot: snapshotInfo.Abspath}
+	for _, item := range items {
+		if !slices.Contains(record.Dirs, item.dir.SrcDirAbspath) {
+			dirs = append(dirs, item.dir)
+			record.Dirs = append(record.Dirs, item.dir.SrcDirAbspath)
+		}
+		if len(options.Paths) > 0 {
+			record.Paths = append(record.Paths, item.restorePath)
+		}
+		// undoing the restore deletes what it created
+		if !pathExists(item.restorePath) {
+			record.Missing = append(record.Missing, item.restorePath)
+		}
+	}
+	keepFor, err := utils.ParseDuration(snapshotConfig.PreRestoreRetention)
+	if err != nil {
+		return "", fmt.Errorf("invalid pre_restore_retention: %s", err.Error())
+	}
+	now := time.Now()
+	keepUntil := now.Add(keepFor)
+	return executeOnlySnapshot(context.Background(), config, getPreRestoreConfig(snapshotConfig, dirs), structs.SnapshotMetadata{
+		StartedAt: now,
+		Tags:      []string{structs.PreRestoreTag},
+		KeepUntil: &keepUntil,
+		Restore:   record,
+	})
+}
+
+// GetLastRestore returns the pre restore snapshot of the newest restore that
+// was not undone, or nil if there is none.
+func GetLastRestore(snapshotConfig *structs.SnapshotConfig) (*structs.SnapshotInfo, error) {
+	snapshotsInfo, err := listSnapshots(snapshotConfig.SnapshotsDir, snapshotConfig.SnapshotName, structs.PreRestoreInterval)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshotInfo := range snapshotsInfo {
+		if snapshotInfo.Metadata.Restore != nil && !snapshotInfo.Metadata.Restore.Undone {
+			return snapshotInfo, nil
+		}
+	}
+	return nil, nil
+}
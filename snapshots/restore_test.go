@@ -0,0 +1,384 @@
+package snapshots
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"testing"
+	"time"
+)
+
+func TestSelectSnapshot(t *testing.T) {
+	now := time.Now()
+	snapshotsInfo := []*structs.SnapshotInfo{
+		{Abspath: "daily.0", Interval: "daily", Number: 0, Timestamp: now.Add(-24 * time.Hour)},
+		{Abspath: "daily.1", Interval: "daily", Number: 1, Timestamp: now.Add(-48 * time.Hour), Metadata: structs.SnapshotMetadata{Tags: []string{"release"}}},
+		{Abspath: "hourly.0", Interval: "hourly", Number: 0, Timestamp: now.Add(-time.Hour)},
+		{Abspath: "hourly.1", Interval: "hourly", Number: 1, Timestamp: now.Add(-2 * time.Hour), Metadata: structs.SnapshotMetadata{Tags: []string{"release"}}},
+	}
+	tests := []struct {
+		name     string
+		selector SnapshotSelector
+		want     string
+	}{
+		{"number in interval", SnapshotSelector{Interval: "daily", Number: 1}, "daily.1"},
+		{"number across intervals", SnapshotSelector{Number: 0}, "hourly.0"},
+		{"number out of range", SnapshotSelector{Interval: "daily", Number: 2}, ""},
+		{"at a snapshot time", SnapshotSelector{Number: -1, At: now.Add(-2 * time.Hour)}, "hourly.1"},
+		{"at between snapshots", SnapshotSelector{Number: -1, At: now.Add(-30 * time.Hour)}, "daily.1"},
+		{"at before every snapshot", SnapshotSelector{Number: -1, At: now.Add(-72 * time.Hour)}, ""},
+		{"newest with tag", SnapshotSelector{Number: -1, Tag: "release"}, "hourly.1"},
+		{"missing tag", SnapshotSelector{Number: -1, Tag: "other"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := SelectSnapshot(snapshotsInfo, test.selector)
+			gotPath := ""
+			if got != nil {
+				gotPath = got.Abspath
+			}
+			if gotPath != test.want {
+				t.Errorf("got %q, want %q", gotPath, test.want)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotPartialFailure(t *testing.T) {
+	srcDir := t.TempDir()
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: a
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: b
+`, srcDir, t.TempDir()))
+	// b is missing from the snapshot
+	snapshotInfo := writeTestSnapshot(t, snapshotConfig, map[string]string{"a/file": "a"})
+	config := &structs.Config{Engine: structs.EngineNative}
+	err := RestoreSnapshot(config, snapshotInfo, snapshotConfig, RestoreOptions{})
+	if !errors.Is(err, ErrPartialRestore) {
+		t.Errorf("got %v, want a partial restore", err)
+	}
+	if content, _ := os.ReadFile(path.Join(srcDir, "file")); string(content) != "a" {
+		t.Errorf("the dir that could be restored wasn't")
+	}
+
+	snapshotConfig.Dirs = snapshotConfig.Dirs[1:]
+	err = RestoreSnapshot(config, snapshotInfo, snapshotConfig, RestoreOptions{})
+	if err == nil || errors.Is(err, ErrPartialRestore) {
+		t.Errorf("got %v, want a failed restore", err)
+	}
+}
+
+func TestGetRestoreItemsTarget(t *testing.T) {
+	snapshotInfo := &structs.SnapshotInfo{Abspath: "/snapshots/t.daily.0"}
+	snapshotConfig := &structs.SnapshotConfig{
+		SnapshotName: "t",
+		Dirs: []structs.SnapshotDir{
+			{SrcDirAbspath: "/home/user", DstDirInSnapshot: "home"},
+			{SrcDirAbspath: "/home/user/data", DstDirInSnapshot: "data"},
+		},
+	}
+	type mapping struct{ snapshotPath, restorePath string }
+	tests := []struct {
+		name    string
+		options RestoreOptions
+		want    []mapping
+		wantErr bool
+	}{
+		{
+			name:    "every dir",
+			options: RestoreOptions{Target: "/tmp/restored"},
+			want: []mapping{
+				{"/snapshots/t.daily.0/home", "/tmp/restored/home/user"},
+				{"/snapshots/t.daily.0/data", "/tmp/restored/home/user/data"},
+			},
+		},
+		{
+			name:    "every dir in place",
+			options: RestoreOptions{},
+			want: []mapping{
+				{"/snapshots/t.daily.0/home", "/home/user"},
+				{"/snapshots/t.daily.0/data", "/home/user/data"},
+			},
+		},
+		{name: "relative target", options: RestoreOptions{Target: "restored"}, wantErr: true},
+		{name: "target inside a source", options: RestoreOptions{Target: "/home/user/restored"}, wantErr: true},
+		{name: "target containing a source", options: RestoreOptions{Target: "/home"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items, err := getRestoreItems(snapshotInfo, snapshotConfig, test.options)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []mapping
+			for _, item := range items {
+				got = append(got, mapping{item.snapshotPath, item.restorePath})
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetRestoreItemsTargetPath(t *testing.T) {
+	snapshotPath := t.TempDir()
+	writeTestTree(t, snapshotPath, map[string]string{"data/docs/file": "content"})
+	snapshotConfig := &structs.SnapshotConfig{
+		SnapshotName: "t",
+		Dirs: []structs.SnapshotDir{
+			{SrcDirAbspath: "/home/user", DstDirInSnapshot: "home"},
+			{SrcDirAbspath: "/home/user/data", DstDirInSnapshot: "data"},
+		},
+	}
+	options := RestoreOptions{Paths: []string{"/home/user/data/docs/file"}, Target: "/tmp/restored"}
+	items, err := getRestoreItems(&structs.SnapshotInfo{Abspath: snapshotPath}, snapshotConfig, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the path belongs to the dir with the longest source path
+	if len(items) != 1 || items[0].snapshotPath != path.Join(snapshotPath, "data/docs/file") || items[0].restorePath != "/tmp/restored/home/user/data/docs/file" {
+		t.Errorf("got %+v", items)
+	}
+	options.Paths = []string{"/etc/file"}
+	_, err = getRestoreItems(&structs.SnapshotInfo{Abspath: snapshotPath}, snapshotConfig, options)
+	if !errors.Is(err, ErrNothingToRestore) {
+		t.Errorf("got %v for a path outside the dirs, want nothing to restore", err)
+	}
+}
+
+func TestRestoreSnapshotToTarget(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "live"})
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+`, srcDir))
+	snapshotInfo := writeTestSnapshot(t, snapshotConfig, map[string]string{"src/file": "old"})
+	target := t.TempDir()
+	config := &structs.Config{Engine: structs.EngineNative}
+	err := RestoreSnapshot(config, snapshotInfo, snapshotConfig, RestoreOptions{Target: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path.Join(target, srcDir, "file")); string(content) != "old" {
+		t.Errorf("got %q under the target, want the snapshot content", content)
+	}
+	if content, _ := os.ReadFile(path.Join(srcDir, "file")); string(content) != "live" {
+		t.Errorf("the live source was changed to %q", content)
+	}
+}
+
+func TestRestoreSnapshotRefusesRotatedSnapshot(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "live"})
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+`, srcDir))
+	snapshotInfo := writeTestSnapshot(t, snapshotConfig, map[string]string{"src/file": "old"})
+	// a rotation puts another snapshot at the listed path
+	err := os.Rename(snapshotInfo.Abspath, path.Join(snapshotConfig.SnapshotsDir, "t.daily.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestTree(t, snapshotInfo.Abspath, map[string]string{"src/file": "new"})
+	newer := snapshotInfo.Timestamp.Add(time.Hour)
+	err = os.Chtimes(snapshotInfo.Abspath, newer, newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &structs.Config{Engine: structs.EngineNative}
+	err = RestoreSnapshot(config, snapshotInfo, snapshotConfig, RestoreOptions{Target: t.TempDir()})
+	if err == nil {
+		t.Error("the snapshot that replaced the listed one was restored")
+	}
+
+	unlock, err := lockSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RestoreSnapshot(config, snapshotsInfo[0], snapshotConfig, RestoreOptions{Target: t.TempDir()})
+	if !errors.Is(err, ErrSnapshotsLocked) {
+		t.Errorf("got %v restoring a locked snapshot, want the snapshots locked", err)
+	}
+}
+
+func TestRestorePathKeepsParentsTimes(t *testing.T) {
+	snapshotPath := t.TempDir()
+	srcDir := path.Join(t.TempDir(), "src")
+	writeTestTree(t, path.Join(snapshotPath, "data"), map[string]string{"a/b/file": "content"})
+	parentsTime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	for _, relDir := range []string{"data/a/b", "data/a"} {
+		err := os.Chtimes(path.Join(snapshotPath, relDir), parentsTime, parentsTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshotInfo := &structs.SnapshotInfo{Abspath: snapshotPath}
+	snapshotConfig := &structs.SnapshotConfig{
+		Dirs: []structs.SnapshotDir{{SrcDirAbspath: srcDir, DstDirInSnapshot: "data"}},
+	}
+	items, err := getRestoreItems(snapshotInfo, snapshotConfig, RestoreOptions{Paths: []string{path.Join(srcDir, "a/b/file")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &structs.Config{Engine: structs.EngineNative}
+	for _, item := range items {
+		err = restoreItemPath(config, item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := os.ReadFile(path.Join(srcDir, "a/b/file"))
+	if err != nil || string(content) != "content" {
+		t.Fatalf("file not restored: %q, %v", content, err)
+	}
+	// the parents get their times after the file is written into them
+	for _, relDir := range []string{"a/b", "a"} {
+		info, err := os.Stat(path.Join(srcDir, relDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(parentsTime) {
+			t.Errorf("%s: got mtime %s, want %s", relDir, info.ModTime(), parentsTime)
+		}
+	}
+}
+
+func TestRestoreDirKeepsExcludedFiles(t *testing.T) {
+	snapshotPath := t.TempDir()
+	srcDir := path.Join(t.TempDir(), "src")
+	writeTestTree(t, path.Join(snapshotPath, "data"), map[string]string{"file": "content"})
+	writeTestTree(t, srcDir, map[string]string{"file": "changed content", "new": "new", "cache.tmp": "cache"})
+	snapshotInfo := &structs.SnapshotInfo{Abspath: snapshotPath}
+	snapshotConfig := &structs.SnapshotConfig{
+		Dirs: []structs.SnapshotDir{{SrcDirAbspath: srcDir, DstDirInSnapshot: "data", Excludes: []string{"*.tmp"}}},
+	}
+	items, err := getRestoreItems(snapshotInfo, snapshotConfig, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &structs.Config{Engine: structs.EngineNative}
+	for _, item := range items {
+		err = restoreItemPath(config, item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := os.ReadFile(path.Join(srcDir, "file"))
+	if err != nil || string(content) != "content" {
+		t.Errorf("file not restored: %q, %v", content, err)
+	}
+	if pathExists(path.Join(srcDir, "new")) {
+		t.Errorf("the file missing from the snapshot was not deleted")
+	}
+	if !pathExists(path.Join(srcDir, "cache.tmp")) {
+		t.Errorf("the excluded file was deleted")
+	}
+}
+
+func TestUndoRestoreOnlyTouchesRecordedDirs(t *testing.T) {
+	srcA := t.TempDir()
+	writeTestTree(t, srcA, map[string]string{"file": "live", "created": "live"})
+	srcB := path.Join(t.TempDir(), "b")
+	srcC := t.TempDir()
+	writeTestTree(t, srcC, map[string]string{"file": "untouched"})
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: a
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: b
+`, srcA, srcB))
+	snapshotInfo := writeTestSnapshot(t, snapshotConfig, map[string]string{"a/file": "old", "b/file": "old"})
+	config := &structs.Config{Engine: structs.EngineNative}
+	err := RestoreSnapshot(config, snapshotInfo, snapshotConfig, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	preRestoreInfo, err := GetLastRestore(snapshotConfig)
+	if err != nil || preRestoreInfo == nil {
+		t.Fatalf("got no pre restore snapshot: %v", err)
+	}
+
+	// a dir added to the config after the restore has nothing to undo
+	snapshotConfig.Dirs = append(snapshotConfig.Dirs, structs.SnapshotDir{SrcDirAbspath: srcC, DstDirInSnapshot: "c"})
+	err = RestoreSnapshot(config, preRestoreInfo, snapshotConfig, RestoreOptions{Undo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path.Join(srcA, "file")); string(content) != "live" {
+		t.Errorf("got %q in the restored dir, want its content before the restore", content)
+	}
+	if !pathExists(path.Join(srcA, "created")) {
+		t.Error("a file that existed before the restore is gone")
+	}
+	if pathExists(srcB) {
+		t.Error("the dir created by the restore was kept")
+	}
+	if content, _ := os.ReadFile(path.Join(srcC, "file")); string(content) != "untouched" {
+		t.Error("the undo changed a dir the restore didn't touch")
+	}
+}
+
+func TestUndoRestoreOfPaths(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "live", "other": "live"})
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+`, srcDir))
+	snapshotInfo := writeTestSnapshot(t, snapshotConfig, map[string]string{"src/file": "old", "src/new": "old", "src/other": "old"})
+	config := &structs.Config{Engine: structs.EngineNative}
+	options := RestoreOptions{Paths: []string{path.Join(srcDir, "file"), path.Join(srcDir, "new")}}
+	err := RestoreSnapshot(config, snapshotInfo, snapshotConfig, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preRestoreInfo, err := GetLastRestore(snapshotConfig)
+	if err != nil || preRestoreInfo == nil {
+		t.Fatalf("got no pre restore snapshot: %v", err)
+	}
+	record := preRestoreInfo.Metadata.Restore
+	err = RestoreSnapshot(config, preRestoreInfo, snapshotConfig, RestoreOptions{Paths: record.Paths, Undo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path.Join(srcDir, "file")); string(content) != "live" {
+		t.Errorf("got %q, want the content before the restore", content)
+	}
+	if pathExists(path.Join(srcDir, "new")) {
+		t.Error("the file created by the restore was kept")
+	}
+	if content, _ := os.ReadFile(path.Join(srcDir, "other")); string(content) != "live" {
+		t.Error("the undo changed a path the restore didn't touch")
+	}
+	if last, _ := GetLastRestore(snapshotConfig); last != nil {
+		t.Error("the undone restore can be undone again")
+	}
+}
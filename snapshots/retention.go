@@ -0,0 +1,174 @@
+package snapshots
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"slices"
+	"time"
+)
+
+type RetentionDecision struct {
+	SnapshotInfo *structs.SnapshotInfo
+	Keep         bool
+	// Reasons are the rules that keep the snapshot, empty if it is removed
+	Reasons []string
+}
+
+// getRetentionPolicy returns the policy of intervalConfig, or a keep_last
+// policy equivalent to Retention if there is none.
+func getRetentionPolicy(intervalConfig *structs.SnapshotConfig) *structs.RetentionPolicy {
+	if intervalConfig.RetentionPolicy != nil {
+		return intervalConfig.RetentionPolicy
+	}
+	return &structs.RetentionPolicy{KeepLast: intervalConfig.Retention}
+}
+
+type retentionBucketRule struct {
+	name   string
+	count  int
+	bucket func(timestamp time.Time) string
+}
+
+// EvaluateRetention decides which snapshots of one interval are kept.
+// snapshotsInfo must be sorted newest first, like listSnapshots returns them.
+func EvaluateRetention(intervalConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo) (decisions []*RetentionDecision, err error) {
+	policy := getRetentionPolicy(intervalConfig)
+	for _, snapshotInfo := range snapshotsInfo {
+		decisions = append(decisions, &RetentionDecision{SnapshotInfo: snapshotInfo})
+	}
+	keep := func(decision *RetentionDecision, reason string) {
+		decision.Keep = true
+		decision.Reasons = append(decision.Reasons, reason)
+	}
+
+	for i, decision := range decisions {
+		if i < policy.KeepLast {
+			keep(decision, "last")
+		}
+	}
+
+	// like restic, every rule keeps the newest snapshot of each of its last N periods
+	bucketRules := []retentionBucketRule{
+		{"hourly", policy.KeepHourly, func(timestamp time.Time) string { return timestamp.Format("2006-01-02 15") }},
+		{"daily", policy.KeepDaily, func(timestamp time.Time) string { return timestamp.Format("2006-01-02") }},
+		{"weekly", policy.KeepWeekly, func(timestamp time.Time) string {
+			year, week := timestamp.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{"monthly", policy.KeepMonthly, func(timestamp time.Time) string { return timestamp.Format("2006-01") }},
+		{"yearly", policy.KeepYearly, func(timestamp time.Time) string { return timestamp.Format("2006") }},
+	}
+	for _, rule := range bucketRules {
+		lastBucket := ""
+		kept := 0
+		for _, decision := range decisions {
+			if kept >= rule.count {
+				break
+			}
+			bucket := rule.bucket(decision.SnapshotInfo.Timestamp.Local())
+			if bucket == lastBucket {
+				continue
+			}
+			lastBucket = bucket
+			kept++
+			keep(decision, rule.name)
+		}
+	}
+
+	if len(policy.KeepWithin) > 0 && len(decisions) > 0 {
+		within, err := utils.ParseDuration(policy.KeepWithin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keep_within: %s", err.Error())
+		}
+		// counted from the newest snapshot so that nothing is lost when snapshots stop
+		newest := decisions[0].SnapshotInfo.Timestamp
+		for _, decision := range decisions {
+			if !decision.SnapshotInfo.Timestamp.Before(newest.Add(-within)) {
+				keep(decision, "within "+policy.KeepWithin)
+			}
+		}
+	}
+
+	for _, decision := range decisions {
+		if decision.SnapshotInfo.Metadata.Pinned {
+			keep(decision, "pinned")
+		}
+		keepUntil := decision.SnapshotInfo.Metadata.KeepUntil
+		if keepUntil != nil && time.Now().Before(*keepUntil) {
+			keep(decision, "until "+keepUntil.Local().Format(time.DateTime))
+		}
+		for _, tag := range decision.SnapshotInfo.Metadata.Tags {
+			if slices.Contains(policy.KeepTagged, tag) {
+				keep(decision, "tagged "+tag)
+				break
+			}
+		}
+	}
+	return decisions, nil
+}
+
+// pruneSnapshots deletes the snapshots of one interval that the retention
+// policy does not keep. Unless dryRun, it must be called with the interval lock held.
+func pruneSnapshots(intervalConfig *structs.SnapshotConfig, dryRun bool) ([]*RetentionDecision, error) {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", intervalConfig.SnapshotName)
+	snapshotsInfo, err := listConfigSnapshots(intervalConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	decisions, err := EvaluateRetention(intervalConfig, snapshotsInfo)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
+	}
+	if dryRun {
+		return decisions, nil
+	}
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+		slog.Info(fmt.Sprintf("%s removing snapshot %s", snapshotLogPrefix, decision.SnapshotInfo.Abspath))
+		err = os.RemoveAll(decision.SnapshotInfo.Abspath)
+		if err != nil {
+			return decisions, fmt.Errorf("%s can't remove snapshot %s: %s", snapshotLogPrefix, decision.SnapshotInfo.Abspath, err.Error())
+		}
+	}
+	return decisions, nil
+}
+
+// Prune applies the retention policy of every interval of snapshotConfig.
+// With dryRun nothing is deleted and the decisions are only returned.
+func Prune(snapshotConfig *structs.SnapshotConfig, dryRun bool) (decisions []*RetentionDecision, err error) {
+	for _, interval := range snapshotConfig.Intervals {
+		intervalConfig, err := configs.GetIntervalConfig(snapshotConfig, interval.Name)
+		if err != nil {
+			return decisions, err
+		}
+		intervalDecisions, err := pruneInterval(intervalConfig, dryRun)
+		decisions = append(decisions, intervalDecisions...)
+		if err != nil {
+			return decisions, err
+		}
+	}
+	preRestoreDecisions, err := pruneInterval(getPreRestoreConfig(snapshotConfig, snapshotConfig.Dirs), dryRun)
+	return append(decisions, preRestoreDecisions...), err
+}
+
+func pruneInterval(intervalConfig *structs.SnapshotConfig, dryRun bool) ([]*RetentionDecision, error) {
+	if dryRun {
+		return pruneSnapshots(intervalConfig, true)
+	}
+	unlock, err := lockSnapshots(intervalConfig)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %s", intervalConfig.SnapshotName, err.Error())
+	}
+	defer unlock()
+	err = recoverSnapshots(intervalConfig)
+	if err != nil {
+		return nil, err
+	}
+	return pruneSnapshots(intervalConfig, false)
+}
@@ -0,0 +1,115 @@
+package snapshots
+
+import (
+	"fmt"
+	"peppeosmio/snapsync/structs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluateRetention(t *testing.T) {
+	newest := time.Date(2024, 6, 12, 12, 40, 0, 0, time.Local)
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	type snapshot struct {
+		age      time.Duration
+		metadata structs.SnapshotMetadata
+	}
+	tests := []struct {
+		name      string
+		retention int
+		policy    *structs.RetentionPolicy
+		snapshots []snapshot
+		// want holds the reasons each snapshot is kept for, empty if it is removed
+		want []string
+	}{
+		{
+			name:      "retention without a policy",
+			retention: 2,
+			snapshots: []snapshot{{age: 0}, {age: time.Hour}, {age: 2 * time.Hour}},
+			want:      []string{"last", "last", ""},
+		},
+		{
+			name:      "newest of each period",
+			policy:    &structs.RetentionPolicy{KeepHourly: 2},
+			snapshots: []snapshot{{age: 0}, {age: 30 * time.Minute}, {age: time.Hour}, {age: 2 * time.Hour}},
+			want:      []string{"hourly", "", "hourly", ""},
+		},
+		{
+			name:      "overlapping rules",
+			policy:    &structs.RetentionPolicy{KeepLast: 2, KeepDaily: 2, KeepMonthly: 1},
+			snapshots: []snapshot{{age: 0}, {age: 4 * time.Hour}, {age: 8 * time.Hour}, {age: 24 * time.Hour}, {age: 48 * time.Hour}},
+			want:      []string{"last, daily, monthly", "last", "", "daily", ""},
+		},
+		{
+			name:   "pinned and tagged",
+			policy: &structs.RetentionPolicy{KeepLast: 1, KeepTagged: []string{"release"}},
+			snapshots: []snapshot{
+				{age: 0},
+				{age: time.Hour, metadata: structs.SnapshotMetadata{Pinned: true}},
+				{age: 2 * time.Hour, metadata: structs.SnapshotMetadata{Tags: []string{"other", "release"}}},
+				{age: 3 * time.Hour, metadata: structs.SnapshotMetadata{Tags: []string{"other"}}},
+				{age: 4 * time.Hour},
+			},
+			want: []string{"last", "pinned", "tagged release", "", ""},
+		},
+		{
+			name:   "keep until",
+			policy: &structs.RetentionPolicy{},
+			snapshots: []snapshot{
+				{age: 0, metadata: structs.SnapshotMetadata{KeepUntil: &future}},
+				{age: time.Hour, metadata: structs.SnapshotMetadata{KeepUntil: &past}},
+			},
+			want: []string{"until " + future.Local().Format(time.DateTime), ""},
+		},
+		{
+			name:      "within at the boundary",
+			policy:    &structs.RetentionPolicy{KeepWithin: "1d"},
+			snapshots: []snapshot{{age: 0}, {age: 24 * time.Hour}, {age: 24*time.Hour + time.Second}},
+			want:      []string{"within 1d", "within 1d", ""},
+		},
+		{
+			name:      "no snapshots",
+			policy:    &structs.RetentionPolicy{KeepLast: 1, KeepWithin: "1d"},
+			snapshots: nil,
+			want:      nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			intervalConfig := &structs.SnapshotConfig{Retention: test.retention, RetentionPolicy: test.policy}
+			snapshotsInfo := []*structs.SnapshotInfo{}
+			for i, snapshot := range test.snapshots {
+				snapshotsInfo = append(snapshotsInfo, &structs.SnapshotInfo{
+					Abspath:   fmt.Sprintf("t.daily.%d", i),
+					Number:    i,
+					Timestamp: newest.Add(-snapshot.age),
+					Metadata:  snapshot.metadata,
+				})
+			}
+			decisions, err := EvaluateRetention(intervalConfig, snapshotsInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decisions) != len(test.want) {
+				t.Fatalf("got %d decisions, want %d", len(decisions), len(test.want))
+			}
+			for i, decision := range decisions {
+				reasons := strings.Join(decision.Reasons, ", ")
+				if decision.Keep != (len(test.want[i]) > 0) || reasons != test.want[i] {
+					t.Errorf("snapshot %d: got keep %t for %q, want %q", i, decision.Keep, reasons, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateRetentionInvalidWithin(t *testing.T) {
+	intervalConfig := &structs.SnapshotConfig{RetentionPolicy: &structs.RetentionPolicy{KeepWithin: "soon"}}
+	snapshotsInfo := []*structs.SnapshotInfo{{Abspath: "t.daily.0", Timestamp: time.Now()}}
+	_, err := EvaluateRetention(intervalConfig, snapshotsInfo)
+	if err == nil {
+		t.Error("got no error for an invalid keep_within")
+	}
+}
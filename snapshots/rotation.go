@@ -0,0 +1,355 @@
+package snapshots
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/structs"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The journal records the renames of a rotation before any of them is done.
+// It is written only when the tmp dir holds a complete snapshot, so after a
+// crash the rotation is rolled forward if the tmp dir still exists or was
+// already moved in place, and rolled back otherwise.
+type rotationJournal struct {
+	SnapshotName string           `json:"snapshot_name"`
+	Interval     string           `json:"interval"`
+	TmpDir       string           `json:"tmp_dir"`
+	Renames      []rotationRename `json:"renames"`
+}
+
+type rotationRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+var legacyTmpDirRegex = regexp.MustCompile(`^tmp[0-9]+$`)
+
+var ErrSnapshotsLocked = errors.New("another snapsync process is working on these snapshots")
+
+func getJournalPath(snapshotConfig *structs.SnapshotConfig) string {
+	return path.Join(snapshotConfig.SnapshotsDir, "."+GetSnapshotDirPrefix(snapshotConfig.SnapshotName, snapshotConfig.Interval)+"journal")
+}
+
+func getLockPath(snapshotConfig *structs.SnapshotConfig) string {
+	return path.Join(snapshotConfig.SnapshotsDir, "."+GetSnapshotDirPrefix(snapshotConfig.SnapshotName, snapshotConfig.Interval)+"lock")
+}
+
+func getTmpDirPrefix(snapshotConfig *structs.SnapshotConfig) string {
+	return ".tmp." + GetSnapshotDirPrefix(snapshotConfig.SnapshotName, snapshotConfig.Interval)
+}
+
+// lockSnapshots takes an exclusive lock on the snapshots of snapshotConfig so
+// that two processes never rotate or recover the same set at the same time.
+func lockSnapshots(snapshotConfig *structs.SnapshotConfig) (unlock func(), err error) {
+	lockPath := getLockPath(snapshotConfig)
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open lock file %s: %s", lockPath, err.Error())
+	}
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		lockFile.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrSnapshotsLocked
+		}
+		return nil, fmt.Errorf("can't lock %s: %s", lockPath, err.Error())
+	}
+	return func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+	}, nil
+}
+
+func getSnapshotsNumbers(snapshotConfig *structs.SnapshotConfig) (snapshotsNumbers []int, err error) {
+	snapshots, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read directory %s: %s", snapshotConfig.SnapshotsDir, err.Error())
+	}
+	snapshotPrefixWithNumberRegex, err := regexp.Compile(fmt.Sprintf("^%s([0-9]+)$", regexp.QuoteMeta(GetSnapshotDirPrefix(snapshotConfig.SnapshotName, snapshotConfig.Interval))))
+	if err != nil {
+		return nil, fmt.Errorf("error compiling regex: %s", err.Error())
+	}
+	for _, snapshot := range snapshots {
+		match := snapshotPrefixWithNumberRegex.FindStringSubmatch(snapshot.Name())
+		if match != nil {
+			number, err := strconv.Atoi(match[1]) // match[1] contains the first capturing group
+			if err != nil {
+				return nil, fmt.Errorf("error converting string to int: %s", err.Error())
+			}
+			snapshotsNumbers = append(snapshotsNumbers, number)
+		}
+	}
+	slices.Sort(snapshotsNumbers)
+	return snapshotsNumbers, nil
+}
+
+// rotateSnapshots shifts every snapshot number by one and moves tmpDir to .0,
+// recording the plan in the journal first.
+// With timestamp naming the only rename is tmpDir to the name for timestamp.
+func rotateSnapshots(snapshotConfig *structs.SnapshotConfig, tmpDir string, timestamp time.Time) (newestSnapshotPath string, err error) {
+	journal := &rotationJournal{
+		SnapshotName: snapshotConfig.SnapshotName,
+		Interval:     snapshotConfig.Interval,
+		TmpDir:       tmpDir,
+	}
+	if snapshotConfig.Naming == structs.NamingTimestamp {
+		newestSnapshotPath = path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirTimestampName(snapshotConfig.SnapshotName, snapshotConfig.Interval, timestamp))
+		// names have a resolution of one second, two snapshots in the same second keep their order
+		for pathExists(newestSnapshotPath) {
+			timestamp = timestamp.Add(time.Second)
+			newestSnapshotPath = path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirTimestampName(snapshotConfig.SnapshotName, snapshotConfig.Interval, timestamp))
+		}
+		journal.Renames = append(journal.Renames, rotationRename{From: tmpDir, To: newestSnapshotPath})
+		return newestSnapshotPath, commitJournal(snapshotConfig, journal)
+	}
+	snapshotsNumbers, err := getSnapshotsNumbers(snapshotConfig)
+	if err != nil {
+		return "", err
+	}
+	slices.Reverse(snapshotsNumbers)
+	for _, number := range snapshotsNumbers {
+		journal.Renames = append(journal.Renames, rotationRename{
+			From: path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName(snapshotConfig.SnapshotName, snapshotConfig.Interval, number)),
+			To:   path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName(snapshotConfig.SnapshotName, snapshotConfig.Interval, number+1)),
+		})
+	}
+	newestSnapshotPath = path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName(snapshotConfig.SnapshotName, snapshotConfig.Interval, 0))
+	journal.Renames = append(journal.Renames, rotationRename{
+		From: tmpDir,
+		To:   newestSnapshotPath,
+	})
+	return newestSnapshotPath, commitJournal(snapshotConfig, journal)
+}
+
+// commitJournal persists the journal, does its renames and removes it.
+func commitJournal(snapshotConfig *structs.SnapshotConfig, journal *rotationJournal) error {
+	err := writeJournal(getJournalPath(snapshotConfig), journal)
+	if err != nil {
+		return err
+	}
+	err = applyJournal(journal)
+	if err != nil {
+		return err
+	}
+	return removeJournal(snapshotConfig)
+}
+
+func writeJournal(journalPath string, journal *rotationJournal) error {
+	content, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't encode journal: %s", err.Error())
+	}
+	return writeFileAtomic(journalPath, content)
+}
+
+// writeFileAtomic writes content to a temporary file, syncs it and renames it
+// to filePath, so readers see either the old or the new content.
+func writeFileAtomic(filePath string, content []byte) error {
+	tmpPath := filePath + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("can't create %s: %s", tmpPath, err.Error())
+	}
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("can't write %s: %s", tmpPath, err.Error())
+	}
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		return fmt.Errorf("can't rename %s to %s: %s", tmpPath, filePath, err.Error())
+	}
+	return syncDirEntries(path.Dir(filePath))
+}
+
+func readJournal(journalPath string) (*rotationJournal, error) {
+	content, err := os.ReadFile(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	journal := &rotationJournal{}
+	err = json.Unmarshal(content, journal)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse journal %s: %s", journalPath, err.Error())
+	}
+	return journal, nil
+}
+
+func removeJournal(snapshotConfig *structs.SnapshotConfig) error {
+	journalPath := getJournalPath(snapshotConfig)
+	err := os.Remove(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't remove journal %s: %s", journalPath, err.Error())
+	}
+	return syncDirEntries(snapshotConfig.SnapshotsDir)
+}
+
+// syncDirEntries flushes renames and deletions in dirPath to disk.
+func syncDirEntries(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return fmt.Errorf("can't open %s: %s", dirPath, err.Error())
+	}
+	defer dir.Close()
+	err = dir.Sync()
+	if err != nil {
+		return fmt.Errorf("can't sync %s: %s", dirPath, err.Error())
+	}
+	return nil
+}
+
+func pathExists(filePath string) bool {
+	_, err := os.Lstat(filePath)
+	return err == nil
+}
+
+// getDoneRenames finds out which renames of the journal were already done.
+// The renames are done in order and the destination of each one is free, or
+// freed by an earlier rename, until it is done. So the done renames are the
+// ones before the first rename whose destination doesn't exist. The source
+// can't tell it: a missing tmp dir doesn't mean it was moved in place.
+func getDoneRenames(journal *rotationJournal) []bool {
+	done := make([]bool, len(journal.Renames))
+	for i, rename := range journal.Renames {
+		if !pathExists(rename.To) {
+			break
+		}
+		done[i] = true
+	}
+	return done
+}
+
+func applyJournal(journal *rotationJournal) error {
+	done := getDoneRenames(journal)
+	for i, rename := range journal.Renames {
+		if done[i] {
+			continue
+		}
+		err := os.Rename(rename.From, rename.To)
+		if err != nil {
+			return fmt.Errorf("can't move %s to %s: %s", rename.From, rename.To, err.Error())
+		}
+	}
+	return syncDirEntries(path.Dir(journal.Renames[len(journal.Renames)-1].To))
+}
+
+func rollbackJournal(journal *rotationJournal) error {
+	done := getDoneRenames(journal)
+	for i := len(journal.Renames) - 1; i >= 0; i-- {
+		if !done[i] {
+			continue
+		}
+		rename := journal.Renames[i]
+		err := os.Rename(rename.To, rename.From)
+		if err != nil {
+			return fmt.Errorf("can't move %s back to %s: %s", rename.To, rename.From, err.Error())
+		}
+	}
+	return syncDirEntries(path.Dir(journal.Renames[len(journal.Renames)-1].To))
+}
+
+// RecoverSnapshots brings the snapshots of snapshotConfig back to a
+// consistent state after a crash. It does nothing if another process holds
+// the lock, since that process is the one that owns the journal and tmp dirs.
+func RecoverSnapshots(snapshotConfig *structs.SnapshotConfig) error {
+	_, err := os.Stat(snapshotConfig.SnapshotsDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	for _, interval := range snapshotConfig.Intervals {
+		intervalConfig, err := configs.GetIntervalConfig(snapshotConfig, interval.Name)
+		if err != nil {
+			return err
+		}
+		err = recoverInterval(intervalConfig)
+		if err != nil {
+			return err
+		}
+	}
+	// the pre restore snapshots are rotated and locked apart from the intervals
+	return recoverInterval(getPreRestoreConfig(snapshotConfig, snapshotConfig.Dirs))
+}
+
+func recoverInterval(intervalConfig *structs.SnapshotConfig) error {
+	unlock, err := lockSnapshots(intervalConfig)
+	if err == ErrSnapshotsLocked {
+		slog.Debug(fmt.Sprintf("[%s] skipping recovery of %s: %s", intervalConfig.SnapshotName, intervalConfig.Interval, err.Error()))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return recoverSnapshots(intervalConfig)
+}
+
+// recoverSnapshots must be called with the lock held.
+func recoverSnapshots(snapshotConfig *structs.SnapshotConfig) error {
+	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
+	journalPath := getJournalPath(snapshotConfig)
+	journal, err := readJournal(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if journal != nil && len(journal.Renames) > 0 {
+		done := getDoneRenames(journal)
+		// journals without a tmp dir, like the naming migration, can always be rolled forward.
+		// If the tmp dir was already moved in place only removing the journal is left.
+		if done[len(done)-1] || len(journal.TmpDir) == 0 || pathExists(journal.TmpDir) {
+			slog.Warn(fmt.Sprintf("%s found an interrupted rotation, rolling it forward", snapshotLogPrefix))
+			err = applyJournal(journal)
+		} else {
+			slog.Warn(fmt.Sprintf("%s found an interrupted rotation without its new snapshot, rolling it back", snapshotLogPrefix))
+			err = rollbackJournal(journal)
+		}
+		if err != nil {
+			return fmt.Errorf("%s can't recover rotation from %s: %s", snapshotLogPrefix, journalPath, err.Error())
+		}
+	}
+	if journal != nil {
+		err = removeJournal(snapshotConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	if err != nil {
+		return fmt.Errorf("%s can't read directory %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotsDir, err.Error())
+	}
+	tmpDirPrefix := getTmpDirPrefix(snapshotConfig)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// tmpXXXX dirs were created by older versions that did not namespace them
+		if !strings.HasPrefix(entry.Name(), tmpDirPrefix) && !legacyTmpDirRegex.MatchString(entry.Name()) {
+			continue
+		}
+		staleTmpDir := path.Join(snapshotConfig.SnapshotsDir, entry.Name())
+		slog.Warn(fmt.Sprintf("%s removing stale temp directory %s", snapshotLogPrefix, staleTmpDir))
+		err = os.RemoveAll(staleTmpDir)
+		if err != nil {
+			return fmt.Errorf("%s can't remove stale temp directory %s: %s", snapshotLogPrefix, staleTmpDir, err.Error())
+		}
+	}
+	return nil
+}
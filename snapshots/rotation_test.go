@@ -0,0 +1,144 @@
+package snapshots
+
+import (
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"testing"
+)
+
+// setupInterruptedRotation creates t.daily.0 and t.daily.1, a tmp dir with the
+// new snapshot and the journal rotating them, with the first doneRenames
+// renames already done.
+func setupInterruptedRotation(t *testing.T, doneRenames int) (*structs.SnapshotConfig, *rotationJournal) {
+	t.Helper()
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 3\n")
+	getPath := func(name string) string {
+		return path.Join(snapshotConfig.SnapshotsDir, name)
+	}
+	tmpDir := getPath(getTmpDirPrefix(snapshotConfig) + "1234")
+	for name, id := range map[string]string{"t.daily.0": "old0", "t.daily.1": "old1", path.Base(tmpDir): "new"} {
+		writeTestTree(t, getPath(name), map[string]string{"id": id})
+	}
+	journal := &rotationJournal{
+		SnapshotName: snapshotConfig.SnapshotName,
+		Interval:     snapshotConfig.Interval,
+		TmpDir:       tmpDir,
+		Renames: []rotationRename{
+			{From: getPath("t.daily.1"), To: getPath("t.daily.2")},
+			{From: getPath("t.daily.0"), To: getPath("t.daily.1")},
+			{From: tmpDir, To: getPath("t.daily.0")},
+		},
+	}
+	err := writeJournal(getJournalPath(snapshotConfig), journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rename := range journal.Renames[:doneRenames] {
+		err = os.Rename(rename.From, rename.To)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return snapshotConfig, journal
+}
+
+// checkSnapshots checks the id of every snapshot and that the journal and the
+// tmp dir are gone.
+func checkSnapshots(t *testing.T, snapshotConfig *structs.SnapshotConfig, want map[string]string) {
+	t.Helper()
+	entries, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		id, err := os.ReadFile(path.Join(snapshotConfig.SnapshotsDir, entry.Name(), "id"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[entry.Name()] = string(id)
+	}
+	if len(got) != len(want) {
+		t.Errorf("got snapshots %v, want %v", got, want)
+	}
+	for name, id := range want {
+		if got[name] != id {
+			t.Errorf("%s: got %q, want %q (snapshots %v)", name, got[name], id, got)
+		}
+	}
+	if pathExists(getJournalPath(snapshotConfig)) {
+		t.Errorf("the journal was not removed")
+	}
+}
+
+func TestRecoverSnapshotsRollsForward(t *testing.T) {
+	rolledForward := map[string]string{"t.daily.0": "new", "t.daily.1": "old0", "t.daily.2": "old1"}
+	for _, doneRenames := range []int{0, 1, 2} {
+		snapshotConfig, _ := setupInterruptedRotation(t, doneRenames)
+		err := RecoverSnapshots(snapshotConfig)
+		if err != nil {
+			t.Fatalf("%d renames done: %s", doneRenames, err.Error())
+		}
+		checkSnapshots(t, snapshotConfig, rolledForward)
+	}
+}
+
+func TestRecoverSnapshotsKeepsCompletedRotation(t *testing.T) {
+	// the crash happened after the last rename, before the journal was removed
+	snapshotConfig, _ := setupInterruptedRotation(t, 3)
+	err := RecoverSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshots(t, snapshotConfig, map[string]string{"t.daily.0": "new", "t.daily.1": "old0", "t.daily.2": "old1"})
+}
+
+func TestRecoverSnapshotsRollsBackWithoutTmpDir(t *testing.T) {
+	snapshotConfig, journal := setupInterruptedRotation(t, 1)
+	err := os.RemoveAll(journal.TmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RecoverSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshots(t, snapshotConfig, map[string]string{"t.daily.0": "old0", "t.daily.1": "old1"})
+}
+
+func TestRecoverSnapshotsRemovesStaleTmpDirs(t *testing.T) {
+	snapshotConfig, journal := setupInterruptedRotation(t, 0)
+	err := removeJournal(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without a journal the tmp dir is an interrupted snapshot
+	err = RecoverSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshots(t, snapshotConfig, map[string]string{"t.daily.0": "old0", "t.daily.1": "old1"})
+	if pathExists(journal.TmpDir) {
+		t.Errorf("the stale tmp dir was not removed")
+	}
+}
+
+func TestRecoverSnapshotsRecoversPreRestore(t *testing.T) {
+	snapshotConfig, _ := setupInterruptedRotation(t, 3)
+	tmpDir := path.Join(snapshotConfig.SnapshotsDir, getTmpDirPrefix(getPreRestoreConfig(snapshotConfig, nil))+"1234")
+	err := os.Mkdir(tmpDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RecoverSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pathExists(tmpDir) {
+		t.Errorf("the stale pre restore tmp dir was not removed")
+	}
+}
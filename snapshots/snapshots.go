@@ -1,32 +1,116 @@
 package snapshots
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path"
 	"peppeosmio/snapsync/configs"
 	"peppeosmio/snapsync/structs"
 	"peppeosmio/snapsync/utils"
-	"regexp"
-	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
-func getRsyncDirsCommand(config *structs.Config, srcDir string, dstDir string, excludes []string) string {
-	rsyncExecutable := "rsync"
+func getRsyncExecutable(config *structs.Config) string {
 	if len(config.RSyncPath) > 0 {
-		rsyncExecutable = config.RSyncPath
+		return config.RSyncPath
 	}
-	excludesString := ""
-	if len(excludes) > 0 {
-		for _, exclude := range excludes {
-			excludesString += fmt.Sprintf("%s ", exclude)
+	return "rsync"
+}
+
+func getRsyncDirsArgs(srcDir string, dstDir string, excludes []string) []string {
+	// the file list of -v isn't read, --stats is parsed into SyncStats
+	args := []string{"-arLK", "--delete", "--stats"}
+	for _, exclude := range excludes {
+		args = append(args, "--exclude", exclude)
+	}
+	// "--" stops option parsing in case a path starts with a dash
+	return append(args, "--", srcDir+"/", dstDir)
+}
+
+func getRsyncFileArgs(srcPath string, dstPath string) []string {
+	return []string{"-avhLK", "--", srcPath, dstPath}
+}
+
+func getCpExecutable(config *structs.Config) string {
+	if len(config.CpPath) > 0 {
+		return config.CpPath
+	}
+	return "cp"
+}
+
+// syncDir mirrors srcDir into dstDir with the engine selected in config.
+// linkDestDir is only used by the native engine, the rsync engine relies on
+// the destination being prepopulated with hard links by cp -lra.
+func syncDir(ctx context.Context, config *structs.Config, srcDir string, dstDir string, linkDestDir string, excludes []string) (stats structs.SyncStats, err error) {
+	if config.Engine == structs.EngineRsync {
+		stdout, _, err := runCommand(ctx, getRsyncExecutable(config), getRsyncDirsArgs(srcDir, dstDir, excludes)...)
+		if err != nil {
+			return stats, err
+		}
+		return parseRsyncStats(stdout), nil
+	}
+	err = syncDirNative(ctx, srcDir, dstDir, linkDestDir, excludes, &stats)
+	return stats, err
+}
+
+// parseRsyncStats reads the output of rsync --stats. Numbers can have
+// thousands separators, or units with -h.
+func parseRsyncStats(output string) (stats structs.SyncStats) {
+	parseNumber := func(value string) int64 {
+		fields := strings.Fields(strings.ReplaceAll(value, ",", ""))
+		if len(fields) == 0 {
+			return 0
+		}
+		number, err := utils.ParseSize(fields[0])
+		if err != nil {
+			return 0
+		}
+		return number
+	}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ": ")
+		if !found {
+			continue
+		}
+		switch key {
+		case "Number of files":
+			// Number of files: 1,234 (reg: 1,000, dir: 234)
+			_, regular, found := strings.Cut(value, "reg: ")
+			if found {
+				stats.Files = parseNumber(strings.SplitN(regular, ", ", 2)[0])
+			} else {
+				stats.Files = parseNumber(value)
+			}
+		case "Number of regular files transferred":
+			stats.TransferredFiles = parseNumber(value)
+		case "Total file size":
+			stats.TotalSize = parseNumber(value)
+		case "Total transferred file size":
+			stats.TransferredSize = parseNumber(value)
 		}
 	}
-	return fmt.Sprintf("%s -avrhLK --delete --exclude \"%s\" %s/ %s", rsyncExecutable, excludesString, srcDir, dstDir)
+	return stats
+}
+
+// syncFile copies the regular file srcPath to dstPath, whose dir must exist.
+func syncFile(ctx context.Context, config *structs.Config, srcPath string, dstPath string) error {
+	if config.Engine == structs.EngineRsync {
+		_, _, err := runCommand(ctx, getRsyncExecutable(config), getRsyncFileArgs(srcPath, dstPath)...)
+		return err
+	}
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return fmt.Errorf("can't stat %s: %s", srcPath, err.Error())
+	}
+	if !srcInfo.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", srcPath)
+	}
+	_, err = syncFileNative(srcPath, dstPath, "", srcInfo)
+	return err
 }
 
 func GetSnapshotDirPrefix(snapshotName string, interval string) string {
@@ -37,141 +121,178 @@ func GetSnapshotDirName(snapshotName string, interval string, number int) string
 	return GetSnapshotDirPrefix(snapshotName, interval) + strconv.Itoa(number)
 }
 
-func executeOnlySnapshot(config *structs.Config, snapshotConfig *structs.SnapshotConfig) error {
+// executeOnlySnapshot syncs the sources into a new snapshot and returns its
+// path. The snapshot gets metadata, completed with its end time and status.
+// When ctx is canceled the sync stops and the tmp dir is removed.
+func executeOnlySnapshot(ctx context.Context, config *structs.Config, snapshotConfig *structs.SnapshotConfig, metadata structs.SnapshotMetadata) (snapshotPath string, err error) {
 	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
 	before := time.Now().UnixMilli()
-	newestSnapshotPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName(snapshotConfig.SnapshotName, snapshotConfig.Interval, 0))
-	slog.Debug(snapshotLogPrefix + "Checking if " + newestSnapshotPath + " exists")
-	err := os.MkdirAll(snapshotConfig.SnapshotsDir, 0700)
+	err = os.MkdirAll(snapshotConfig.SnapshotsDir, 0700)
 	if err != nil {
-		return fmt.Errorf("%s can't create snapshot dir %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotsDir, err.Error())
+		return "", fmt.Errorf("%s can't create snapshot dir %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotsDir, err.Error())
 	}
-	tmpDir, mkdirErr := os.MkdirTemp(snapshotConfig.SnapshotsDir, "tmp")
+	unlock, err := lockSnapshots(snapshotConfig)
+	if err != nil {
+		return "", fmt.Errorf("%s %w", snapshotLogPrefix, err)
+	}
+	defer unlock()
+	err = recoverSnapshots(snapshotConfig)
+	if err != nil {
+		return "", err
+	}
+	tmpDir, mkdirErr := os.MkdirTemp(snapshotConfig.SnapshotsDir, getTmpDirPrefix(snapshotConfig))
 	// in case of errors be sure to remove the tmp directory to avoid creating junk
 	defer os.RemoveAll(tmpDir)
 	if mkdirErr != nil {
-		return fmt.Errorf("%s can't create tmp dir %s: %s", snapshotLogPrefix, tmpDir, mkdirErr.Error())
+		return "", fmt.Errorf("%s can't create tmp dir %s: %s", snapshotLogPrefix, tmpDir, mkdirErr.Error())
+	}
+	existingSnapshots, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
 	}
-	_, err = os.Stat(newestSnapshotPath)
-	// if the snapshot 0 already exists, copy it with hard links into the tmp dir
-	if err == nil {
+	newestSnapshotExists := len(existingSnapshots) > 0
+	newestSnapshotPath := ""
+	if newestSnapshotExists {
+		newestSnapshotPath = existingSnapshots[0].Abspath
+	}
+	// if there is already a snapshot, the rsync engine needs it copied with hard links into the tmp dir.
+	// The native engine hard links unchanged files by itself while synching.
+	if newestSnapshotExists && config.Engine == structs.EngineRsync {
 		slog.Debug(snapshotLogPrefix + "Copying latest snapshot...")
-		cpCommand := fmt.Sprintf("%s -lra %s/./ %s", config.CpPath, newestSnapshotPath, tmpDir)
-		_, cpErr := exec.Command("sh", "-c", cpCommand).Output()
+		_, _, cpErr := runCommand(ctx, getCpExecutable(config), "-lra", "--", newestSnapshotPath+"/.", tmpDir)
 		if cpErr != nil {
-			return fmt.Errorf("%s error copying last snapshot %s to %s: %s", snapshotLogPrefix, newestSnapshotPath, tmpDir, cpErr.Error())
+			return "", fmt.Errorf("%s error copying last snapshot %s to %s: %s", snapshotLogPrefix, newestSnapshotPath, tmpDir, cpErr.Error())
 		}
-	} else if os.IsNotExist(err) {
-		slog.Debug(snapshotLogPrefix + "Creating first snapshot " + newestSnapshotPath)
-	} else {
-		return fmt.Errorf("%s can't stat %s: %s", newestSnapshotPath, snapshotLogPrefix, err.Error())
+	} else if !newestSnapshotExists {
+		slog.Debug(snapshotLogPrefix + "Creating first snapshot")
+	}
+	// the snapshot is named and dated after its start, before the pre snapshot commands
+	createdAt := metadata.StartedAt
+	os.Chtimes(tmpDir, createdAt, createdAt)
+	metadata.Host, _ = os.Hostname()
+	metadata.Version = utils.GetVersion()
+	metadata.ConfigHash, err = getConfigHash(snapshotConfig)
+	if err != nil {
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
 	}
-	now := time.Now()
-	os.Chtimes(tmpDir, now, now)
 
 	for _, dirToSnapshot := range snapshotConfig.Dirs {
+		dstDirFull := path.Join(tmpDir, dirToSnapshot.DstDirInSnapshot)
+		linkDestDir := ""
+		if newestSnapshotExists {
+			linkDestDir = path.Join(newestSnapshotPath, dirToSnapshot.DstDirInSnapshot)
+		}
+		dirRun := structs.DirRun{SrcDirAbspath: dirToSnapshot.SrcDirAbspath, DstDirInSnapshot: dirToSnapshot.DstDirInSnapshot}
+		dirBefore := time.Now()
 		_, err = os.Stat(dirToSnapshot.SrcDirAbspath)
 		if os.IsNotExist(err) {
 			slog.Warn(snapshotLogPrefix + "Source directory " + dirToSnapshot.SrcDirAbspath + " does not exist.")
+			dirRun.Missing = true
+			metadata.Dirs = append(metadata.Dirs, dirRun)
+			// keep the previous copy like the rsync engine does after cp -lra
+			if config.Engine == structs.EngineNative && len(linkDestDir) > 0 {
+				err = linkTreeNative(linkDestDir, dstDirFull)
+				if err != nil {
+					return "", fmt.Errorf("%s can't keep previous copy of %s: %s", snapshotLogPrefix, dirToSnapshot.SrcDirAbspath, err.Error())
+				}
+			}
 			continue
 		}
-		dstDirFull := path.Join(tmpDir, dirToSnapshot.DstDirInSnapshot)
 		_, err = os.Stat(dstDirFull)
 		if os.IsNotExist(err) {
 			err = os.MkdirAll(dstDirFull, 0700)
 			if err != nil {
-				return fmt.Errorf("%s can't create destination dir %s", snapshotLogPrefix, dstDirFull)
+				return "", fmt.Errorf("%s can't create destination dir %s", snapshotLogPrefix, dstDirFull)
 			}
 		}
-		rsyncCommand := getRsyncDirsCommand(config, dirToSnapshot.SrcDirAbspath, dstDirFull, dirToSnapshot.Excludes)
 		slog.Debug(snapshotLogPrefix + "Synching dir " + dirToSnapshot.SrcDirAbspath + "/ to " + dstDirFull)
-		slog.Debug(fmt.Sprintf("Running %s", rsyncCommand))
-		_, err := exec.Command("sh", "-c", rsyncCommand).Output()
+		dirRun.SyncStats, err = syncDir(ctx, config, dirToSnapshot.SrcDirAbspath, dstDirFull, linkDestDir, dirToSnapshot.Excludes)
 		if err != nil {
-			return fmt.Errorf("%s can't sync %s/ to %s: %s", snapshotLogPrefix, dirToSnapshot.SrcDirAbspath, dstDirFull, err.Error())
+			return "", fmt.Errorf("%s can't sync %s/ to %s: %s", snapshotLogPrefix, dirToSnapshot.SrcDirAbspath, dstDirFull, err.Error())
 		}
+		dirRun.DurationSeconds = time.Since(dirBefore).Seconds()
+		metadata.Dirs = append(metadata.Dirs, dirRun)
 	}
-
-	// rename all the snapshots
-	snapshotsNumbers := []int{}
-	snapshots, err := os.ReadDir(snapshotConfig.SnapshotsDir)
-	if err != nil {
-		return fmt.Errorf("%s can't read directory %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotName, err.Error())
-	}
-	snapshotPrefixWithNumberRegex, err := regexp.Compile(fmt.Sprintf("^%s([0-9]+)$", regexp.QuoteMeta(GetSnapshotDirPrefix(snapshotConfig.SnapshotName, snapshotConfig.Interval))))
-	if err != nil {
-		return fmt.Errorf("%s error compiling regex: %s", snapshotLogPrefix, err.Error())
-	}
-	for _, snapshot := range snapshots {
-		match := snapshotPrefixWithNumberRegex.FindStringSubmatch(snapshot.Name())
-		if match != nil {
-			number, err := strconv.Atoi(match[1]) // match[1] contains the first capturing group
-			if err != nil {
-				return fmt.Errorf("%s error converting string to int: %s", snapshotLogPrefix, err.Error())
-			}
-			snapshotsNumbers = append(snapshotsNumbers, number)
+	// cp -lra, or a dir snapshotted at the root, brings along the metadata of the previous snapshot
+	for _, snapsyncFilePath := range []string{getMetadataPath(tmpDir), getIndexPath(tmpDir)} {
+		err = os.Remove(snapsyncFilePath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("%s can't remove previous %s: %s", snapshotLogPrefix, snapsyncFilePath, err.Error())
 		}
 	}
-	slices.Sort(snapshotsNumbers)
-	slices.Reverse(snapshotsNumbers)
-	for _, number := range snapshotsNumbers {
-		snapshotOldName := GetSnapshotDirName(snapshotConfig.SnapshotName, snapshotConfig.Interval, number)
-		snapshotOldPath := path.Join(snapshotConfig.SnapshotsDir, snapshotOldName)
-		snapshotRenamedName := GetSnapshotDirName(snapshotConfig.SnapshotName, snapshotConfig.Interval, number+1)
-		snapshotRenamedPath := path.Join(snapshotConfig.SnapshotsDir, snapshotRenamedName)
-		err = os.Rename(snapshotOldPath, snapshotRenamedPath)
-		if err != nil {
-			return fmt.Errorf("%s can't move %s to %s: %s", snapshotLogPrefix, snapshotOldPath, snapshotOldPath, err.Error())
-		}
+	// the index only speeds up searches, a snapshot without it is still complete
+	err = writeSnapshotIndex(tmpDir)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("%s can't index %s: %s", snapshotLogPrefix, tmpDir, err.Error()))
 	}
 
-	// rename the temporary folder to be the newest snapshot
-	err = os.Rename(tmpDir, newestSnapshotPath)
+	metadata.FinishedAt = time.Now()
+	metadata.Status = structs.SnapshotStatusSuccess
+	err = writeSnapshotMetadata(tmpDir, &metadata)
 	if err != nil {
-		return fmt.Errorf("%s can't rename temp directory %s to %s: %s", snapshotLogPrefix, tmpDir, newestSnapshotPath, err.Error())
+		return "", fmt.Errorf("%s %s", snapshotLogPrefix, err.Error())
 	}
 
-	// delete the excess amount of snapshots
-	snapshots, err = os.ReadDir(snapshotConfig.SnapshotsDir)
+	// rename all the snapshots and the temporary folder to be the newest snapshot
+	snapshotPath, err = rotateSnapshots(snapshotConfig, tmpDir, createdAt)
 	if err != nil {
-		return fmt.Errorf("%s can't read directory %s: %s", snapshotLogPrefix, snapshotConfig.SnapshotsDir, err.Error())
+		return "", fmt.Errorf("%s can't rotate snapshots: %s", snapshotLogPrefix, err.Error())
 	}
-	for _, snapshotEntry := range snapshots {
-		snapshotInfo, err := utils.GetInfoFromSnapshotPath(snapshotEntry.Name())
-		if err != nil {
-			return err
-		}
-		if snapshotInfo.Number >= snapshotConfig.Retention {
-			snapshotToRemoveName := GetSnapshotDirName(snapshotConfig.SnapshotName, snapshotConfig.Interval, snapshotInfo.Number)
-			snapshotToRemovePath := path.Join(snapshotConfig.SnapshotsDir, snapshotToRemoveName)
-			err = os.RemoveAll(snapshotToRemovePath)
-			if err != nil {
-				return fmt.Errorf("%s can't remove snapshot %s: %s", snapshotLogPrefix, snapshotToRemovePath, err.Error())
-			}
-		}
+
+	_, err = pruneSnapshots(snapshotConfig, false)
+	if err != nil {
+		return snapshotPath, err
 	}
 
 	after := time.Now().UnixMilli()
 	seconds := float64(after-before) / 1000
 	slog.Info(fmt.Sprintf("%s snapshots done in %.2f s", snapshotLogPrefix, seconds))
-	return nil
+	return snapshotPath, nil
+}
+
+// SnapshotOptions are the settings of a snapshot taken on demand
+type SnapshotOptions struct {
+	Note string
+	Tags []string
+	// SkipHooks doesn't run the pre and post snapshot commands
+	SkipHooks bool
 }
 
-func ExecuteSnapshot(config *structs.Config, snapshotConfig *structs.SnapshotConfig) error {
+// postSnapshotCommandsTimeout bounds the post snapshot commands, which are not
+// canceled with the snapshot
+const postSnapshotCommandsTimeout = 5 * time.Minute
+
+// ExecuteSnapshot runs the pre snapshot commands, takes a snapshot and runs the
+// post snapshot commands. The path of the snapshot is returned whenever it was
+// taken, even if a later step fails.
+func ExecuteSnapshot(ctx context.Context, config *structs.Config, snapshotConfig *structs.SnapshotConfig, options SnapshotOptions) (string, error) {
 	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
-	before := time.Now().UnixMilli()
+	metadata := structs.SnapshotMetadata{StartedAt: time.Now(), Note: options.Note, Tags: options.Tags}
+	before := metadata.StartedAt.UnixMilli()
+	// refuse to start a snapshot that can't fit, before the hooks do any work
+	if hasSpaceBudget(snapshotConfig) {
+		err := checkSpaceBudget(snapshotConfig)
+		if err != nil {
+			return "", fmt.Errorf("refusing to start snapshot: %w", err)
+		}
+	}
+	if options.SkipHooks {
+		slog.Info(fmt.Sprintf("%s skipping pre and post snapshot commands", snapshotLogPrefix))
+		withoutHooks := *snapshotConfig
+		withoutHooks.PreSnapshotCommands = nil
+		withoutHooks.PostSnapshotCommands = nil
+		snapshotConfig = &withoutHooks
+	}
 	if len(snapshotConfig.PreSnapshotCommands) > 0 {
 		slog.Info(fmt.Sprintf("%s executing pre snapshot commands", snapshotLogPrefix))
 		for _, command := range snapshotConfig.PreSnapshotCommands {
 			slog.Info(snapshotLogPrefix + " " + command)
-			result, err := exec.Command("sh", "-c", command).Output()
+			hookRun, err := runHook(ctx, config, structs.HookPhasePre, command)
 			if err != nil {
-				fmt.Println(snapshotLogPrefix + command + ": " + err.Error())
-				return err
-			}
-			if len(result) > 0 {
-				slog.Info(snapshotLogPrefix + command + ": " + string(result))
+				return "", fmt.Errorf("%s %s: %s", snapshotLogPrefix, command, err.Error())
 			}
+			logHookOutput(snapshotLogPrefix, hookRun)
+			metadata.Hooks = append(metadata.Hooks, hookRun)
 		}
 		after := time.Now().UnixMilli()
 		seconds := float64(after-before) / 1000
@@ -180,33 +301,71 @@ func ExecuteSnapshot(config *structs.Config, snapshotConfig *structs.SnapshotCon
 		slog.Info(fmt.Sprintf("%s no pre snapshot commands to run", snapshotLogPrefix))
 	}
 
-	err := executeOnlySnapshot(config, snapshotConfig)
-	if err != nil && !snapshotConfig.AlwaysRunPostSnapshotCommands {
-		return err
+	snapshotPath, snapshotErr := executeOnlySnapshot(ctx, config, snapshotConfig, metadata)
+	if snapshotErr != nil && !snapshotConfig.AlwaysRunPostSnapshotCommands {
+		return snapshotPath, snapshotErr
+	}
+	if snapshotErr == nil {
+		budgetErr := enforceSpaceBudget(snapshotConfig, 0)
+		if budgetErr != nil {
+			slog.Warn(budgetErr.Error())
+		}
 	}
 
+	var postHooks []structs.HookRun
 	if len(snapshotConfig.PostSnapshotCommands) > 0 {
 		slog.Info(fmt.Sprintf("%s executing post snapshot commands", snapshotLogPrefix))
+		// they undo what the pre snapshot commands did, like stopping a service,
+		// so they run even if the daemon is stopping
+		postCtx, cancelPost := context.WithTimeout(context.WithoutCancel(ctx), postSnapshotCommandsTimeout)
+		defer cancelPost()
 		for _, command := range snapshotConfig.PostSnapshotCommands {
 			slog.Info(fmt.Sprintf("%s %s", snapshotLogPrefix, command))
-			result, err := exec.Command("sh", "-c", command).Output()
+			hookRun, err := runHook(postCtx, config, structs.HookPhasePost, command)
+			postHooks = append(postHooks, hookRun)
 			if err != nil {
-				return fmt.Errorf("%s %s: %s", snapshotLogPrefix, command, err.Error())
-			}
-			if len(result) > 0 {
-				slog.Info(snapshotLogPrefix + command + ": " + string(result))
+				if len(snapshotPath) > 0 {
+					metadataErr := updateSnapshotMetadata(snapshotPath, func(metadata *structs.SnapshotMetadata) {
+						metadata.FinishedAt = time.Now()
+						metadata.Status = structs.SnapshotStatusPostCommandsFailed
+						metadata.Hooks = append(metadata.Hooks, postHooks...)
+					})
+					if metadataErr != nil {
+						slog.Warn(snapshotLogPrefix + " " + metadataErr.Error())
+					}
+				}
+				return snapshotPath, fmt.Errorf("%s %s: %s", snapshotLogPrefix, command, err.Error())
 			}
+			logHookOutput(snapshotLogPrefix, hookRun)
 		}
 		after := time.Now().UnixMilli()
 		seconds := float64(after-before) / 1000
 		slog.Info(fmt.Sprintf("%s post snapshot commands done in %.2f s", snapshotLogPrefix, seconds))
 	} else {
-		slog.Info(fmt.Sprintf("%s no pre snapshot commands to run", snapshotLogPrefix))
+		slog.Info(fmt.Sprintf("%s no post snapshot commands to run", snapshotLogPrefix))
+	}
+	// the post snapshot commands ran anyway, the snapshot still failed
+	if snapshotErr != nil {
+		return snapshotPath, snapshotErr
+	}
+
+	err := updateSnapshotMetadata(snapshotPath, func(metadata *structs.SnapshotMetadata) {
+		metadata.FinishedAt = time.Now()
+		metadata.Hooks = append(metadata.Hooks, postHooks...)
+	})
+	if err != nil {
+		slog.Warn(snapshotLogPrefix + " " + err.Error())
 	}
+	return snapshotPath, nil
+}
 
-	now := time.Now()
-	os.Chtimes(GetSnapshotDirName(snapshotConfig.SnapshotName, snapshotConfig.Interval, 0), now, now)
-	return nil
+func logHookOutput(snapshotLogPrefix string, hookRun structs.HookRun) {
+	if len(hookRun.Stdout) > 0 {
+		slog.Info(snapshotLogPrefix + " " + hookRun.Command + ": " + hookRun.Stdout)
+	}
+	if len(hookRun.Stderr) > 0 {
+		slog.Warn(snapshotLogPrefix + " " + hookRun.Command + ": " + hookRun.Stderr)
+	}
 }
 
 func GetSnapshotsInfo(configsDir string, expandVars bool, snapshotName string) (snapshotsInfo []*structs.SnapshotInfo, err error) {
@@ -223,39 +382,9 @@ func GetSnapshotsInfo(configsDir string, expandVars bool, snapshotName string) (
 		slog.Info("No snapshots found for " + snapshotName)
 		return snapshotsInfo, nil
 	}
-	snapshotsDirsEntries, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	snapshotsInfo, err = listSnapshots(snapshotConfig.SnapshotsDir, snapshotConfig.SnapshotName, "")
 	if err != nil {
 		return snapshotsInfo, fmt.Errorf("can't list snapshot of %s: %s", snapshotName, err.Error())
 	}
-	for _, entry := range snapshotsDirsEntries {
-		snapshotFullPath := path.Join(snapshotConfig.SnapshotsDir, entry.Name())
-		_, err := os.Stat(snapshotFullPath)
-		if err != nil {
-			return snapshotsInfo, fmt.Errorf("can't stat %s: %s", snapshotFullPath, err.Error())
-		}
-		snapshotInfo, err := utils.GetInfoFromSnapshotPath(path.Join(snapshotConfig.SnapshotsDir, entry.Name()))
-		if err != nil {
-			return snapshotsInfo, fmt.Errorf("can't parse snapshot name: %s", err.Error())
-		}
-		snapshotsInfo = append(snapshotsInfo, snapshotInfo)
-	}
 	return snapshotsInfo, nil
 }
-
-func RestoreSnapshot(config *structs.Config, snapshotInfo *structs.SnapshotInfo, snapshotConfig *structs.SnapshotConfig) (err error) {
-	snapshotLogPrefix := fmt.Sprintf("[%s]", snapshotConfig.SnapshotName)
-	for _, dir := range snapshotConfig.Dirs {
-		err = os.MkdirAll(dir.SrcDirAbspath, 0700)
-		if err != nil {
-			return fmt.Errorf("can't create directory %s: %s", dir.SrcDirAbspath, err.Error())
-		}
-		snapshottedDirPath := path.Join(snapshotInfo.Abspath, dir.DstDirInSnapshot)
-		rsyncCommand := getRsyncDirsCommand(config, snapshottedDirPath, dir.SrcDirAbspath, nil)
-		slog.Debug(rsyncCommand)
-		_, err = exec.Command("sh", "-c", rsyncCommand).Output()
-		if err != nil {
-			slog.Error(fmt.Sprintf("%s can't sync %s/ to %s: %s", snapshotLogPrefix, snapshottedDirPath, dir.SrcDirAbspath, err.Error()))
-		}
-	}
-	return err
-}
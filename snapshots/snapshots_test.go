@@ -0,0 +1,119 @@
+package snapshots
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExecuteSnapshotReturnsErrorAfterPostSnapshotCommands(t *testing.T) {
+	markerPath := path.Join(t.TempDir(), "post")
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+always_run_post_snapshot_commands: true
+post_snapshot_commands:
+  - touch %s
+`, markerPath))
+	// the snapshots dir can't be created under a file
+	notADir := path.Join(t.TempDir(), "file")
+	writeTestTree(t, path.Dir(notADir), map[string]string{"file": ""})
+	snapshotConfig.SnapshotsDir = path.Join(notADir, "snapshots")
+	_, err := ExecuteSnapshot(context.Background(), &structs.Config{Engine: structs.EngineNative}, snapshotConfig, SnapshotOptions{})
+	if err == nil {
+		t.Error("got no error from the failed snapshot")
+	}
+	if _, statErr := os.Stat(markerPath); statErr != nil {
+		t.Errorf("the post snapshot commands didn't run: %s", statErr.Error())
+	}
+}
+
+func TestExecuteSnapshotOptions(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "content"})
+	markerPath := path.Join(t.TempDir(), "pre")
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+pre_snapshot_commands:
+  - touch %s
+`, srcDir, markerPath))
+	options := SnapshotOptions{Note: "before the upgrade", Tags: []string{"upgrade"}, SkipHooks: true}
+	snapshotPath, err := ExecuteSnapshot(context.Background(), &structs.Config{Engine: structs.EngineNative}, snapshotConfig, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pathExists(markerPath) {
+		t.Error("the pre snapshot commands ran")
+	}
+	metadata, err := readSnapshotMetadata(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Note != options.Note || !slices.Equal(metadata.Tags, options.Tags) || len(metadata.Hooks) > 0 {
+		t.Errorf("got %+v", metadata)
+	}
+}
+
+func TestExecuteSnapshotCanceled(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "content"})
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 3
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+`, srcDir))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ExecuteSnapshot(ctx, &structs.Config{Engine: structs.EngineNative}, snapshotConfig, SnapshotOptions{})
+	if err == nil {
+		t.Fatal("got no error from a canceled snapshot")
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshotsInfo) > 0 {
+		t.Errorf("the canceled snapshot %s was kept", snapshotsInfo[0].Abspath)
+	}
+	entries, err := os.ReadDir(snapshotConfig.SnapshotsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".tmp") {
+			t.Errorf("the tmp dir %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestPostSnapshotCommandsRunWhenCanceled(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestTree(t, srcDir, map[string]string{"file": "content"})
+	markerPath := path.Join(t.TempDir(), "post")
+	snapshotConfig := newTestSnapshotConfig(t, fmt.Sprintf(`interval: daily
+retention: 2
+dirs:
+  - src_dir_abspath: %s
+    dst_dir_in_snapshot: src
+always_run_post_snapshot_commands: true
+post_snapshot_commands:
+  - touch %s
+`, srcDir, markerPath))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ExecuteSnapshot(ctx, &structs.Config{Engine: structs.EngineNative}, snapshotConfig, SnapshotOptions{})
+	if err == nil {
+		t.Errorf("the canceled snapshot succeeded")
+	}
+	if !pathExists(markerPath) {
+		t.Errorf("the post snapshot command didn't run")
+	}
+}
@@ -0,0 +1,268 @@
+package snapshots
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"peppeosmio/snapsync/structs"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+type inodeUsage struct {
+	bytes int64
+	// refs counts the snapshots that contain the inode
+	refs int
+}
+
+// usageIndex tracks which inodes every snapshot contains, so that the space
+// freed by deleting a snapshot can be known without walking the tree again.
+// A file hard linked across snapshots only takes space once.
+type usageIndex struct {
+	inodes         map[inodeKey]*inodeUsage
+	snapshotInodes map[string][]inodeKey
+	apparent       map[string]int64
+	total          int64
+}
+
+func newUsageIndex() *usageIndex {
+	return &usageIndex{
+		inodes:         map[inodeKey]*inodeUsage{},
+		snapshotInodes: map[string][]inodeKey{},
+		apparent:       map[string]int64{},
+	}
+}
+
+// getDiskBytes returns the space used on disk by a file, which can be less
+// than its size for sparse files.
+func getDiskBytes(info fs.FileInfo) (key inodeKey, bytes int64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return key, info.Size(), false
+	}
+	return inodeKey{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, stat.Blocks * 512, true
+}
+
+func (index *usageIndex) addTree(treePath string) error {
+	if _, ok := index.snapshotInodes[treePath]; ok {
+		return nil
+	}
+	seen := map[inodeKey]bool{}
+	keys := []inodeKey{}
+	apparent := int64(0)
+	err := filepath.WalkDir(treePath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			apparent += info.Size()
+		}
+		key, bytes, ok := getDiskBytes(info)
+		if !ok {
+			index.total += bytes
+			return nil
+		}
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		keys = append(keys, key)
+		usage, ok := index.inodes[key]
+		if !ok {
+			usage = &inodeUsage{bytes: bytes}
+			index.inodes[key] = usage
+			index.total += bytes
+		}
+		usage.refs++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't walk %s: %s", treePath, err.Error())
+	}
+	index.snapshotInodes[treePath] = keys
+	index.apparent[treePath] = apparent
+	return nil
+}
+
+// remove forgets treePath and returns the bytes that deleting it frees.
+func (index *usageIndex) remove(treePath string) (freed int64) {
+	for _, key := range index.snapshotInodes[treePath] {
+		usage := index.inodes[key]
+		usage.refs--
+		if usage.refs == 0 {
+			freed += usage.bytes
+			delete(index.inodes, key)
+		}
+	}
+	delete(index.snapshotInodes, treePath)
+	index.total -= freed
+	return freed
+}
+
+// diskBytes returns the bytes used by treePath, shared or not.
+func (index *usageIndex) diskBytes(treePath string) (bytes int64) {
+	for _, key := range index.snapshotInodes[treePath] {
+		bytes += index.inodes[key].bytes
+	}
+	return bytes
+}
+
+// exclusiveBytes returns the bytes used only by treePath.
+func (index *usageIndex) exclusiveBytes(treePath string) (bytes int64) {
+	for _, key := range index.snapshotInodes[treePath] {
+		if usage := index.inodes[key]; usage.refs == 1 {
+			bytes += usage.bytes
+		}
+	}
+	return bytes
+}
+
+// newSnapshotsUsageIndex indexes the given snapshots only, so that the other
+// configs sharing the snapshots dir don't count.
+func newSnapshotsUsageIndex(snapshotsInfo []*structs.SnapshotInfo) (*usageIndex, error) {
+	index := newUsageIndex()
+	for _, snapshotInfo := range snapshotsInfo {
+		err := index.addTree(snapshotInfo.Abspath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// getFreeSpace returns the bytes available to unprivileged users and the
+// total size of the filesystem that holds dirPath.
+func getFreeSpace(dirPath string) (free int64, total int64, err error) {
+	stat := syscall.Statfs_t{}
+	err = syscall.Statfs(dirPath, &stat)
+	if err != nil {
+		return 0, 0, fmt.Errorf("can't get free space of %s: %s", dirPath, err.Error())
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), nil
+}
+
+// setUsageCache is stored in the snapshots dir and holds the usage of all the
+// snapshots of a config, valid as long as the set has the same fingerprint.
+type setUsageCache struct {
+	SetFingerprint string `json:"set_fingerprint"`
+	Total          int64  `json:"total"`
+}
+
+func getSetUsageCachePath(snapshotConfig *structs.SnapshotConfig) string {
+	return path.Join(snapshotConfig.SnapshotsDir, "."+snapshotConfig.SnapshotName+".usage.json")
+}
+
+// getSetFingerprint identifies a set of snapshots. Numbered snapshots keep
+// their names when rotated, so the inode and the creation time of every
+// snapshot dir are part of it too.
+func getSetFingerprint(snapshotsInfo []*structs.SnapshotInfo) string {
+	lines := []string{}
+	for _, snapshotInfo := range snapshotsInfo {
+		var inode uint64
+		info, err := os.Stat(snapshotInfo.Abspath)
+		if err == nil {
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				inode = stat.Ino
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s %d %d", path.Base(snapshotInfo.Abspath), inode, snapshotInfo.Timestamp.UnixNano()))
+	}
+	slices.Sort(lines)
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(hash[:8])
+}
+
+// GetSnapshotsUsage fills the Size metadata of every snapshot of snapshotConfig
+// and returns the space used on disk by all of them together. Results are
+// cached in the metadata, and only computed again when snapshots are added or
+// removed.
+func GetSnapshotsUsage(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo) (total int64, err error) {
+	fingerprint := getSetFingerprint(snapshotsInfo)
+	cachePath := getSetUsageCachePath(snapshotConfig)
+	cache := setUsageCache{}
+	content, err := os.ReadFile(cachePath)
+	if err == nil && json.Unmarshal(content, &cache) == nil && cache.SetFingerprint == fingerprint {
+		cached := true
+		for _, snapshotInfo := range snapshotsInfo {
+			if snapshotInfo.Metadata.Size == nil || snapshotInfo.Metadata.Size.SetFingerprint != fingerprint {
+				cached = false
+				break
+			}
+		}
+		if cached {
+			return cache.Total, nil
+		}
+	}
+
+	index, err := newSnapshotsUsageIndex(snapshotsInfo)
+	if err != nil {
+		return 0, err
+	}
+	for _, snapshotInfo := range snapshotsInfo {
+		snapshotInfo.Metadata.Size = &structs.SnapshotSize{
+			Apparent:       index.apparent[snapshotInfo.Abspath],
+			Disk:           index.diskBytes(snapshotInfo.Abspath),
+			Exclusive:      index.exclusiveBytes(snapshotInfo.Abspath),
+			SetFingerprint: fingerprint,
+		}
+	}
+	cacheSnapshotsSizes(snapshotConfig, snapshotsInfo)
+	content, err = json.Marshal(setUsageCache{SetFingerprint: fingerprint, Total: index.total})
+	if err == nil {
+		err = writeFileAtomic(cachePath, content)
+	}
+	if err != nil {
+		slog.Debug("Can't cache snapshots usage: " + err.Error())
+	}
+	return index.total, nil
+}
+
+// cacheSnapshotsSizes writes the Size of snapshotsInfo into their metadata
+// files, leaving the rest of the metadata as it is on disk. The snapshots were
+// listed before the slow walk, so each interval is locked and the snapshots
+// rotated in the meantime are skipped. The cache is best effort, a read only
+// snapshots dir still gets its sizes.
+func cacheSnapshotsSizes(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo) {
+	intervalsSnapshots := map[string][]*structs.SnapshotInfo{}
+	for _, snapshotInfo := range snapshotsInfo {
+		intervalsSnapshots[snapshotInfo.Interval] = append(intervalsSnapshots[snapshotInfo.Interval], snapshotInfo)
+	}
+	for interval, intervalSnapshots := range intervalsSnapshots {
+		intervalConfig := *snapshotConfig
+		intervalConfig.Interval = interval
+		unlock, err := lockSnapshots(&intervalConfig)
+		if err != nil {
+			slog.Debug(fmt.Sprintf("Can't cache snapshot sizes of %s: %s", interval, err.Error()))
+			continue
+		}
+		for _, snapshotInfo := range intervalSnapshots {
+			err = checkSnapshotUnchanged(snapshotInfo)
+			if err == nil {
+				size := *snapshotInfo.Metadata.Size
+				err = updateSnapshotMetadata(snapshotInfo.Abspath, func(metadata *structs.SnapshotMetadata) {
+					metadata.Size = &size
+				})
+			}
+			if err != nil {
+				slog.Debug("Can't cache snapshot size: " + err.Error())
+			}
+		}
+		unlock()
+	}
+}
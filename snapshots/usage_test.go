@@ -0,0 +1,112 @@
+package snapshots
+
+import (
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"testing"
+	"time"
+)
+
+func TestGetSnapshotsUsageOnlyWritesSize(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 3\n")
+	snapshotPath := path.Join(snapshotConfig.SnapshotsDir, "t.daily.0")
+	writeTestTree(t, snapshotPath, map[string]string{"file": "1234"})
+	startedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	err := writeSnapshotMetadata(snapshotPath, &structs.SnapshotMetadata{StartedAt: startedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pinned by another process after the snapshots were listed
+	err = updateSnapshotMetadata(snapshotPath, func(metadata *structs.SnapshotMetadata) {
+		metadata.Pinned = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetSnapshotsUsage(snapshotConfig, snapshotsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := readSnapshotMetadata(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.Pinned || !metadata.StartedAt.Equal(startedAt) || metadata.Size == nil {
+		t.Errorf("got %+v, want the pin and start time kept and the size cached", metadata)
+	}
+}
+
+func TestGetSnapshotsUsageSkipsRotatedSnapshots(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 3\n")
+	snapshotPath := path.Join(snapshotConfig.SnapshotsDir, "t.daily.0")
+	writeTestTree(t, snapshotPath, map[string]string{"file": "1234"})
+	oldStartedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	err := writeSnapshotMetadata(snapshotPath, &structs.SnapshotMetadata{StartedAt: oldStartedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a rotation puts another snapshot at the listed path
+	err = os.Rename(snapshotPath, path.Join(snapshotConfig.SnapshotsDir, "t.daily.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestTree(t, snapshotPath, map[string]string{"file": "12345678"})
+	newStartedAt := time.Now().UTC().Truncate(time.Second)
+	err = writeSnapshotMetadata(snapshotPath, &structs.SnapshotMetadata{StartedAt: newStartedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetSnapshotsUsage(snapshotConfig, snapshotsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := readSnapshotMetadata(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.StartedAt.Equal(newStartedAt) || metadata.Size != nil {
+		t.Errorf("the new snapshot got the metadata of the rotated one: %+v", metadata)
+	}
+}
+
+func TestGetSetFingerprintChangesWhenSnapshotsRotate(t *testing.T) {
+	snapshotConfig := newTestSnapshotConfig(t, "interval: daily\nretention: 2\n")
+	now := time.Now()
+	writeNumberedSnapshots(t, snapshotConfig.SnapshotsDir, now.Add(-time.Hour), now.Add(-2*time.Hour))
+	snapshotsInfo, err := listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := getSetFingerprint(snapshotsInfo)
+	// a rotation keeps the names of the numbered snapshots
+	newestPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 0))
+	oldestPath := path.Join(snapshotConfig.SnapshotsDir, GetSnapshotDirName("t", "daily", 1))
+	err = os.RemoveAll(oldestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(newestPath, oldestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeNumberedSnapshots(t, snapshotConfig.SnapshotsDir, now)
+	snapshotsInfo, err = listConfigSnapshots(snapshotConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getSetFingerprint(snapshotsInfo) == fingerprint {
+		t.Error("the rotated set has the fingerprint of the old one")
+	}
+	if getSetFingerprint(snapshotsInfo) != getSetFingerprint(snapshotsInfo) {
+		t.Error("the fingerprint of the same set changed")
+	}
+}
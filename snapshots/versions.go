@@ -0,0 +1,81 @@
+package snapshots
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"peppeosmio/snapsync/structs"
+	"time"
+)
+
+// FileVersion is a distinct content of a file across the snapshots.
+type FileVersion struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string
+	// Snapshots holds the version, newest first
+	Snapshots []*structs.SnapshotInfo
+	// Path is where the version is in the newest of Snapshots
+	Path string
+}
+
+// GetFileVersions returns the versions of the absolute source path srcPath
+// in snapshotsInfo, newest first. Hard linked copies are recognized by their
+// inode without being read, the other copies are compared by content hash.
+func GetFileVersions(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo, srcPath string) (versions []*FileVersion, err error) {
+	dir, _, ok := snapshotConfig.GetSnapshotDir(srcPath)
+	if !ok {
+		return nil, fmt.Errorf("%s is not in any dir of %s", srcPath, snapshotConfig.SnapshotName)
+	}
+	versionsByInode := map[inodeKey]*FileVersion{}
+	versionsByHash := map[string]*FileVersion{}
+	for _, snapshotInfo := range snapshotsInfo {
+		filePath, _ := dir.GetPathInSnapshot(snapshotInfo.Abspath, srcPath)
+		info, err := os.Stat(filePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't stat %s: %s", filePath, err.Error())
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		key, _, hasInode := getDiskBytes(info)
+		if version, ok := versionsByInode[key]; hasInode && ok {
+			version.Snapshots = append(version.Snapshots, snapshotInfo)
+			continue
+		}
+		hash, err := hashFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		version, ok := versionsByHash[hash]
+		if !ok {
+			version = &FileVersion{Size: info.Size(), ModTime: info.ModTime(), Hash: hash, Path: filePath}
+			versionsByHash[hash] = version
+			versions = append(versions, version)
+		}
+		version.Snapshots = append(version.Snapshots, snapshotInfo)
+		if hasInode {
+			versionsByInode[key] = version
+		}
+	}
+	return versions, nil
+}
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("can't open %s: %s", filePath, err.Error())
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", fmt.Errorf("can't read %s: %s", filePath, err.Error())
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
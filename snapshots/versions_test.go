@@ -0,0 +1,70 @@
+package snapshots
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"peppeosmio/snapsync/structs"
+	"testing"
+)
+
+func TestGetFileVersions(t *testing.T) {
+	snapshotsDir := t.TempDir()
+	var snapshotsInfo []*structs.SnapshotInfo
+	for number := 0; number < 5; number++ {
+		snapshotPath := path.Join(snapshotsDir, GetSnapshotDirName("t", "daily", number))
+		err := os.MkdirAll(path.Join(snapshotPath, "src"), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshotsInfo = append(snapshotsInfo, &structs.SnapshotInfo{Abspath: snapshotPath, Number: number})
+	}
+	filePath := func(number int) string {
+		return path.Join(snapshotsInfo[number].Abspath, "src", "docs", "file")
+	}
+	// 0 has a new version, 1 is missing the file, 2 has a copy of the version
+	// that 3 and 4 share through a hard link
+	writeTestTree(t, snapshotsInfo[0].Abspath, map[string]string{"src/docs/file": "v2"})
+	writeTestTree(t, snapshotsInfo[2].Abspath, map[string]string{"src/docs/file": "v1"})
+	writeTestTree(t, snapshotsInfo[4].Abspath, map[string]string{"src/docs/file": "v1"})
+	err := os.MkdirAll(path.Dir(filePath(3)), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Link(filePath(4), filePath(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotConfig := &structs.SnapshotConfig{
+		SnapshotName: "t",
+		Dirs:         []structs.SnapshotDir{{SrcDirAbspath: "/home/user", DstDirInSnapshot: "src"}},
+	}
+	versions, err := GetFileVersions(snapshotConfig, snapshotsInfo, "/home/user/docs/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("got %d versions, want 2", len(versions))
+	}
+	want := []struct {
+		path    string
+		numbers []int
+	}{
+		{filePath(0), []int{0}},
+		{filePath(2), []int{2, 3, 4}},
+	}
+	for i, version := range versions {
+		var numbers []int
+		for _, snapshotInfo := range version.Snapshots {
+			numbers = append(numbers, snapshotInfo.Number)
+		}
+		if version.Path != want[i].path || fmt.Sprint(numbers) != fmt.Sprint(want[i].numbers) {
+			t.Errorf("version %d: got %s in %v, want %s in %v", i, version.Path, numbers, want[i].path, want[i].numbers)
+		}
+	}
+
+	_, err = GetFileVersions(snapshotConfig, snapshotsInfo, "/etc/file")
+	if err == nil {
+		t.Error("got no error for a path outside the dirs")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const controlCommandStatus = "status"
+
+// daemonStatus is the answer of the daemon to a status request
+type daemonStatus struct {
+	Pid       int               `json:"pid"`
+	StartedAt time.Time         `json:"started_at"`
+	Jobs      []daemonJobStatus `json:"jobs"`
+}
+
+type daemonJobStatus struct {
+	Name     string     `json:"name"`
+	Interval string     `json:"interval"`
+	Cron     string     `json:"cron"`
+	Running  bool       `json:"running"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+}
+
+type intervalStatus struct {
+	Name      string `json:"name"`
+	Interval  string `json:"interval"`
+	Snapshots int    `json:"snapshots"`
+	// Newest is the path of the newest snapshot of the interval
+	Newest       string     `json:"newest,omitempty"`
+	NewestAt     *time.Time `json:"newest_at,omitempty"`
+	NewestStatus string     `json:"newest_status,omitempty"`
+	Cron         string     `json:"cron,omitempty"`
+	Running      bool       `json:"running"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+}
+
+type statusOutput struct {
+	// Daemon is nil when no daemon serves the configs dir
+	Daemon    *daemonStatus    `json:"daemon"`
+	Intervals []intervalStatus `json:"intervals"`
+}
+
+func statusCommand(args []string) int {
+	flagSet := flag.NewFlagSet("status", flag.ExitOnError)
+	format := flagSet.String("format", outputFormatText, "Output format: text or json")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync status [<name>...]")
+		fmt.Fprintln(flagSet.Output(), "Shows the newest snapshot of every interval and, when the daemon is running, its schedule.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if *format != outputFormatText && *format != outputFormatJSON {
+		slog.Error(fmt.Sprintf("Unknown format %s, must be %s or %s", *format, outputFormatText, outputFormatJSON))
+		return exitUsage
+	}
+	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(*configsDir, *expandVars)
+	if err != nil {
+		slog.Error("Can't get snapshots configs in " + *configsDir + ": " + err.Error())
+		return exitError
+	}
+	if len(positional) > 0 {
+		selected := []*structs.SnapshotConfig{}
+		for _, snapshotName := range positional {
+			snapshotConfig := getSnapshotConfig(snapshotsConfigs, snapshotName)
+			if snapshotConfig == nil {
+				slog.Error("Snapshot template " + snapshotName + " does not exist.")
+				return exitError
+			}
+			selected = append(selected, snapshotConfig)
+		}
+		snapshotsConfigs = selected
+	}
+
+	output := statusOutput{Intervals: []intervalStatus{}}
+	daemon := daemonStatus{}
+	handled, err := callDaemon(*configsDir, controlRequest{Command: controlCommandStatus}, &daemon)
+	if err != nil {
+		slog.Warn(err.Error())
+	} else if handled {
+		output.Daemon = &daemon
+	}
+	for _, snapshotConfig := range snapshotsConfigs {
+		snapshotsInfo, err := snapshots.GetSnapshotsInfo(*configsDir, *expandVars, snapshotConfig.SnapshotName)
+		if err != nil {
+			slog.Error("Can't get snapshots of snapshot " + snapshotConfig.SnapshotName + ": " + err.Error())
+			return exitError
+		}
+		intervals := []string{}
+		for _, interval := range snapshotConfig.Intervals {
+			intervals = append(intervals, interval.Name)
+		}
+		intervals = append(intervals, structs.PreRestoreInterval)
+		for _, interval := range intervals {
+			status := intervalStatus{Name: snapshotConfig.SnapshotName, Interval: interval}
+			for _, snapshotInfo := range snapshotsInfo {
+				if snapshotInfo.Interval != interval {
+					continue
+				}
+				status.Snapshots++
+				if status.NewestAt == nil || snapshotInfo.Timestamp.After(*status.NewestAt) {
+					timestamp := snapshotInfo.Timestamp
+					status.Newest = snapshotInfo.Abspath
+					status.NewestAt = &timestamp
+					status.NewestStatus = snapshotInfo.Metadata.Status
+				}
+			}
+			if output.Daemon != nil {
+				for _, job := range output.Daemon.Jobs {
+					if job.Name == status.Name && job.Interval == status.Interval {
+						status.Cron = job.Cron
+						status.Running = job.Running
+						status.NextRun = job.NextRun
+					}
+				}
+			}
+			// pre restore snapshots are only shown when there are some
+			if interval == structs.PreRestoreInterval && status.Snapshots == 0 {
+				continue
+			}
+			output.Intervals = append(output.Intervals, status)
+		}
+	}
+	err = writeStatus(os.Stdout, *format, output)
+	if err != nil {
+		slog.Error("Can't write the status: " + err.Error())
+		return exitError
+	}
+	return exitOK
+}
+
+func writeStatus(writer io.Writer, format string, output statusOutput) error {
+	if format == outputFormatJSON {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	}
+	if output.Daemon == nil {
+		fmt.Fprintln(writer, "Daemon: not running")
+	} else {
+		fmt.Fprintf(writer, "Daemon: running since %s (pid %d)\n", output.Daemon.StartedAt.Local().Format(time.DateTime), output.Daemon.Pid)
+	}
+	fmt.Fprintln(writer)
+	tableWriter := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tableWriter, "NAME\tINTERVAL\tSNAPSHOTS\tNEWEST\tSTATUS\tNEXT RUN")
+	for _, status := range output.Intervals {
+		newest := "-"
+		if status.NewestAt != nil {
+			newest = status.NewestAt.Local().Format(time.DateTime)
+		}
+		newestStatus := status.NewestStatus
+		if len(newestStatus) == 0 {
+			newestStatus = "-"
+		}
+		nextRun := "-"
+		if status.Running {
+			nextRun = "running"
+		} else if status.NextRun != nil {
+			nextRun = status.NextRun.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tableWriter, "%s\t%s\t%d\t%s\t%s\t%s\n", status.Name, status.Interval, status.Snapshots, newest, newestStatus, nextRun)
+	}
+	return tableWriter.Flush()
+}
@@ -3,24 +3,105 @@ package structs
 import (
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+const (
+	EngineNative = "native"
+	EngineRsync  = "rsync"
+)
+
+const (
+	NamingNumber    = "number"
+	NamingTimestamp = "timestamp"
+)
+
+const (
+	PromoteMove = "move"
+	PromoteLink = "link"
+)
+
+// SnapshotTimestampLayout is used in the dir name of snapshots with timestamp naming.
+// It has no dots or colons so that it is safe in a <name>.<interval>.<timestamp> path.
+const SnapshotTimestampLayout = "2006-01-02T15-04-05Z"
+
+// SnapshotMetadataFileName is the file at the root of every snapshot that
+// holds its SnapshotMetadata. Being inside the snapshot it follows the renames.
+const SnapshotMetadataFileName = ".snapsync-metadata.json"
+
+// SnapshotIndexFileName is the gzipped file at the root of every snapshot
+// listing the files in it, so that they can be searched without walking the snapshot.
+const SnapshotIndexFileName = ".snapsync-index.json.gz"
+
+// PreRestoreInterval is the interval of the snapshots taken before a restore
+// overwrites the sources. It can't be the name of a configured interval.
+const PreRestoreInterval = "pre-restore"
+
+// PreRestoreTag is the tag of the snapshots taken before a restore
+const PreRestoreTag = "pre-restore"
+
 type Config struct {
 	LogLevel  string `yaml:"log_level"`
+	Engine    string `yaml:"engine"`
 	CpPath    string `yaml:"cp_path"`
 	RSyncPath string `yaml:"rsync_path"`
+	Shell     string `yaml:"shell"`
+	// ServeListen, ServeUsername and ServePassword configure snapsync serve
+	ServeListen   string `yaml:"serve_listen"`
+	ServeUsername string `yaml:"serve_username"`
+	ServePassword string `yaml:"serve_password"`
 }
 
 type SnapshotConfig struct {
-	SnapshotName                  string        `yaml:"snapshot_name"`
-	Dirs                          []SnapshotDir `yaml:"dirs"`
-	SnapshotsDir                  string        `yaml:"snapshots_dir"`
-	Interval                      string        `yaml:"interval"`
-	Retention                     int           `yaml:"retention"`
-	Cron                          string        `yaml:"cron"`
-	AlwaysRunPostSnapshotCommands bool          `yaml:"always_run_post_snapshot_commands"`
-	PreSnapshotCommands           []string      `yaml:"pre_snapshot_commands"`
-	PostSnapshotCommands          []string      `yaml:"post_snapshot_commands"`
+	SnapshotName string        `yaml:"snapshot_name"`
+	Dirs         []SnapshotDir `yaml:"dirs"`
+	SnapshotsDir string        `yaml:"snapshots_dir"`
+	Interval     string        `yaml:"interval"`
+	Retention    int           `yaml:"retention"`
+	Naming       string        `yaml:"naming"`
+	Cron         string        `yaml:"cron"`
+	// RetentionPolicy replaces Retention when set
+	RetentionPolicy *RetentionPolicy `yaml:"retention_policy"`
+	// MinFreeSpace is a size like 20G or a percentage of the filesystem like 10%
+	MinFreeSpace string `yaml:"min_free_space"`
+	MaxTotalSize string `yaml:"max_total_size"`
+	// MinSnapshots is how many snapshots space pruning never goes below, at least 1
+	MinSnapshots int `yaml:"min_snapshots"`
+	// PreRestoreRetention is how long the snapshot taken before a restore is
+	// exempt from retention, like 7d
+	PreRestoreRetention string `yaml:"pre_restore_retention"`
+	// Intervals lists the tiers from the most to the least frequent. The first
+	// tier syncs the sources, the others promote the oldest snapshot of the tier
+	// below like rsnapshot. When empty, Interval, Retention and Cron are the only tier.
+	Intervals                     []SnapshotInterval `yaml:"intervals"`
+	AlwaysRunPostSnapshotCommands bool               `yaml:"always_run_post_snapshot_commands"`
+	PreSnapshotCommands           []string           `yaml:"pre_snapshot_commands"`
+	PostSnapshotCommands          []string           `yaml:"post_snapshot_commands"`
+}
+
+type SnapshotInterval struct {
+	Name            string           `yaml:"name"`
+	Retention       int              `yaml:"retention"`
+	Cron            string           `yaml:"cron"`
+	RetentionPolicy *RetentionPolicy `yaml:"retention_policy"`
+	// Promote is how the oldest snapshot of the tier below becomes the newest
+	// of this tier: moved (the default) or copied with hard links.
+	Promote string `yaml:"promote"`
+}
+
+// RetentionPolicy is evaluated against the creation time of the snapshots.
+// A snapshot is kept if any of the rules keeps it.
+type RetentionPolicy struct {
+	KeepLast    int `yaml:"keep_last"`
+	KeepHourly  int `yaml:"keep_hourly"`
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+	KeepYearly  int `yaml:"keep_yearly"`
+	// KeepWithin is a duration like 36h, 14d or 2w, counted back from the newest snapshot
+	KeepWithin string   `yaml:"keep_within"`
+	KeepTagged []string `yaml:"keep_tagged"`
 }
 
 type SnapshotDir struct {
@@ -29,14 +110,178 @@ type SnapshotDir struct {
 	Excludes         []string `yaml:"excludes"`
 }
 
+// GetSnapshotDir returns the dir of snapshotConfig that holds the absolute
+// source path srcPath and the path of srcPath relative to the dir. When dirs are
+// nested the innermost one is returned.
+func (snapshotConfig *SnapshotConfig) GetSnapshotDir(srcPath string) (dir *SnapshotDir, relPath string, ok bool) {
+	for i := range snapshotConfig.Dirs {
+		dirRelPath, dirOk := snapshotConfig.Dirs[i].GetRelPath(srcPath)
+		if dirOk && (!ok || len(snapshotConfig.Dirs[i].SrcDirAbspath) > len(dir.SrcDirAbspath)) {
+			dir = &snapshotConfig.Dirs[i]
+			relPath = dirRelPath
+			ok = true
+		}
+	}
+	return dir, relPath, ok
+}
+
+// GetSrcPath maps relPath, relative to the root of a snapshot of snapshotConfig,
+// back to the absolute source path it was copied from.
+func (snapshotConfig *SnapshotConfig) GetSrcPath(relPath string) (srcPath string, ok bool) {
+	bestLen := -1
+	for _, dir := range snapshotConfig.Dirs {
+		dstDir := strings.Trim(filepath.Clean("/"+dir.DstDirInSnapshot), "/")
+		dirRelPath := relPath
+		if len(dstDir) > 0 {
+			var found bool
+			dirRelPath, found = strings.CutPrefix(relPath, dstDir)
+			if !found || (len(dirRelPath) > 0 && dirRelPath[0] != '/') {
+				continue
+			}
+		}
+		if len(dstDir) > bestLen {
+			bestLen = len(dstDir)
+			srcPath = filepath.Join(dir.SrcDirAbspath, dirRelPath)
+			ok = true
+		}
+	}
+	return srcPath, ok
+}
+
+// GetRelPath returns the path of the absolute source path srcPath relative to
+// SrcDirAbspath, or false if it is outside of it.
+func (snapshotDir *SnapshotDir) GetRelPath(srcPath string) (string, bool) {
+	relPath, err := filepath.Rel(filepath.Clean(snapshotDir.SrcDirAbspath), filepath.Clean(srcPath))
+	if err != nil || !filepath.IsAbs(srcPath) || relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", false
+	}
+	return relPath, true
+}
+
+// GetPathInSnapshot returns where the absolute source path srcPath is in the
+// snapshot at snapshotPath, or false if it is outside of SrcDirAbspath.
+func (snapshotDir *SnapshotDir) GetPathInSnapshot(snapshotPath string, srcPath string) (string, bool) {
+	relPath, ok := snapshotDir.GetRelPath(srcPath)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(snapshotPath, snapshotDir.DstDirInSnapshot, relPath), true
+}
+
 type SnapshotInfo struct {
 	Abspath      string
 	SnapshotName string
 	Interval     string
-	Number       int
+	// Number is the position of the snapshot in its interval, 0 being the newest.
+	// For timestamp naming it is computed when listing instead of parsed from the name.
+	Number    int
+	Timestamp time.Time
+	// Timestamped is true when the dir name holds Timestamp instead of Number
+	Timestamped bool
+	Metadata    SnapshotMetadata
+}
+
+const (
+	SnapshotStatusSuccess = "success"
+	// SnapshotStatusPostCommandsFailed is a complete snapshot whose post snapshot commands failed
+	SnapshotStatusPostCommandsFailed = "post_commands_failed"
+	// SnapshotStatusUnknown is a snapshot whose metadata can't be read
+	SnapshotStatusUnknown = "unknown"
+)
+
+type SnapshotMetadata struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Status     string    `json:"status,omitempty"`
+	// Host and Version are the machine and the snapsync version that took the snapshot
+	Host    string `json:"host,omitempty"`
+	Version string `json:"version,omitempty"`
+	// ConfigHash is the sha256 of the SnapshotConfig that took the snapshot
+	ConfigHash string    `json:"config_hash,omitempty"`
+	Dirs       []DirRun  `json:"dirs,omitempty"`
+	Hooks      []HookRun `json:"hooks,omitempty"`
+	// Pinned snapshots are never pruned
+	Pinned bool          `json:"pinned,omitempty"`
+	Tags   []string      `json:"tags,omitempty"`
+	Note   string        `json:"note,omitempty"`
+	Size   *SnapshotSize `json:"size,omitempty"`
+	// KeepUntil exempts the snapshot from retention until then
+	KeepUntil *time.Time `json:"keep_until,omitempty"`
+	// Restore is set on the pre restore snapshots
+	Restore *RestoreRecord `json:"restore,omitempty"`
+}
+
+// SyncStats count what a sync of a dir did, like rsync --stats. Only regular
+// files are counted.
+type SyncStats struct {
+	Files     int64 `json:"files"`
+	TotalSize int64 `json:"total_size"`
+	// TransferredFiles were copied instead of being unchanged or hard linked
+	TransferredFiles int64 `json:"transferred_files"`
+	TransferredSize  int64 `json:"transferred_size"`
+	// SkippedFiles are the dangling symlinks and symlink loops the native
+	// engine left out of the snapshot
+	SkippedFiles int64 `json:"skipped_files,omitempty"`
+}
+
+// DirRun is the sync of a SnapshotDir while taking a snapshot
+type DirRun struct {
+	SrcDirAbspath    string `json:"src_dir_abspath"`
+	DstDirInSnapshot string `json:"dst_dir_in_snapshot"`
+	// Missing is true when the source dir didn't exist and the previous copy was kept
+	Missing         bool    `json:"missing,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	SyncStats
+}
+
+const (
+	HookPhasePre  = "pre"
+	HookPhasePost = "post"
+)
+
+// HookRun is a pre or post snapshot command run for the snapshot
+type HookRun struct {
+	Phase   string `json:"phase"`
+	Command string `json:"command"`
+	// ExitCode is -1 when the command couldn't run or was killed by a signal
+	ExitCode        int     `json:"exit_code"`
+	Stdout          string  `json:"stdout,omitempty"`
+	Stderr          string  `json:"stderr,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// TimedOut is set when the command was killed for running too long
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// RestoreRecord describes the restore that a pre restore snapshot can undo.
+type RestoreRecord struct {
+	// Snapshot is the path of the restored snapshot
+	Snapshot string `json:"snapshot"`
+	// Dirs are the source dirs saved by the pre restore snapshot
+	Dirs []string `json:"dirs,omitempty"`
+	// Paths are the restored paths, empty when every dir was restored
+	Paths []string `json:"paths,omitempty"`
+	// Missing are the restored paths or dirs that didn't exist before the restore
+	Missing []string `json:"missing,omitempty"`
+	Undone  bool     `json:"undone,omitempty"`
+}
+
+type SnapshotSize struct {
+	// Apparent is the sum of the file sizes, as if nothing was hard linked
+	Apparent int64 `json:"apparent"`
+	// Disk is the space taken by the snapshot on its own, counting every inode once
+	Disk int64 `json:"disk"`
+	// Exclusive is the space that only this snapshot uses, freed if it is deleted
+	Exclusive int64 `json:"exclusive"`
+	// SetFingerprint identifies the snapshots that existed when Exclusive was
+	// computed, since it changes when snapshots sharing files are added or removed
+	SetFingerprint string `json:"set_fingerprint"`
 }
 
+// Size returns the apparent size of the snapshot, from its metadata when cached.
 func (snapshotInfo *SnapshotInfo) Size() (size int64, err error) {
+	if snapshotInfo.Metadata.Size != nil {
+		return snapshotInfo.Metadata.Size.Apparent, nil
+	}
 	err = filepath.Walk(snapshotInfo.Abspath, func(_ string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
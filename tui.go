@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/tui"
+
+	"golang.org/x/exp/slog"
+)
+
+func tuiCommand(args []string) int {
+	flagSet := flag.NewFlagSet("tui", flag.ExitOnError)
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync tui")
+		fmt.Fprintln(flagSet.Output(), "Browse the snapshots in the terminal, compare the versions of the files and restore them.")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 0 {
+		flagSet.Usage()
+		return exitUsage
+	}
+	config, err := configs.LoadConfig(*configsDir, *expandVars)
+	if err != nil {
+		slog.Error("Can't get " + *configsDir + ": " + err.Error())
+		return exitError
+	}
+	logs := tui.NewLogWriter(os.Stderr)
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	err = tui.Run(config, *configsDir, *expandVars, logs)
+	if err != nil {
+		slog.Error(err.Error())
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,72 @@
+package tui
+
+import "fmt"
+
+// maxDiffCells bounds the memory of the line diff, len(a)*len(b)
+const maxDiffCells = 4_000_000
+
+const diffContext = 3
+
+// diffLines returns a unified-like diff of the lines of a and b, with some
+// lines of context around the changes.
+func diffLines(a []string, b []string) []string {
+	if len(a)*len(b) > maxDiffCells {
+		return []string{fmt.Sprintf("The files are too big to compare line by line (%d and %d lines)", len(a), len(b))}
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var all []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			all = append(all, "  "+a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			all = append(all, "+ "+b[j])
+			j++
+		default:
+			all = append(all, "- "+a[i])
+			i++
+		}
+	}
+
+	var lines []string
+	lastShown := -1
+	for index, line := range all {
+		if line[0] == ' ' {
+			continue
+		}
+		start := max(index-diffContext, lastShown+1)
+		if lastShown >= 0 && start > lastShown+1 {
+			lines = append(lines, "...")
+		}
+		for context := start; context < index; context++ {
+			lines = append(lines, all[context])
+		}
+		lines = append(lines, line)
+		lastShown = index
+		// the context after the change, unless another change comes first
+		for context := index + 1; context < len(all) && context <= index+diffContext && all[context][0] == ' '; context++ {
+			lines = append(lines, all[context])
+			lastShown = context
+		}
+	}
+	if len(lines) == 0 {
+		return []string{"No differences"}
+	}
+	return lines
+}
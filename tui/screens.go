@@ -0,0 +1,448 @@
+package tui
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/structs"
+	"peppeosmio/snapsync/utils"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxTextSize is the biggest file shown or diffed
+const maxTextSize = 4 * 1024 * 1024
+
+type configsScreen struct {
+	snapshotsConfigs []*structs.SnapshotConfig
+}
+
+func (configsScreen *configsScreen) title() string {
+	return "snapsync - snapshot configs"
+}
+
+func (configsScreen *configsScreen) lines() (lines []string) {
+	for _, snapshotConfig := range configsScreen.snapshotsConfigs {
+		lines = append(lines, fmt.Sprintf("%-20s  %d dirs  %s", snapshotConfig.SnapshotName, len(snapshotConfig.Dirs), snapshotConfig.SnapshotsDir))
+	}
+	return lines
+}
+
+func (configsScreen *configsScreen) help() string {
+	return "enter snapshots"
+}
+
+func (configsScreen *configsScreen) handle(app *app, current *frame, key string) (screen, error) {
+	if key != keyEnter || len(configsScreen.snapshotsConfigs) == 0 {
+		return nil, nil
+	}
+	snapshotConfig := configsScreen.snapshotsConfigs[current.cursor]
+	snapshotsInfo, err := snapshots.GetSnapshotsInfo(app.configsDir, app.expandVars, snapshotConfig.SnapshotName)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(snapshotsInfo, func(a *structs.SnapshotInfo, b *structs.SnapshotInfo) int {
+		return b.Timestamp.Compare(a.Timestamp)
+	})
+	return &snapshotsScreen{snapshotConfig: snapshotConfig, snapshotsInfo: snapshotsInfo}, nil
+}
+
+type snapshotsScreen struct {
+	snapshotConfig *structs.SnapshotConfig
+	// snapshotsInfo is sorted newest first, across the intervals
+	snapshotsInfo []*structs.SnapshotInfo
+}
+
+func (snapshotsScreen *snapshotsScreen) title() string {
+	return fmt.Sprintf("snapsync - snapshots of %s", snapshotsScreen.snapshotConfig.SnapshotName)
+}
+
+func (snapshotsScreen *snapshotsScreen) lines() (lines []string) {
+	for _, snapshotInfo := range snapshotsScreen.snapshotsInfo {
+		line := fmt.Sprintf("%-12s %3d  %s", snapshotInfo.Interval, snapshotInfo.Number, snapshotInfo.Timestamp.Local().Format(time.DateTime))
+		if snapshotInfo.Metadata.Size != nil {
+			line += "  " + utils.HumanReadableSize(snapshotInfo.Metadata.Size.Apparent)
+		}
+		if snapshotInfo.Metadata.Pinned {
+			line += "  pinned"
+		}
+		if len(snapshotInfo.Metadata.Tags) > 0 {
+			line += "  [" + strings.Join(snapshotInfo.Metadata.Tags, ", ") + "]"
+		}
+		if snapshotInfo.Metadata.Status == structs.SnapshotStatusPostCommandsFailed {
+			line += "  post snapshot commands failed"
+		}
+		if len(snapshotInfo.Metadata.Note) > 0 {
+			line += "  " + snapshotInfo.Metadata.Note
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (snapshotsScreen *snapshotsScreen) help() string {
+	return "enter browse  r restore all"
+}
+
+func (snapshotsScreen *snapshotsScreen) handle(app *app, current *frame, key string) (screen, error) {
+	if len(snapshotsScreen.snapshotsInfo) == 0 {
+		return nil, nil
+	}
+	snapshotInfo := snapshotsScreen.snapshotsInfo[current.cursor]
+	switch key {
+	case keyEnter:
+		return newTreeScreen(snapshotsScreen.snapshotConfig, snapshotsScreen.snapshotsInfo, snapshotInfo, "", map[string]bool{})
+	case "r":
+		_, err := app.restore(snapshotsScreen.snapshotConfig, snapshotInfo, nil)
+		return nil, err
+	}
+	return nil, nil
+}
+
+type treeEntry struct {
+	name    string
+	srcPath string
+	// path is where the entry is in the snapshot
+	path    string
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// treeScreen browses a dir of a snapshot. The paths are shown and marked as
+// the source paths they were copied from, which is what restore takes.
+type treeScreen struct {
+	snapshotConfig *structs.SnapshotConfig
+	snapshotsInfo  []*structs.SnapshotInfo
+	snapshotInfo   *structs.SnapshotInfo
+	// srcDir is the source path of the dir, empty for the dirs of the config
+	srcDir  string
+	entries []*treeEntry
+	// marks are shared by the tree screens of the snapshot
+	marks map[string]bool
+}
+
+func newTreeScreen(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo, snapshotInfo *structs.SnapshotInfo, srcDir string, marks map[string]bool) (*treeScreen, error) {
+	treeScreen := &treeScreen{snapshotConfig: snapshotConfig, snapshotsInfo: snapshotsInfo, snapshotInfo: snapshotInfo, srcDir: srcDir, marks: marks}
+	if len(srcDir) == 0 {
+		for _, dir := range snapshotConfig.Dirs {
+			dirPath, _ := dir.GetPathInSnapshot(snapshotInfo.Abspath, dir.SrcDirAbspath)
+			entry := &treeEntry{name: dir.SrcDirAbspath, srcPath: filepath.Clean(dir.SrcDirAbspath), path: dirPath, isDir: true}
+			if info, err := os.Stat(dirPath); err == nil {
+				entry.modTime = info.ModTime()
+			}
+			treeScreen.entries = append(treeScreen.entries, entry)
+		}
+		return treeScreen, nil
+	}
+	dir, _, ok := snapshotConfig.GetSnapshotDir(srcDir)
+	if !ok {
+		return nil, fmt.Errorf("%s is not in any dir of %s", srcDir, snapshotConfig.SnapshotName)
+	}
+	dirPath, _ := dir.GetPathInSnapshot(snapshotInfo.Abspath, srcDir)
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", dirPath, err.Error())
+	}
+	for _, dirEntry := range dirEntries {
+		entryPath := filepath.Join(dirPath, dirEntry.Name())
+		// the files of snapsync at the root of the snapshot aren't restored
+		if dirPath == filepath.Clean(snapshotInfo.Abspath) && (dirEntry.Name() == structs.SnapshotMetadataFileName || dirEntry.Name() == structs.SnapshotIndexFileName) {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		treeScreen.entries = append(treeScreen.entries, &treeEntry{
+			name:    dirEntry.Name(),
+			srcPath: filepath.Join(srcDir, dirEntry.Name()),
+			path:    entryPath,
+			isDir:   info.IsDir(),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	slices.SortStableFunc(treeScreen.entries, func(a *treeEntry, b *treeEntry) int {
+		if a.isDir != b.isDir {
+			if a.isDir {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	return treeScreen, nil
+}
+
+func (treeScreen *treeScreen) title() string {
+	location := treeScreen.srcDir
+	if len(location) == 0 {
+		location = "dirs"
+	}
+	title := fmt.Sprintf("%s %d (%s) - %s", treeScreen.snapshotInfo.Interval, treeScreen.snapshotInfo.Number, treeScreen.snapshotInfo.Timestamp.Local().Format(time.DateTime), location)
+	if len(treeScreen.marks) > 0 {
+		title += fmt.Sprintf(" - %d marked", len(treeScreen.marks))
+	}
+	return title
+}
+
+func (treeScreen *treeScreen) lines() (lines []string) {
+	for _, entry := range treeScreen.entries {
+		mark := " "
+		if treeScreen.marks[entry.srcPath] {
+			mark = "*"
+		}
+		name := entry.name
+		size := ""
+		if entry.isDir {
+			name += "/"
+		} else {
+			size = utils.HumanReadableSize(entry.size)
+		}
+		modTime := ""
+		if !entry.modTime.IsZero() {
+			modTime = entry.modTime.Local().Format(time.DateTime)
+		}
+		lines = append(lines, fmt.Sprintf("%s %10s  %19s  %s", mark, size, modTime, name))
+	}
+	return lines
+}
+
+func (treeScreen *treeScreen) help() string {
+	return "enter open  space mark  v versions  d diff with live  r restore"
+}
+
+func (treeScreen *treeScreen) handle(app *app, current *frame, key string) (screen, error) {
+	if len(treeScreen.entries) == 0 {
+		return nil, nil
+	}
+	entry := treeScreen.entries[current.cursor]
+	switch key {
+	case keyEnter:
+		if entry.isDir {
+			return newTreeScreen(treeScreen.snapshotConfig, treeScreen.snapshotsInfo, treeScreen.snapshotInfo, entry.srcPath, treeScreen.marks)
+		}
+		return newFileScreen(entry.srcPath, entry.path)
+	case " ":
+		if treeScreen.marks[entry.srcPath] {
+			delete(treeScreen.marks, entry.srcPath)
+		} else {
+			treeScreen.marks[entry.srcPath] = true
+		}
+		current.cursor++
+	case "v":
+		if entry.isDir {
+			return nil, fmt.Errorf("%s is a dir, versions are of files", entry.srcPath)
+		}
+		return newVersionsScreen(treeScreen.snapshotConfig, treeScreen.snapshotsInfo, entry.srcPath)
+	case "d":
+		if entry.isDir {
+			return nil, fmt.Errorf("%s is a dir, only files can be diffed", entry.srcPath)
+		}
+		return newDiffScreen(fmt.Sprintf("%s: snapshot -> live", entry.srcPath), entry.path, entry.srcPath)
+	case "r":
+		paths := []string{entry.srcPath}
+		if len(treeScreen.marks) > 0 {
+			paths = paths[:0]
+			for srcPath := range treeScreen.marks {
+				paths = append(paths, srcPath)
+			}
+			slices.Sort(paths)
+		}
+		restored, err := app.restore(treeScreen.snapshotConfig, treeScreen.snapshotInfo, paths)
+		if restored {
+			clear(treeScreen.marks)
+		}
+		return nil, err
+	}
+	return nil, nil
+}
+
+type versionsScreen struct {
+	snapshotConfig *structs.SnapshotConfig
+	srcPath        string
+	versions       []*snapshots.FileVersion
+}
+
+func newVersionsScreen(snapshotConfig *structs.SnapshotConfig, snapshotsInfo []*structs.SnapshotInfo, srcPath string) (*versionsScreen, error) {
+	versions, err := snapshots.GetFileVersions(snapshotConfig, snapshotsInfo, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	return &versionsScreen{snapshotConfig: snapshotConfig, srcPath: srcPath, versions: versions}, nil
+}
+
+func (versionsScreen *versionsScreen) title() string {
+	return fmt.Sprintf("snapsync - versions of %s", versionsScreen.srcPath)
+}
+
+func (versionsScreen *versionsScreen) lines() (lines []string) {
+	for i, version := range versionsScreen.versions {
+		var names []string
+		for _, snapshotInfo := range version.Snapshots {
+			names = append(names, fmt.Sprintf("%s %d", snapshotInfo.Interval, snapshotInfo.Number))
+		}
+		lines = append(lines, fmt.Sprintf("[%d] %10s  %s  sha256:%s  in %s", i, utils.HumanReadableSize(version.Size), version.ModTime.Local().Format(time.DateTime), version.Hash[:12], strings.Join(names, ", ")))
+	}
+	return lines
+}
+
+func (versionsScreen *versionsScreen) help() string {
+	return "enter view  d diff with older  c compare with live  r restore"
+}
+
+func (versionsScreen *versionsScreen) handle(app *app, current *frame, key string) (screen, error) {
+	if len(versionsScreen.versions) == 0 {
+		return nil, nil
+	}
+	version := versionsScreen.versions[current.cursor]
+	switch key {
+	case keyEnter:
+		return newFileScreen(fmt.Sprintf("%s [%d]", versionsScreen.srcPath, current.cursor), version.Path)
+	case "d":
+		if current.cursor == len(versionsScreen.versions)-1 {
+			return nil, fmt.Errorf("[%d] is the oldest version", current.cursor)
+		}
+		older := versionsScreen.versions[current.cursor+1]
+		return newDiffScreen(fmt.Sprintf("%s: [%d] -> [%d]", versionsScreen.srcPath, current.cursor+1, current.cursor), older.Path, version.Path)
+	case "c":
+		return newDiffScreen(fmt.Sprintf("%s: [%d] -> live", versionsScreen.srcPath, current.cursor), version.Path, versionsScreen.srcPath)
+	case "r":
+		_, err := app.restore(versionsScreen.snapshotConfig, version.Snapshots[0], []string{versionsScreen.srcPath})
+		return nil, err
+	}
+	return nil, nil
+}
+
+// textScreen shows the content of a file or a diff
+type textScreen struct {
+	text    string
+	content []string
+}
+
+func (textScreen *textScreen) title() string {
+	return textScreen.text
+}
+
+func (textScreen *textScreen) lines() []string {
+	return textScreen.content
+}
+
+func (textScreen *textScreen) help() string {
+	return ""
+}
+
+func (textScreen *textScreen) handle(app *app, current *frame, key string) (screen, error) {
+	return nil, nil
+}
+
+func newFileScreen(title string, filePath string) (*textScreen, error) {
+	lines, err := readTextLines(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &textScreen{text: title, content: lines}, nil
+}
+
+// newDiffScreen shows the changes from oldPath to newPath, a missing file
+// being empty.
+func newDiffScreen(title string, oldPath string, newPath string) (*textScreen, error) {
+	oldLines, err := readTextLines(oldPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	newLines, err := readTextLines(newPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &textScreen{text: title, content: diffLines(oldLines, newLines)}, nil
+}
+
+// readTextLines returns the lines of the text file at filePath. Binary files
+// and files bigger than maxTextSize are refused.
+func readTextLines(filePath string) (lines []string, err error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", filePath)
+	}
+	if info.Size() > maxTextSize {
+		return nil, fmt.Errorf("%s is bigger than %s", filePath, utils.HumanReadableSize(maxTextSize))
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", filePath, err.Error())
+	}
+	if bytes.IndexByte(content[:min(len(content), 8000)], 0) >= 0 {
+		return nil, fmt.Errorf("%s is a binary file", filePath)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), maxTextSize)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// restore asks where to restore paths of snapshotInfo, every dir when empty,
+// shows what would change and restores them if confirmed. restored is false
+// when the user cancels.
+func (app *app) restore(snapshotConfig *structs.SnapshotConfig, snapshotInfo *structs.SnapshotInfo, paths []string) (restored bool, err error) {
+	what := "every dir"
+	if len(paths) == 1 {
+		what = paths[0]
+	} else if len(paths) > 1 {
+		what = fmt.Sprintf("%d paths", len(paths))
+	}
+	key, err := app.prompt(fmt.Sprintf("Restore %s from %s %d to o: the original location, a: another dir? ", what, snapshotInfo.Interval, snapshotInfo.Number))
+	if err != nil {
+		return false, err
+	}
+	options := snapshots.RestoreOptions{Paths: paths}
+	switch key {
+	case "o":
+	case "a":
+		target, ok, err := app.readLine("Restore under dir: ")
+		if err != nil || !ok || len(target) == 0 {
+			return false, err
+		}
+		options.Target, err = filepath.Abs(target)
+		if err != nil {
+			return false, fmt.Errorf("can't get the absolute path of %s: %s", target, err.Error())
+		}
+	default:
+		return false, nil
+	}
+	previews, err := snapshots.PreviewRestore(snapshotInfo, snapshotConfig, options)
+	if err != nil {
+		return false, err
+	}
+	var counts []string
+	for _, action := range []string{snapshots.RestoreActionCreate, snapshots.RestoreActionOverwrite, snapshots.RestoreActionDelete} {
+		total := 0
+		for _, preview := range previews {
+			count, _ := preview.Count(action)
+			total += count
+		}
+		counts = append(counts, fmt.Sprintf("%d to %s", total, action))
+	}
+	key, err = app.prompt(fmt.Sprintf("Files %s. Restore? y/n ", strings.Join(counts, ", ")))
+	if err != nil || key != "y" {
+		return false, err
+	}
+	err = app.runOutside(func() error {
+		return snapshots.RestoreSnapshot(app.config, snapshotInfo, snapshotConfig, options)
+	})
+	if err != nil {
+		return false, err
+	}
+	app.status = "Restored " + what
+	return true, nil
+}
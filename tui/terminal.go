@@ -0,0 +1,191 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// terminal switches the tty to raw mode with stty, which keeps snapsync free
+// of terminal libraries, and reads single key presses from it.
+type terminal struct {
+	tty   *os.File
+	saved string
+	// signals gets SIGWINCH to refresh the size, and the signals that would
+	// kill snapsync leaving the terminal in raw mode
+	signals chan os.Signal
+	mutex   sync.Mutex
+	raw     bool
+	rows    int
+	columns int
+}
+
+const (
+	keyUp        = "up"
+	keyDown      = "down"
+	keyLeft      = "left"
+	keyRight     = "right"
+	keyPageUp    = "pgup"
+	keyPageDown  = "pgdown"
+	keyHome      = "home"
+	keyEnd       = "end"
+	keyEnter     = "enter"
+	keyBackspace = "backspace"
+	keyEscape    = "esc"
+	// keyInterrupt is ctrl-c, which doesn't send a signal in raw mode
+	keyInterrupt = "ctrl-c"
+)
+
+func runStty(tty *os.File, args ...string) (string, error) {
+	command := exec.Command("stty", args...)
+	command.Stdin = tty
+	output, err := command.Output()
+	if err != nil {
+		return "", fmt.Errorf("stty %s: %s", strings.Join(args, " "), err.Error())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func openTerminal() (*terminal, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("can't open the terminal: %s", err.Error())
+	}
+	saved, err := runStty(tty, "-g")
+	if err != nil {
+		tty.Close()
+		return nil, err
+	}
+	term := &terminal{tty: tty, saved: saved, signals: make(chan os.Signal, 1)}
+	term.updateSize()
+	signal.Notify(term.signals, syscall.SIGWINCH, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
+	go term.handleSignals()
+	err = term.enterRaw()
+	if err != nil {
+		term.close()
+		return nil, err
+	}
+	return term, nil
+}
+
+// enterRaw switches to raw mode and to the alternate screen.
+func (term *terminal) enterRaw() error {
+	term.mutex.Lock()
+	defer term.mutex.Unlock()
+	_, err := runStty(term.tty, "raw", "-echo")
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(term.tty, "\x1b[?1049h\x1b[?25l")
+	term.raw = true
+	return nil
+}
+
+// leaveRaw gives the terminal back as it was, for the output of other commands.
+func (term *terminal) leaveRaw() {
+	term.mutex.Lock()
+	defer term.mutex.Unlock()
+	term.leaveRawLocked()
+}
+
+func (term *terminal) leaveRawLocked() {
+	if !term.raw {
+		return
+	}
+	fmt.Fprint(term.tty, "\x1b[?25h\x1b[?1049l")
+	runStty(term.tty, term.saved)
+	term.raw = false
+}
+
+func (term *terminal) close() {
+	signal.Stop(term.signals)
+	close(term.signals)
+	term.leaveRaw()
+	term.tty.Close()
+}
+
+// handleSignals refreshes the size when the terminal is resized. On the other
+// signals it gives the terminal back and lets the signal kill snapsync as if
+// it wasn't handled.
+func (term *terminal) handleSignals() {
+	for received := range term.signals {
+		if received == syscall.SIGWINCH {
+			term.updateSize()
+			continue
+		}
+		// the lock is kept, the browser must not go back to raw mode
+		term.mutex.Lock()
+		term.leaveRawLocked()
+		signal.Reset(received)
+		syscall.Kill(os.Getpid(), received.(syscall.Signal))
+		return
+	}
+}
+
+// updateSize reads the rows and columns of the terminal, defaulting to 24x80.
+func (term *terminal) updateSize() {
+	rows, columns := 0, 0
+	output, err := runStty(term.tty, "size")
+	if err == nil {
+		fields := strings.Fields(output)
+		if len(fields) == 2 {
+			rows, _ = strconv.Atoi(fields[0])
+			columns, _ = strconv.Atoi(fields[1])
+		}
+	}
+	if rows <= 0 || columns <= 0 {
+		rows, columns = 24, 80
+	}
+	term.mutex.Lock()
+	defer term.mutex.Unlock()
+	term.rows, term.columns = rows, columns
+}
+
+// size returns the rows and columns of the terminal as of the last resize.
+func (term *terminal) size() (rows int, columns int) {
+	term.mutex.Lock()
+	defer term.mutex.Unlock()
+	return term.rows, term.columns
+}
+
+// readKey returns the name of a special key, or the character typed.
+func (term *terminal) readKey() (string, error) {
+	buffer := make([]byte, 16)
+	read, err := term.tty.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	input := string(buffer[:read])
+	switch input {
+	case "\x1b[A", "\x1bOA":
+		return keyUp, nil
+	case "\x1b[B", "\x1bOB":
+		return keyDown, nil
+	case "\x1b[C", "\x1bOC":
+		return keyRight, nil
+	case "\x1b[D", "\x1bOD":
+		return keyLeft, nil
+	case "\x1b[5~":
+		return keyPageUp, nil
+	case "\x1b[6~":
+		return keyPageDown, nil
+	case "\x1b[H", "\x1b[1~", "\x1bOH":
+		return keyHome, nil
+	case "\x1b[F", "\x1b[4~", "\x1bOF":
+		return keyEnd, nil
+	case "\r", "\n":
+		return keyEnter, nil
+	case "\x7f", "\x08":
+		return keyBackspace, nil
+	case "\x1b":
+		return keyEscape, nil
+	case "\x03":
+		return keyInterrupt, nil
+	}
+	return input, nil
+}
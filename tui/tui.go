@@ -0,0 +1,261 @@
+// Package tui implements the full-screen terminal browser of snapsync tui.
+package tui
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/structs"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// screen is a page of the browser, a list of lines the cursor moves on.
+type screen interface {
+	title() string
+	lines() []string
+	help() string
+	// handle reacts to a key that doesn't move the cursor, with current being
+	// the frame of the screen. It returns the screen to open, if any.
+	handle(app *app, current *frame, key string) (screen, error)
+}
+
+// frame is a screen in the stack of the open screens, with its scroll state
+type frame struct {
+	screen screen
+	cursor int
+	offset int
+}
+
+type app struct {
+	config     *structs.Config
+	configsDir string
+	expandVars bool
+	term       *terminal
+	logs       *LogWriter
+	frames     []*frame
+	status     string
+}
+
+// LogWriter is the output of the log while the browser runs. Log lines would
+// break the screen, so only the last one is kept and shown in the status line,
+// unless the browser is running a command in the normal screen.
+type LogWriter struct {
+	mutex       sync.Mutex
+	out         io.Writer
+	passthrough bool
+	last        string
+}
+
+func NewLogWriter(out io.Writer) *LogWriter {
+	return &LogWriter{out: out, passthrough: true}
+}
+
+func (logWriter *LogWriter) Write(p []byte) (int, error) {
+	logWriter.mutex.Lock()
+	defer logWriter.mutex.Unlock()
+	if logWriter.passthrough {
+		return logWriter.out.Write(p)
+	}
+	lines := strings.Split(strings.TrimSpace(string(p)), "\n")
+	logWriter.last = lines[len(lines)-1]
+	return len(p), nil
+}
+
+func (logWriter *LogWriter) setPassthrough(passthrough bool) {
+	logWriter.mutex.Lock()
+	defer logWriter.mutex.Unlock()
+	logWriter.passthrough = passthrough
+}
+
+// takeLast returns the last line logged since the previous call
+func (logWriter *LogWriter) takeLast() string {
+	logWriter.mutex.Lock()
+	defer logWriter.mutex.Unlock()
+	last := logWriter.last
+	logWriter.last = ""
+	return last
+}
+
+// Run shows the snapshots of the configs in configsDir until the user quits.
+// The log must be written to logs.
+func Run(config *structs.Config, configsDir string, expandVars bool, logs *LogWriter) error {
+	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(configsDir, expandVars)
+	if err != nil {
+		return fmt.Errorf("can't get snapshots configs in %s: %s", configsDir, err.Error())
+	}
+	term, err := openTerminal()
+	if err != nil {
+		return err
+	}
+	logs.setPassthrough(false)
+	defer func() {
+		term.close()
+		logs.setPassthrough(true)
+	}()
+	app := &app{config: config, configsDir: configsDir, expandVars: expandVars, term: term, logs: logs}
+	app.frames = []*frame{{screen: &configsScreen{snapshotsConfigs: snapshotsConfigs}}}
+	return app.loop()
+}
+
+func (app *app) loop() error {
+	for len(app.frames) > 0 {
+		current := app.frames[len(app.frames)-1]
+		rows, _ := app.term.size()
+		pageSize := max(rows-3, 1)
+		app.render(current)
+		key, err := app.term.readKey()
+		if err != nil {
+			return fmt.Errorf("can't read the terminal: %s", err.Error())
+		}
+		app.status = ""
+		switch key {
+		case "q", keyInterrupt:
+			return nil
+		case keyUp, "k":
+			current.cursor--
+		case keyDown, "j":
+			current.cursor++
+		case keyPageUp:
+			current.cursor -= pageSize
+		case keyPageDown:
+			current.cursor += pageSize
+		case keyHome, "g":
+			current.cursor = 0
+		case keyEnd, "G":
+			current.cursor = len(current.screen.lines()) - 1
+		case keyLeft, "h", keyBackspace, keyEscape:
+			app.frames = app.frames[:len(app.frames)-1]
+		default:
+			if key == keyRight || key == "l" {
+				key = keyEnter
+			}
+			next, err := current.screen.handle(app, current, key)
+			if err != nil {
+				app.status = err.Error()
+			}
+			if next != nil {
+				app.frames = append(app.frames, &frame{screen: next})
+			}
+		}
+		current.cursor = max(min(current.cursor, len(current.screen.lines())-1), 0)
+	}
+	return nil
+}
+
+// render draws the title, the lines of current around the cursor, the status and the help.
+func (app *app) render(current *frame) {
+	rows, columns := app.term.size()
+	pageSize := max(rows-3, 1)
+	lines := current.screen.lines()
+	current.cursor = max(min(current.cursor, len(lines)-1), 0)
+	if current.cursor < current.offset {
+		current.offset = current.cursor
+	}
+	if current.cursor >= current.offset+pageSize {
+		current.offset = current.cursor - pageSize + 1
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("\x1b[H\x1b[2J")
+	// reverse video for the title and the selected line
+	buffer.WriteString("\x1b[7m" + fitLine(current.screen.title(), columns) + "\x1b[0m\r\n")
+	for i := current.offset; i < current.offset+pageSize; i++ {
+		if i < len(lines) {
+			line := fitLine(lines[i], columns)
+			if i == current.cursor {
+				line = "\x1b[7m" + line + "\x1b[0m"
+			}
+			buffer.WriteString(line)
+		}
+		buffer.WriteString("\r\n")
+	}
+	status := app.status
+	if logged := app.logs.takeLast(); len(status) == 0 && len(logged) > 0 {
+		status = logged
+	}
+	if len(status) == 0 && len(lines) > 0 {
+		status = fmt.Sprintf("%d/%d", current.cursor+1, len(lines))
+	}
+	buffer.WriteString(fitLine(status, columns) + "\r\n")
+	buffer.WriteString("\x1b[2m" + fitLine(current.screen.help()+"  h back  q quit", columns) + "\x1b[0m")
+	app.term.tty.Write(buffer.Bytes())
+}
+
+// fitLine makes line safe to print and cuts it at columns runes. File names
+// and contents can hold escape sequences that must not reach the terminal.
+func fitLine(line string, columns int) string {
+	var builder strings.Builder
+	count := 0
+	for _, r := range strings.ReplaceAll(line, "\t", "    ") {
+		if count >= columns {
+			break
+		}
+		if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) || r == utf8.RuneError {
+			r = '?'
+		}
+		builder.WriteRune(r)
+		count++
+	}
+	return builder.String()
+}
+
+// prompt shows question in the status line and returns the next key.
+func (app *app) prompt(question string) (string, error) {
+	rows, columns := app.term.size()
+	fmt.Fprintf(app.term.tty, "\x1b[%d;1H\x1b[2K%s", rows-1, fitLine(question, columns))
+	return app.term.readKey()
+}
+
+// readLine reads a line in the status line, or returns false if the user
+// pressed escape.
+func (app *app) readLine(question string) (string, bool, error) {
+	var input []rune
+	for {
+		key, err := app.prompt(question + string(input))
+		if err != nil {
+			return "", false, err
+		}
+		switch key {
+		case keyEnter:
+			return string(input), true, nil
+		case keyEscape, keyInterrupt:
+			return "", false, nil
+		case keyBackspace:
+			if len(input) > 0 {
+				input = input[:len(input)-1]
+			}
+		default:
+			if len(key) > 1 && key[0] == '\x1b' {
+				continue
+			}
+			for _, r := range key {
+				if r >= 0x20 && r != 0x7f {
+					input = append(input, r)
+				}
+			}
+		}
+	}
+}
+
+// runOutside runs run in the normal screen, so that its log is visible, and
+// waits for a key before going back to the browser.
+func (app *app) runOutside(run func() error) error {
+	app.term.leaveRaw()
+	app.logs.setPassthrough(true)
+	err := run()
+	if err != nil {
+		fmt.Fprintln(app.term.tty, "Error: "+err.Error())
+	}
+	fmt.Fprint(app.term.tty, "Press enter to go back")
+	// the terminal is in cooked mode, the read returns at the end of the line
+	app.term.tty.Read(make([]byte, 256))
+	app.logs.setPassthrough(false)
+	rawErr := app.term.enterRaw()
+	if rawErr != nil {
+		return rawErr
+	}
+	return err
+}
@@ -4,10 +4,28 @@ import (
 	"fmt"
 	"path"
 	"peppeosmio/snapsync/structs"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Version is the snapsync version, set at build time with
+// -ldflags "-X peppeosmio/snapsync/utils.Version=v1.2.3"
+var Version = ""
+
+// GetVersion returns Version, or the module version for go install builds.
+func GetVersion() string {
+	if len(Version) > 0 {
+		return Version
+	}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if ok && len(buildInfo.Main.Version) > 0 {
+		return buildInfo.Main.Version
+	}
+	return "(devel)"
+}
+
 func HumanReadableSize(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
@@ -25,18 +43,68 @@ func GetInfoFromSnapshotPath(snapshotPath string) (snapshotInfo *structs.Snapsho
 	snapshotDirName := strings.TrimSuffix(path.Base(snapshotPath), "/")
 	items := strings.Split(snapshotDirName, ".")
 	if len(items) != 3 {
-		return nil, fmt.Errorf("snapshot name must be in format <name>.<interval>.<number>")
+		return nil, fmt.Errorf("snapshot name must be in format <name>.<interval>.<number> or <name>.<interval>.<timestamp>")
 	}
 	name := items[0]
 	interval := items[1]
-	number, err := strconv.Atoi(items[2])
-	if err != nil {
-		return nil, fmt.Errorf("can't parse snapshot number: %s", snapshotPath)
-	}
-	return &structs.SnapshotInfo{
+	snapshotInfo = &structs.SnapshotInfo{
 		Abspath:      snapshotPath,
 		SnapshotName: name,
 		Interval:     interval,
-		Number:       number,
-	}, nil
+	}
+	number, err := strconv.Atoi(items[2])
+	if err == nil {
+		snapshotInfo.Number = number
+		return snapshotInfo, nil
+	}
+	timestamp, err := time.Parse(structs.SnapshotTimestampLayout, items[2])
+	if err != nil {
+		return nil, fmt.Errorf("can't parse snapshot number or timestamp: %s", snapshotPath)
+	}
+	snapshotInfo.Timestamp = timestamp
+	snapshotInfo.Timestamped = true
+	return snapshotInfo, nil
+}
+
+// ParseDuration is like time.ParseDuration but also accepts days (d), weeks (w)
+// and years of 365 days (y) as a single unit, like 14d.
+func ParseDuration(duration string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	}
+	for suffix, unit := range units {
+		if !strings.HasSuffix(duration, suffix) {
+			continue
+		}
+		count, err := strconv.Atoi(strings.TrimSuffix(duration, suffix))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", duration)
+		}
+		return time.Duration(count) * unit, nil
+	}
+	return time.ParseDuration(duration)
+}
+
+// ParseSize parses sizes like 512M, 1.5G or 2TiB into bytes. Units are powers
+// of 1024 like HumanReadableSize, a plain number is in bytes.
+func ParseSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	trimmed := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(size, "B"), "i"), "b")
+	multiplier := int64(1)
+	if len(trimmed) > 0 {
+		exp := strings.IndexByte("KMGTPE", strings.ToUpper(trimmed[len(trimmed)-1:])[0])
+		if exp >= 0 {
+			trimmed = trimmed[:len(trimmed)-1]
+			for i := 0; i <= exp; i++ {
+				multiplier *= 1024
+			}
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(trimmed), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return int64(value * float64(multiplier)), nil
 }
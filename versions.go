@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"peppeosmio/snapsync/configs"
+	"peppeosmio/snapsync/snapshots"
+	"peppeosmio/snapsync/utils"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// versionsEntry is a version of a file in the output of the versions command
+type versionsEntry struct {
+	Index     int       `json:"index"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	Sha256    string    `json:"sha256"`
+	Snapshots []string  `json:"snapshots"`
+	// version is used to print or restore the version
+	version *snapshots.FileVersion
+}
+
+func versionsCommand(args []string) int {
+	flagSet := flag.NewFlagSet("versions", flag.ExitOnError)
+	name := flagSet.String("name", "", "Only look in the snapshots of this snapshot config")
+	format := flagSet.String("format", outputFormatText, "Output format: text or json")
+	printIndex := flagSet.Int("print", -1, "Write the content of the version with this index to stdout")
+	restoreIndex := flagSet.Int("restore", -1, "Restore the version with this index")
+	target := flagSet.String("target", "", "With --restore, recreate the path under this dir instead of overwriting it")
+	yes := flagSet.Bool("yes", false, "With --restore, don't ask for confirmation")
+	configsDir, expandVars, err := addConfigFlags(flagSet)
+	if err != nil {
+		slog.Error("Can't get default config path: " + err.Error())
+		return exitError
+	}
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: snapsync versions <abs-path> [--print INDEX | --restore INDEX [--target DIR] [--yes]]")
+		flagSet.PrintDefaults()
+	}
+	positional := parseInterspersed(flagSet, args)
+	if len(positional) != 1 || !filepath.IsAbs(positional[0]) {
+		flagSet.Usage()
+		return exitUsage
+	}
+	if *printIndex >= 0 && *restoreIndex >= 0 {
+		slog.Error("Only one of --print and --restore can be used")
+		return exitUsage
+	}
+	if *format != outputFormatText && *format != outputFormatJSON {
+		slog.Error(fmt.Sprintf("Unknown format %s, must be %s or %s", *format, outputFormatText, outputFormatJSON))
+		return exitUsage
+	}
+	srcPath := filepath.Clean(positional[0])
+
+	config, err := configs.LoadConfig(*configsDir, *expandVars)
+	if err != nil {
+		slog.Error("Can't get " + *configsDir + ": " + err.Error())
+		return exitError
+	}
+	snapshotsConfigs, err := configs.LoadSnapshotsConfigs(*configsDir, *expandVars)
+	if err != nil {
+		slog.Error("Can't get snapshots configs in " + *configsDir + ": " + err.Error())
+		return exitError
+	}
+	entries := []*versionsEntry{}
+	covered := false
+	for _, snapshotConfig := range snapshotsConfigs {
+		if len(*name) > 0 && snapshotConfig.SnapshotName != *name {
+			continue
+		}
+		if _, _, ok := snapshotConfig.GetSnapshotDir(srcPath); !ok {
+			continue
+		}
+		covered = true
+		snapshotsInfo, err := snapshots.GetSnapshotsInfo(*configsDir, *expandVars, snapshotConfig.SnapshotName)
+		if err != nil {
+			slog.Error("Can't get snapshots of snapshot " + snapshotConfig.SnapshotName + ": " + err.Error())
+			return exitError
+		}
+		sortSnapshotsForList(snapshotsInfo, listSortDate)
+		versions, err := snapshots.GetFileVersions(snapshotConfig, snapshotsInfo, srcPath)
+		if err != nil {
+			slog.Error("Can't get the versions of " + srcPath + ": " + err.Error())
+			return exitError
+		}
+		for _, version := range versions {
+			entry := &versionsEntry{
+				Index:   len(entries),
+				Name:    snapshotConfig.SnapshotName,
+				Size:    version.Size,
+				ModTime: version.ModTime,
+				Sha256:  version.Hash,
+				version: version,
+			}
+			for _, snapshotInfo := range version.Snapshots {
+				entry.Snapshots = append(entry.Snapshots, fmt.Sprintf("%s %d", snapshotInfo.Interval, snapshotInfo.Number))
+			}
+			entries = append(entries, entry)
+		}
+	}
+	if !covered {
+		slog.Error("No snapshot config covers " + srcPath)
+		return exitNothingToRestore
+	}
+
+	index := max(*printIndex, *restoreIndex)
+	if index >= len(entries) {
+		slog.Error(fmt.Sprintf("There is no version %d of %s", index, srcPath))
+		return exitNothingToRestore
+	}
+	if *printIndex >= 0 {
+		file, err := os.Open(entries[index].version.Path)
+		if err != nil {
+			slog.Error("Can't open the version: " + err.Error())
+			return exitError
+		}
+		defer file.Close()
+		_, err = io.Copy(os.Stdout, file)
+		if err != nil {
+			slog.Error("Can't print the version: " + err.Error())
+			return exitError
+		}
+		return exitOK
+	}
+	if *restoreIndex >= 0 {
+		entry := entries[index]
+		options := restoreOptions{
+			selector: snapshots.SnapshotSelector{Number: -1, Path: entry.version.Snapshots[0].Abspath},
+			restore:  snapshots.RestoreOptions{Paths: []string{srcPath}},
+			yes:      *yes,
+		}
+		if len(*target) > 0 {
+			options.restore.Target, err = filepath.Abs(*target)
+			if err != nil {
+				slog.Error("Can't get the absolute path of " + *target + ": " + err.Error())
+				return exitUsage
+			}
+		}
+		return restore(config, *configsDir, *expandVars, entry.Name, options)
+	}
+
+	if *format == outputFormatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(entries)
+		if err != nil {
+			slog.Error("Can't write the versions: " + err.Error())
+			return exitError
+		}
+		return exitOK
+	}
+	if len(entries) == 0 {
+		fmt.Printf("%s is in no snapshot\n", srcPath)
+		return exitOK
+	}
+	for _, entry := range entries {
+		fmt.Printf("[%d] %s  %s  %s  sha256:%s  in %s\n", entry.Index, entry.Name, utils.HumanReadableSize(entry.Size), entry.ModTime.Local().Format(time.DateTime), entry.Sha256[:12], strings.Join(entry.Snapshots, ", "))
+	}
+	return exitOK
+}